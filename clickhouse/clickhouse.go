@@ -0,0 +1,402 @@
+// Package clickhouse is a Store for ClickHouse, connecting over its HTTP
+// interface.
+//
+// ClickHouse has no transactions, so each statement of a migration is
+// checkpointed as it completes, and a failed file resumes after the last
+// statement which succeeded. The meta tables use ReplacingMergeTree, so rows
+// are never updated in place: a newer row replaces an older one with the same
+// key, and deleted rows are replaced by tombstones.
+package clickhouse
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/egtann/migrate"
+	"github.com/jmoiron/sqlx"
+	chhttp "github.com/mailru/go-clickhouse/v2"
+	"github.com/pkg/errors"
+)
+
+type DB struct {
+	connURL string
+
+	// cluster, if set, is added to DDL as ON CLUSTER.
+	cluster string
+
+	// Embed the sqlx DB struct
+	*sqlx.DB
+}
+
+// Option configures a DB.
+type Option func(*DB)
+
+// WithCluster runs DDL on every host in the named cluster by adding ON
+// CLUSTER to statements which don't specify a cluster, including those which
+// create the meta tables. The meta tables are replicated, so every host must
+// have the default_replica_path and default_replica_name settings, which
+// ClickHouse provides by default. Macros such as {cluster} are allowed.
+func WithCluster(name string) Option {
+	return func(db *DB) { db.cluster = name }
+}
+
+// New connects to the HTTP interface with the given settings. ALTER TABLE
+// mutations, such as UPDATE and DELETE, wait until they complete on every
+// replica, so later statements see their effects.
+func New(
+	user, pass, host, dbName string,
+	port int,
+	opts ...Option,
+) *DB {
+	cfg := chhttp.NewConfig()
+	cfg.User = user
+	cfg.Password = pass
+	cfg.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	cfg.Database = dbName
+	cfg.KillQueryOnErr = true
+	cfg.Params["mutations_sync"] = "2"
+	db := &DB{connURL: cfg.FormatDSN()}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// Exec runs q, adding ON CLUSTER if it's DDL and a cluster is set.
+func (db *DB) Exec(q string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.onCluster(q), args...)
+}
+
+// ExecContext runs q, adding ON CLUSTER if it's DDL and a cluster is set.
+func (db *DB) ExecContext(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.onCluster(q), args...)
+}
+
+func (db *DB) MetaExists() (bool, error) {
+	var n int
+	q := `
+		SELECT count() FROM system.tables
+		WHERE database = currentDatabase() AND name = 'meta'`
+	if err := db.Get(&n, q); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db *DB) CreateMetaVersionIfNotExists() (migrate.MetaVersion, error) {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS metaversion (
+		version UInt32,
+		migraterelease String,
+		createdat DateTime64(6, 'UTC') DEFAULT now64(6)
+	) ENGINE = %s ORDER BY tuple()`, db.engine())
+	if _, err := db.Exec(q); err != nil {
+		return migrate.MetaVersion{}, errors.Wrap(err,
+			"create metaversion table")
+	}
+	return db.GetMetaVersion()
+}
+
+// GetMetaVersion reports the version of the meta tables without changing
+// them. It's zero if there's no metaversion table.
+func (db *DB) GetMetaVersion() (migrate.MetaVersion, error) {
+	var v migrate.MetaVersion
+	var n int
+	q := `
+		SELECT count() FROM system.tables
+		WHERE database = currentDatabase() AND name = 'metaversion'`
+	if err := db.Get(&n, q); err != nil {
+		return v, errors.Wrap(err, "metaversion exists")
+	}
+	if n == 0 {
+		return v, nil
+	}
+
+	// The latest row is the current version, whether or not older rows
+	// have been merged away
+	q = `
+		SELECT version, migraterelease FROM metaversion
+		ORDER BY createdat DESC LIMIT 1`
+	err := db.Get(&v, q)
+	switch {
+	case err == sql.ErrNoRows:
+		return v, nil
+	case err != nil:
+		return v, errors.Wrap(err, "get version")
+	}
+	return v, nil
+}
+
+func (db *DB) CreateMetaIfNotExists() error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS meta (
+		filename String,
+		md5 String,
+		content String,
+		deleted UInt8 DEFAULT 0,
+		createdat DateTime64(6, 'UTC') DEFAULT now64(6)
+	) ENGINE = %s ORDER BY filename`, db.engine())
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaCheckpointsIfNotExists() error {
+	q := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS metacheckpoints (
+		filename String,
+		idx UInt32,
+		md5 String,
+		content String,
+		deleted UInt8 DEFAULT 0,
+		createdat DateTime64(6, 'UTC') DEFAULT now64(6)
+	) ENGINE = %s ORDER BY (filename, idx)`, db.engine())
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metacheckpoints table")
+	}
+	return nil
+}
+
+// engine for the meta tables, which keeps the latest row for each key.
+func (db *DB) engine() string {
+	if db.cluster != "" {
+		return "ReplicatedReplacingMergeTree(createdat)"
+	}
+	return "ReplacingMergeTree(createdat)"
+}
+
+func (db *DB) GetMigrations() ([]migrate.Migration, error) {
+	migrations := []migrate.Migration{}
+	q := `
+		SELECT filename, content, md5 AS checksum
+		FROM meta FINAL WHERE deleted = 0`
+	err := db.Select(&migrations, q)
+	return migrations, err
+}
+
+func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
+	checkpoints := []string{}
+	q := `
+		SELECT md5 FROM metacheckpoints FINAL
+		WHERE filename = ? AND deleted = 0
+		ORDER BY idx`
+	err := db.Select(&checkpoints, q, filename)
+	return checkpoints, err
+}
+
+// UpsertMigration inserts a row for the file, which replaces any earlier row.
+func (db *DB) UpsertMigration(filename, content, checksum string) error {
+	return db.InsertMigration(filename, content, checksum)
+}
+
+// ReplaceMigrations records the new migration before deleting the old ones,
+// so if it fails part way through, the old migrations remain and the history
+// can be repaired by hand.
+func (db *DB) ReplaceMigrations(
+	old []string,
+	filename, content, checksum string,
+) error {
+	if err := db.InsertMigration(filename, content, checksum); err != nil {
+		return errors.Wrap(err, "insert migration")
+	}
+	q := `
+		INSERT INTO meta (filename, content, md5, deleted)
+		SELECT filename, content, md5, 1 FROM meta FINAL
+		WHERE filename = ? AND deleted = 0`
+	for _, name := range old {
+		if name == filename {
+			continue
+		}
+		if _, err := db.Exec(q, name); err != nil {
+			return errors.Wrapf(err, "delete %s", name)
+		}
+	}
+	return nil
+}
+
+func (db *DB) InsertMetaCheckpoint(
+	filename, content, checksum string,
+	idx int,
+) error {
+	q := `
+		INSERT INTO metacheckpoints (filename, content, idx, md5)
+		VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(q, filename, content, idx, checksum)
+	return err
+}
+
+func (db *DB) InsertMigration(filename, content, checksum string) error {
+	q := `INSERT INTO meta (filename, content, md5) VALUES (?, ?, ?)`
+	_, err := db.Exec(q, filename, content, checksum)
+	return err
+}
+
+// DeleteMetaCheckpoints replaces each of the file's checkpoints with a
+// tombstone.
+func (db *DB) DeleteMetaCheckpoints(filename string) error {
+	q := `
+		INSERT INTO metacheckpoints (filename, idx, md5, content, deleted)
+		SELECT filename, idx, md5, content, 1 FROM metacheckpoints FINAL
+		WHERE filename = ? AND deleted = 0`
+	_, err := db.Exec(q, filename)
+	return err
+}
+
+func (db *DB) GetMetaCheckpointFilenames() ([]string, error) {
+	filenames := []string{}
+	q := `
+		SELECT DISTINCT filename FROM metacheckpoints FINAL
+		WHERE deleted = 0`
+	err := db.Select(&filenames, q)
+	return filenames, err
+}
+
+// CompleteMigration records the file in meta, then deletes its checkpoints.
+// ClickHouse can't do both atomically, but if the second step fails, the
+// checkpoints are reported as stale and deleted by the next Plan and Apply.
+func (db *DB) CompleteMigration(filename, content, checksum string) error {
+	if err := db.UpsertMigration(filename, content, checksum); err != nil {
+		return errors.Wrap(err, "upsert migration")
+	}
+	if err := db.DeleteMetaCheckpoints(filename); err != nil {
+		return errors.Wrap(err, "delete checkpoints")
+	}
+	return nil
+}
+
+// MetaUpgradeSQL returns the statements which upgrade the meta tables to
+// version. ClickHouse support began at version 2, so its meta tables are
+// always created at the current version and there are no upgrades yet.
+func (db *DB) MetaUpgradeSQL(
+	version int,
+	migrations []migrate.Migration,
+) ([]migrate.MetaStatement, error) {
+	return nil, fmt.Errorf("unknown meta version %d", version)
+}
+
+// UpgradeMeta runs stmts in order and records v as the meta version.
+// ClickHouse has no transactions, so an upgrade which fails part way through
+// must be completed by hand.
+func (db *DB) UpgradeMeta(
+	v migrate.MetaVersion,
+	stmts []migrate.MetaStatement,
+) error {
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt.SQL, stmt.Args...); err != nil {
+			return errors.Wrapf(err, "exec %q", stmt.SQL)
+		}
+	}
+	q := `INSERT INTO metaversion (version, migraterelease) VALUES (?, ?)`
+	if _, err := db.Exec(q, v.Version, v.Release); err != nil {
+		return errors.Wrap(err, "insert metaversion")
+	}
+	return nil
+}
+
+func (db *DB) Open() error {
+	// The HTTP interface is stateless, so settings only persist between
+	// statements within a session
+	byt := make([]byte, 16)
+	if _, err := rand.Read(byt); err != nil {
+		return errors.Wrap(err, "read rand")
+	}
+	cfg, err := chhttp.ParseDSN(db.connURL)
+	if err != nil {
+		return errors.Wrap(err, "parse dsn")
+	}
+	cfg.Params["session_id"] = "migrate_" + hex.EncodeToString(byt)
+	db.DB, err = sqlx.Open("chhttp", cfg.FormatDSN())
+	if err != nil {
+		return errors.Wrap(err, "open db connection")
+	}
+
+	// Use a single connection, since a session can only run one statement
+	// at a time
+	db.SetMaxOpenConns(1)
+	return nil
+}
+
+// SetTimeouts sets max_execution_time and lock_acquire_timeout for the
+// session. Both have a resolution of seconds, so they're rounded up.
+func (db *DB) SetTimeouts(statement, lock time.Duration) error {
+	secs := func(d time.Duration) int64 {
+		return int64((d + time.Second - 1) / time.Second)
+	}
+	q := fmt.Sprintf(`SET max_execution_time = %d`, secs(statement))
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set max_execution_time")
+	}
+
+	// Zero restores ClickHouse's default of two minutes, as it has no
+	// way to wait forever
+	lockSecs := int64(120)
+	if lock > 0 {
+		lockSecs = secs(lock)
+	}
+	q = fmt.Sprintf(`SET lock_acquire_timeout = %d`, lockSecs)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set lock_acquire_timeout")
+	}
+	return nil
+}
+
+func (db *DB) IsLockTimeout(err error) bool {
+	var chErr *chhttp.Error
+	if !errors.As(err, &chErr) {
+		return false
+	}
+	return chErr.Code == 473 // DEADLOCK_AVOIDED
+}
+
+// regexOnCluster matches the ON CLUSTER clause of a statement.
+var regexOnCluster = regexp.MustCompile(`(?i)\sON\s+CLUSTER\s`)
+
+// regexDDL matches the start of DDL statements which take ON CLUSTER after
+// the name of the object they change. Temporary tables exist only on the
+// host which creates them, so they're excluded.
+var regexDDL = regexp.MustCompile(`(?is)^(?:` +
+	`(?:CREATE|ATTACH)(?:\s+OR\s+REPLACE)?\s+` +
+	`(?:TABLE|DATABASE|(?:MATERIALIZED\s+)?VIEW|DICTIONARY|FUNCTION)` +
+	`(?:\s+IF\s+NOT\s+EXISTS)?` +
+	`|(?:DROP|DETACH)\s+` +
+	`(?:TABLE|DATABASE|VIEW|DICTIONARY|FUNCTION)(?:\s+IF\s+EXISTS)?` +
+	`|ALTER\s+TABLE` +
+	`|TRUNCATE(?:\s+TABLE)?(?:\s+IF\s+EXISTS)?` +
+	`)\s+` + name + `(?:\.` + name + `)?`)
+
+// regexRename matches statements which take ON CLUSTER at their end.
+var regexRename = regexp.MustCompile(`(?is)^(?:RENAME|EXCHANGE)\s+(?:TABLES?|DATABASE|DICTIONARY)\s`)
+
+// name matches an identifier, which may be quoted.
+const name = "(?:`(?:[^`\\\\]|\\\\.)*`|\"(?:[^\"\\\\]|\\\\.)*\"|[A-Za-z_][A-Za-z0-9_]*)"
+
+// onCluster adds ON CLUSTER to q if it's DDL which doesn't already have it.
+func (db *DB) onCluster(q string) string {
+	if db.cluster == "" || regexOnCluster.MatchString(q) {
+		return q
+	}
+	clause := " ON CLUSTER " + quoteString(db.cluster)
+	if loc := regexDDL.FindStringIndex(q); loc != nil {
+		return q[:loc[1]] + clause + q[loc[1]:]
+	}
+	if regexRename.MatchString(q) {
+		return strings.TrimRight(q, " \t\r\n;") + clause
+	}
+	return q
+}
+
+// quoteString as a ClickHouse string literal.
+func quoteString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + r.Replace(s) + "'"
+}
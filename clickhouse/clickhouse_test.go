@@ -0,0 +1,209 @@
+package clickhouse
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/egtann/migrate"
+	"github.com/egtann/migrate/internal/fakesql"
+	"github.com/jmoiron/sqlx"
+	chhttp "github.com/mailru/go-clickhouse/v2"
+	"github.com/pkg/errors"
+)
+
+func TestOnCluster(t *testing.T) {
+	db := &DB{cluster: "{cluster}"}
+	tcs := []struct {
+		have string
+		want string
+	}{{
+		have: "CREATE TABLE IF NOT EXISTS events (id UInt64) ENGINE = MergeTree ORDER BY id",
+		want: "CREATE TABLE IF NOT EXISTS events ON CLUSTER '{cluster}' (id UInt64) ENGINE = MergeTree ORDER BY id",
+	}, {
+		have: "ALTER TABLE analytics.`events` ADD COLUMN name String",
+		want: "ALTER TABLE analytics.`events` ON CLUSTER '{cluster}' ADD COLUMN name String",
+	}, {
+		have: "CREATE MATERIALIZED VIEW daily TO totals AS SELECT 1",
+		want: "CREATE MATERIALIZED VIEW daily ON CLUSTER '{cluster}' TO totals AS SELECT 1",
+	}, {
+		have: "drop table if exists events",
+		want: "drop table if exists events ON CLUSTER '{cluster}'",
+	}, {
+		have: "RENAME TABLE a TO b, c TO d",
+		want: "RENAME TABLE a TO b, c TO d ON CLUSTER '{cluster}'",
+	}, {
+		have: "ALTER TABLE events ON CLUSTER other DROP COLUMN name",
+		want: "ALTER TABLE events ON CLUSTER other DROP COLUMN name",
+	}, {
+		have: "CREATE TEMPORARY TABLE scratch (id UInt64)",
+		want: "CREATE TEMPORARY TABLE scratch (id UInt64)",
+	}, {
+		have: "INSERT INTO events (id) VALUES (1)",
+		want: "INSERT INTO events (id) VALUES (1)",
+	}}
+	for _, tc := range tcs {
+		if got := db.onCluster(tc.have); got != tc.want {
+			t.Errorf("expected %s, got %s", tc.want, got)
+		}
+	}
+
+	// Without a cluster, statements are unchanged
+	db.cluster = ""
+	if got := db.onCluster(tcs[0].have); got != tcs[0].have {
+		t.Fatalf("expected no change, got %s", got)
+	}
+}
+
+func TestCreateMetaIfNotExists(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	check(t, db.CreateMetaIfNotExists())
+	q := srv.Log()[0].SQL
+	if !strings.Contains(q, "ENGINE = ReplacingMergeTree(createdat)") ||
+		strings.Contains(q, "ON CLUSTER") {
+		t.Fatalf("expected a local ReplacingMergeTree, got %s", q)
+	}
+
+	srv.Reset()
+	db.cluster = "analytics"
+	check(t, db.CreateMetaCheckpointsIfNotExists())
+	q = srv.Log()[0].SQL
+	if !strings.Contains(q, "metacheckpoints ON CLUSTER 'analytics' (") ||
+		!strings.Contains(q, "ReplicatedReplacingMergeTree(createdat)") {
+		t.Fatalf("expected a replicated table on the cluster, got %s", q)
+	}
+}
+
+func TestCompleteMigration(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	err := db.CompleteMigration("2.sql", "SELECT 2;", "md5")
+	check(t, err)
+
+	// There's no transaction, so the file is recorded first, and its
+	// checkpoints are replaced by tombstones
+	qs := srv.Log()
+	if len(qs) != 2 {
+		t.Fatalf("expected 2 statements, got %+v", qs)
+	}
+	if !strings.HasPrefix(qs[0].SQL, "INSERT INTO meta ") {
+		t.Fatalf("expected the file to be recorded first, got %s",
+			qs[0].SQL)
+	}
+	if !strings.Contains(qs[1].SQL, "SELECT filename, idx, md5, content, 1") ||
+		qs[1].Args[0] != "2.sql" {
+		t.Fatalf("expected tombstones for 2.sql, got %+v", qs[1])
+	}
+}
+
+func TestReplaceMigrations(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	err := db.ReplaceMigrations([]string{"1.sql", "2.sql"}, "2_squash.sql",
+		"SELECT 1;", "md5")
+	check(t, err)
+
+	qs := srv.Log()
+	if len(qs) != 3 || qs[0].Args[0] != "2_squash.sql" {
+		t.Fatalf("expected 2_squash.sql to be recorded first, got %+v", qs)
+	}
+	if qs[1].Args[0] != "1.sql" || qs[2].Args[0] != "2.sql" {
+		t.Fatalf("expected tombstones for 1.sql and 2.sql, got %+v",
+			qs[1:])
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	check(t, db.SetTimeouts(90*time.Second, 1500*time.Millisecond))
+	check(t, db.SetTimeouts(0, 0))
+	want := strings.Join([]string{
+		"SET max_execution_time = 90",
+		"SET lock_acquire_timeout = 2",
+		"SET max_execution_time = 0",
+		"SET lock_acquire_timeout = 120",
+	}, ",")
+	if got := srv.Summary(); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestIsLockTimeout(t *testing.T) {
+	db := New("default", "", "127.0.0.1", "migrate_test", 8123)
+	err := errors.Wrap(&chhttp.Error{Code: 473}, "exec")
+	if !db.IsLockTimeout(err) {
+		t.Fatal("expected a lock timeout")
+	}
+	if db.IsLockTimeout(&chhttp.Error{Code: 159}) {
+		t.Fatal("expected a statement timeout not to be a lock timeout")
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	fsys := fstest.MapFS{"1.sql": {Data: []byte(`
+		CREATE TABLE events (id UInt64) ENGINE = MergeTree ORDER BY id;
+		ALTER TABLE events ADD COLUMN name String;`)}}
+
+	db, srv := newDB(t, func(q string, args []driver.Value) (*fakesql.Rows, error) {
+		if strings.Contains(q, "FROM system.tables") {
+			return &fakesql.Rows{
+				Cols: []string{"count()"},
+				Data: [][]driver.Value{{int64(0)}},
+			}, nil
+		}
+		return &fakesql.Rows{}, nil
+	})
+	db.cluster = "analytics"
+	defer db.Close()
+
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	check(t, m.Init())
+	plan, err := m.Plan()
+	check(t, err)
+	srv.Reset()
+	check(t, m.Apply(plan))
+
+	// Each statement runs on the cluster and is checkpointed in turn
+	var got []string
+	for _, q := range srv.Log() {
+		switch {
+		case strings.HasPrefix(q.SQL, "CREATE TABLE events"),
+			strings.HasPrefix(q.SQL, "ALTER TABLE events"):
+			if !strings.Contains(q.SQL, "ON CLUSTER 'analytics'") {
+				t.Fatalf("expected ON CLUSTER, got %s", q.SQL)
+			}
+			got = append(got, "exec")
+		case strings.Contains(q.SQL, "INSERT INTO metacheckpoints ("+
+			"filename, content, idx, md5)"):
+			got = append(got, "checkpoint")
+		}
+	}
+	if strings.Join(got, ",") != "exec,checkpoint,exec,checkpoint" {
+		t.Fatalf("expected each statement to be checkpointed, got %v",
+			got)
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDB connects to a fake driver, so the tests run without a server.
+func newDB(t *testing.T, respond fakesql.Responder) (*DB, *fakesql.Server) {
+	sqlDB, srv := fakesql.Open(respond)
+	db := &DB{DB: sqlx.NewDb(sqlDB, "chhttp")}
+	db.SetMaxOpenConns(1)
+	return db, srv
+}
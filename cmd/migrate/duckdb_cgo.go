@@ -0,0 +1,14 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"github.com/egtann/migrate"
+	"github.com/egtann/migrate/duckdb"
+)
+
+// newDuckDB returns a Store for the DuckDB file at path.
+func newDuckDB(path string) (migrate.Store, error) {
+	return duckdb.New(path), nil
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/egtann/migrate"
+)
+
+// newDuckDB fails, since the DuckDB driver requires cgo.
+func newDuckDB(path string) (migrate.Store, error) {
+	return nil, errors.New("duckdb requires a build with cgo enabled")
+}
@@ -3,10 +3,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/egtann/migrate"
+	"github.com/egtann/migrate/clickhouse"
+	"github.com/egtann/migrate/mssql"
 	"github.com/egtann/migrate/mysql"
 	"github.com/egtann/migrate/postgres"
 	"github.com/egtann/migrate/sqlite"
@@ -14,41 +20,144 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// Exit codes identify common failures, so scripts can react to them.
+const (
+	exitError            = 1
+	exitChecksumMismatch = 3
+	exitOutOfOrder       = 4
+	exitMissingMigration = 5
+	exitStatement        = 6
+	exitLockTimeout      = 7
+	exitVersionTooNew    = 8
+	exitUpgradeRequired  = 9
+)
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+func exitCode(err error) int {
+	var (
+		checksumErr *migrate.ChecksumMismatchError
+		orderErr    *migrate.OutOfOrderError
+		missingErr  *migrate.MissingMigrationError
+		lockErr     *migrate.LockTimeoutError
+		stmtErr     *migrate.StatementError
+		versionErr  *migrate.SchemaVersionTooNewError
+		upgradeErr  *migrate.UpgradeRequiredError
+	)
+	switch {
+	case errors.As(err, &checksumErr):
+		return exitChecksumMismatch
+	case errors.As(err, &orderErr):
+		return exitOutOfOrder
+	case errors.As(err, &missingErr):
+		return exitMissingMigration
+
+	// Lock timeouts are wrapped in statement errors, so check them first
+	case errors.As(err, &lockErr):
+		return exitLockTimeout
+	case errors.As(err, &stmtErr):
+		return exitStatement
+	case errors.As(err, &versionErr):
+		return exitVersionTooNew
+	case errors.As(err, &upgradeErr):
+		return exitUpgradeRequired
+	default:
+		return exitError
 	}
 }
 
 func run() error {
-	migrationDir := flag.String("dir", ".", "migrations directory")
+	// An optional command may precede the flags. Without one, we migrate.
+	args := os.Args[1:]
+	var cmd string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "", "drift", "meta-upgrade", "squash", "tenants":
+	default:
+		return fmt.Errorf("unknown command %q (drift, meta-upgrade, squash, tenants allowed)", cmd)
+	}
+
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: migrate [drift|meta-upgrade|squash|tenants] [flags]\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(out, `
+exit codes:
+  1	error
+  3	checksum mismatch
+  4	migrations out of order
+  5	missing migrations
+  6	statement failed
+  7	lock timeout
+  8	migrate is older than the database's meta tables
+  9	meta tables must be upgraded (run meta-upgrade)
+`)
+	}
+	migrationDir := flag.String("dir", ".", "migrations directory, or comma-separated namespace=dir pairs to merge several")
 	dbName := flag.String("db", "", "database name")
 	dbUser := flag.String("u", "", "database user")
 	dbHost := flag.String("h", "127.0.0.1", "database host")
 	dbPort := flag.Int("p", 0, "database port")
-	dbType := flag.String("t", "mysql", "type of database (mysql, postgres, sqlite)")
+	dbType := flag.String("t", "mysql", "type of database (clickhouse, duckdb, mssql, mysql, postgres, sqlite)")
 	dry := flag.Bool("d", false, "dry run")
+	sslMode := flag.String("ssl-mode", "", "ssl mode (disable, prefer, require, verify-ca, verify-full; postgres also allow). defaults to verify-full with any ssl file, otherwise disable, or for postgres PGSSLMODE or prefer")
 	sslKey := flag.String("ssl-key", "", "path to client key pem")
 	sslCert := flag.String("ssl-cert", "", "path to client cert pem")
 	sslCA := flag.String("ssl-ca", "", "path to server ca pem")
 	sslServerName := flag.String("ssl-server", "", "server name for ssl")
 	skip := flag.String("skip", "", "skip up to this filename (inclusive)")
 	pass := flag.String("pass", "", "password (optional flag, if not provided it will be requested)")
+	expandEnv := flag.Bool("env", false, "expand ${VAR} in migrations with environment variables")
+	timeout := flag.Duration("timeout", 0, "cancel statements which run longer than this")
+	lockTimeout := flag.Duration("lock-timeout", 0, "fail statements which wait longer than this for a lock")
+	lockRetries := flag.Int("lock-retries", 0, "retry statements which fail due to -lock-timeout this many times")
+	lockBackoff := flag.Duration("lock-backoff", time.Second, "wait this long before the first lock retry, doubling each time")
+	logFormat := flag.String("log-format", "", "log structured output to stderr (json, text)")
+	through := flag.String("through", "", "squash migrations through this filename or number (inclusive)")
+	tenants := flag.String("tenants", "", "comma-separated schemas (postgres) or databases (mysql) to migrate")
+	tenantsQuery := flag.String("tenants-query", "", "query which returns the tenants to migrate, one per row")
+	concurrency := flag.Int("concurrency", 1, "migrate up to this many tenants at once")
+	continueOnError := flag.Bool("continue", false, "continue migrating other tenants after one fails")
+	dsn := flag.String("dsn", "", "postgres connection string or URL, instead of -db, -u, -h, -p, -pass and ssl flags. libpq environment variables like PGHOST fill in anything it omits")
+	foreignKeys := flag.Bool("foreign-keys", false, "sqlite: enforce foreign keys")
+	checks := flag.Bool("check", false, "sqlite: run foreign_key_check and integrity_check after each file")
+	cluster := flag.String("cluster", "", "clickhouse: add ON CLUSTER with this cluster to DDL")
 	version := flag.Bool("v", false, "print the version and exit")
-	flag.Parse()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
 
 	if *version {
-		fmt.Println("v1.0.0rc1")
+		if migrate.Release == "" {
+			fmt.Println("devel")
+			return nil
+		}
+		fmt.Println(migrate.Release)
 		return nil
 	}
 
+	sources, err := parseSources(*migrationDir)
+	if err != nil {
+		return err
+	}
+
 	// Restrict this program to specific files (read-only) and greatly
 	// restrict its possible syscalls
-	paths := []string{*migrationDir}
-	if *sslKey != "" {
-		paths = append(paths, *sslKey, *sslCert, *sslCA)
-		fmt.Println(paths)
+	var paths []string
+	for _, src := range sources {
+		paths = append(paths, src.dir)
+	}
+	for _, path := range []string{*sslKey, *sslCert, *sslCA} {
+		if path != "" {
+			paths = append(paths, path)
+		}
 	}
 	if err := migrate.Unveil(paths); err != nil {
 		return errors.Wrap(err, "unveil")
@@ -57,43 +166,130 @@ func run() error {
 		return errors.Wrap(err, "pledge")
 	}
 
-	if len(*dbName) == 0 {
+	if *dsn != "" {
+		if *dbType != "postgres" {
+			return errors.New("only postgres supports the -dsn flag")
+		}
+		if *dbName != "" || *dbUser != "" || *dbHost != "127.0.0.1" ||
+			*dbPort != 0 || *pass != "" || *sslMode != "" ||
+			*sslKey != "" || *sslCert != "" || *sslCA != "" {
+			return errors.New("-dsn cannot be combined with -db, -u, -h, -p, -pass or ssl flags")
+		}
+	}
+	if len(*dbName) == 0 && *dsn == "" &&
+		!(*dbType == "postgres" && os.Getenv("PGDATABASE") != "") {
 		return errors.New("database name cannot be empty. specify using the -db flag. run `migrate -h` for help")
 	}
-	if *dry && *skip != "" {
-		return errors.New("cannot skip ahead with dry mode")
+	if cmd != "" && *skip != "" {
+		return fmt.Errorf("%s does not support the -skip flag", cmd)
+	}
+	if cmd != "" && cmd != "meta-upgrade" && *dry {
+		return fmt.Errorf("%s does not support the -d flag", cmd)
+	}
+	if (cmd == "tenants") != (*tenants != "" || *tenantsQuery != "") {
+		return errors.New("tenants requires the -tenants or -tenants-query flag, which are only valid for tenants")
+	}
+	if *tenants != "" && *tenantsQuery != "" {
+		return errors.New("-tenants and -tenants-query cannot be used together")
+	}
+	if (cmd == "squash") != (*through != "") {
+		return errors.New("squash requires the -through flag, which is only valid for squash")
+	}
+
+	if (*sslKey == "") != (*sslCert == "") {
+		return errors.New("-ssl-key and -ssl-cert must be used together")
+	}
+	useSSL := *sslKey != "" || *sslCA != ""
+	if *sslMode != "" {
+		useSSL = *sslMode != "disable"
+		if !useSSL && (*sslKey != "" || *sslCA != "") {
+			return errors.New("-ssl-mode disable cannot be combined with ssl files")
+		}
+	}
+
+	if *dbType != "sqlite" && (*foreignKeys || *checks) {
+		return errors.New("only sqlite supports the -foreign-keys and -check flags")
+	}
+	if *dbType != "clickhouse" && *cluster != "" {
+		return errors.New("only clickhouse supports the -cluster flag")
 	}
 
 	// Validate flags for each type of database and set appropriate
 	// defaults
 	switch *dbType {
-	case "sqlite":
+	case "duckdb", "sqlite":
 		if *dbUser != "" {
-			return errors.New("sqlite does not support the -u flag")
+			return fmt.Errorf("%s does not support the -u flag", *dbType)
 		}
 		if *dbHost != "127.0.0.1" {
-			return errors.New("sqlite does not support the -h flag")
+			return fmt.Errorf("%s does not support the -h flag", *dbType)
 		}
 		if *dbPort != 0 {
-			return errors.New("sqlite does not support the -p flag")
+			return fmt.Errorf("%s does not support the -p flag", *dbType)
 		}
 		if *pass != "" {
-			return errors.New("sqlite does not support the -pass flag")
+			return fmt.Errorf("%s does not support the -pass flag", *dbType)
 		}
-		if *sslKey != "" || *sslCert != "" || *sslCA != "" || *sslServerName != "" {
-			return errors.New("sqlite does not support ssl")
+		if *sslMode != "" || *sslKey != "" || *sslCert != "" ||
+			*sslCA != "" || *sslServerName != "" {
+			return fmt.Errorf("%s does not support ssl", *dbType)
 		}
 	case "postgres":
 		if *sslServerName != "" {
 			return errors.New("postgres does not support the -ssl-server flag")
 		}
-		if *dbUser == "" {
+		switch *sslMode {
+		case "", "disable", "allow", "prefer", "require", "verify-ca",
+			"verify-full":
+		default:
+			return fmt.Errorf("unknown -ssl-mode %q", *sslMode)
+		}
+
+		// Anything left unset is taken from the libpq environment
+		// variables, when they're set
+		hostSet := false
+		flag.Visit(func(f *flag.Flag) { hostSet = hostSet || f.Name == "h" })
+		if !hostSet && os.Getenv("PGHOST") != "" {
+			*dbHost = ""
+		}
+		if *dbUser == "" && os.Getenv("PGUSER") == "" {
 			*dbUser = "postgres"
 		}
-		if *dbPort == 0 {
+		if *dbPort == 0 && os.Getenv("PGPORT") == "" {
 			*dbPort = 5432
 		}
+	case "clickhouse":
+		if *sslMode != "" || *sslKey != "" || *sslCert != "" ||
+			*sslCA != "" || *sslServerName != "" {
+			return errors.New("clickhouse does not support ssl flags")
+		}
+		if *dbUser == "" {
+			*dbUser = "default"
+		}
+		if *dbPort == 0 {
+			*dbPort = 8123
+		}
+	case "mssql":
+		if *sslMode != "" || *sslKey != "" || *sslCert != "" ||
+			*sslCA != "" || *sslServerName != "" {
+			return errors.New("mssql does not support ssl flags")
+		}
+		if *dbUser == "" {
+			*dbUser = "sa"
+		}
+		if *dbPort == 0 {
+			*dbPort = 1433
+		}
 	case "mysql":
+		switch *sslMode {
+		case "", "disable", "require", "verify-ca", "verify-full":
+		case "prefer":
+			if *sslKey != "" || *sslCA != "" {
+				return errors.New("mysql does not support ssl files with -ssl-mode prefer")
+			}
+		default:
+			return fmt.Errorf("unknown -ssl-mode %q", *sslMode)
+		}
 		if *dbUser == "" {
 			*dbUser = "root"
 		}
@@ -101,20 +297,21 @@ func run() error {
 			*dbPort = 3306
 		}
 	default:
-		return fmt.Errorf("unknown db type %q (mysql, postgres, sqlite allowed)", *dbType)
+		return fmt.Errorf("unknown db type %q (clickhouse, duckdb, mssql, mysql, postgres, sqlite allowed)", *dbType)
 	}
 
 	// Request database password if not provided as a flag argument
 	var password []byte
-	if *dbType != "sqlite" {
+	if *dbType != "sqlite" && *dbType != "duckdb" && *dsn == "" &&
+		!(*dbType == "postgres" && os.Getenv("PGPASSWORD") != "") {
 		if len(*pass) == 0 {
-			fmt.Printf("%s database password: ", *dbName)
+			fmt.Fprintf(os.Stderr, "%s database password: ", *dbName)
 			var err error
 			password, err = terminal.ReadPassword(int(syscall.Stdin))
 			if err != nil {
 				return errors.Wrap(err, "read pass")
 			}
-			fmt.Printf("\n")
+			fmt.Fprintf(os.Stderr, "\n")
 		} else {
 			password = []byte(*pass)
 		}
@@ -123,52 +320,353 @@ func run() error {
 	// Prepare our database-specific configs
 	var db migrate.Store
 	switch *dbType {
+	case "clickhouse":
+		var chOpts []clickhouse.Option
+		if *cluster != "" {
+			chOpts = append(chOpts, clickhouse.WithCluster(*cluster))
+		}
+		db = clickhouse.New(*dbUser, string(password), *dbHost,
+			*dbName, *dbPort, chOpts...)
+	case "duckdb":
+		var err error
+		db, err = newDuckDB(*dbName)
+		if err != nil {
+			return err
+		}
+	case "mssql":
+		db = mssql.New(*dbUser, string(password), *dbHost, *dbName,
+			*dbPort)
 	case "mysql":
 		var err error
 		db, err = mysql.New(*dbUser, string(password), *dbHost,
-			*dbName, *dbPort, *sslKey, *sslCert, *sslCA,
+			*dbName, *dbPort, *sslMode, *sslKey, *sslCert, *sslCA,
 			*sslServerName)
 		if err != nil {
 			return errors.Wrap(err, "mysql new")
 		}
 	case "sqlite":
-		db = sqlite.New(*dbName)
+		var sqliteOpts []sqlite.Option
+		if *foreignKeys {
+			sqliteOpts = append(sqliteOpts, sqlite.WithForeignKeys())
+		}
+		if *checks {
+			sqliteOpts = append(sqliteOpts, sqlite.WithChecks())
+		}
+		db = sqlite.New(*dbName, sqliteOpts...)
 	case "postgres":
+		if *dsn != "" {
+			db = postgres.NewFromDSN(*dsn)
+			break
+		}
 		db = postgres.New(*dbUser, string(password), *dbHost, *dbName,
-			*dbPort, *sslKey, *sslCert, *sslCA)
+			*dbPort, *sslMode, *sslKey, *sslCert, *sslCA)
 	default:
 		return fmt.Errorf("unknown db type: %s", *dbType)
 	}
-	if *sslKey != "" {
+	if useSSL {
 		fmt.Println("using tls")
 	}
 	if err := db.Open(); err != nil {
 		return errors.Wrap(err, "open")
 	}
 
+	var opts []migrate.Option
+	for _, src := range sources {
+		if src.namespace == "" {
+			opts = append(opts, migrate.WithDir(src.dir))
+			continue
+		}
+		opts = append(opts, migrate.WithSource(src.namespace,
+			os.DirFS(src.dir)))
+	}
+	if *expandEnv {
+		opts = append(opts, migrate.WithExpandEnv())
+	}
+	if *timeout > 0 {
+		opts = append(opts, migrate.WithStatementTimeout(*timeout))
+	}
+	if *lockTimeout > 0 {
+		opts = append(opts, migrate.WithLockTimeout(*lockTimeout))
+	}
+	if *lockRetries > 0 {
+		opts = append(opts, migrate.WithLockRetries(*lockRetries,
+			*lockBackoff))
+	}
+	switch *logFormat {
+	case "":
+		// Squash prints the new migration to stdout, so it logs to
+		// stderr
+		var log migrate.Logger = migrate.StdLogger{}
+		if cmd == "squash" {
+			log = stderrLogger{}
+		}
+		opts = append(opts, migrate.WithLogger(migrate.FromLogger(log)))
+	case "json":
+		h := slog.NewJSONHandler(os.Stderr, nil)
+		opts = append(opts, migrate.WithLogger(slog.New(h)))
+	case "text":
+		h := slog.NewTextHandler(os.Stderr, nil)
+		opts = append(opts, migrate.WithLogger(slog.New(h)))
+	default:
+		return fmt.Errorf("unknown log format %q (json, text allowed)",
+			*logFormat)
+	}
+	switch cmd {
+	case "drift":
+		return drift(db, opts)
+	case "meta-upgrade":
+		return metaUpgrade(db, *dry, opts)
+	case "squash":
+		return squash(db, *through, opts)
+	case "tenants":
+		cfg := migrate.TenantConfig{
+			Concurrency:     *concurrency,
+			ContinueOnError: *continueOnError,
+		}
+		return migrateTenants(db, *tenants, *tenantsQuery, cfg, opts)
+	}
+
 	// Prepare our database for migrations and collect the relevant files.
-	m, err := migrate.New(db, migrate.StdLogger{}, *migrationDir, *skip)
+	if *skip != "" {
+		opts = append(opts, migrate.WithBaseline(*skip))
+	}
+	m, err := migrate.New(db, opts...)
+	if err != nil {
+		return err
+	}
+
+	// A dry run only plans, which doesn't change the database
+	if !*dry {
+		if err = m.Init(); err != nil {
+			return err
+		}
+		if err = m.Upgrade(); err != nil {
+			return err
+		}
+	}
+	plan, err := m.Plan()
 	if err != nil {
 		return err
 	}
+	if plan.Empty() {
+		fmt.Println("up to date")
+		return nil
+	}
 	if *dry {
-		if len(m.Migrations) == len(m.Files) {
-			fmt.Println("up to date")
-			return nil
+		printPlan(plan)
+		return nil
+	}
+	if err = m.Apply(plan); err != nil {
+		return err
+	}
+	fmt.Println("success")
+	return nil
+}
+
+// metaUpgrade upgrades the meta tables, or with dry prints the SQL for each
+// upgrade without running it.
+func metaUpgrade(db migrate.Store, dry bool, opts []migrate.Option) error {
+	m, err := migrate.New(db, opts...)
+	if err != nil {
+		return err
+	}
+	if dry {
+		// Planning reports the upgrades without changing the database
+		plan, err := m.Plan()
+		if err != nil {
+			return err
 		}
-		for i := len(m.Migrations); i < len(m.Files); i++ {
-			fmt.Println("would migrate", m.Files[i].Name())
+		if len(plan.MetaUpgrades) == 0 {
+			fmt.Println("meta tables are up to date")
+			return nil
 		}
+		printMetaUpgrades(plan.MetaUpgrades)
 		return nil
 	}
-	migrated, err := m.Migrate()
+	if err = m.Init(); err != nil {
+		return err
+	}
+	ups, err := m.MetaUpgrades()
 	if err != nil {
 		return err
 	}
-	if migrated {
-		fmt.Println("success")
+	if len(ups) == 0 {
+		fmt.Println("meta tables are up to date")
+		return nil
+	}
+	if err = m.Upgrade(); err != nil {
+		return err
+	}
+	fmt.Println("success")
+	return nil
+}
+
+// printMetaUpgrades prints the SQL for each upgrade without running it.
+func printMetaUpgrades(ups []migrate.MetaUpgrade) {
+	for _, up := range ups {
+		fmt.Printf("-- would upgrade meta tables to v%d: %s\n",
+			up.Version, up.Description)
+		if up.Release != "" {
+			fmt.Printf("-- first supported by migrate %s\n", up.Release)
+		}
+		for _, stmt := range up.Statements {
+			fmt.Printf("%s;\n", strings.TrimSpace(stmt.SQL))
+			if len(stmt.Args) > 0 {
+				fmt.Printf("-- with %q\n", stmt.Args)
+			}
+		}
+	}
+}
+
+// printPlan describes the work in a plan without doing it.
+func printPlan(plan *migrate.Plan) {
+	if len(plan.MetaUpgrades) > 0 {
+		printMetaUpgrades(plan.MetaUpgrades)
+		fmt.Println("-- migrations can be planned once the meta tables are upgraded")
+		return
+	}
+	for _, filename := range plan.Baseline {
+		fmt.Println("would skip", filename)
+	}
+	for _, filename := range plan.Squashes {
+		fmt.Println("would record squashed", filename)
+	}
+	for _, filename := range plan.StaleCheckpoints {
+		fmt.Println("would delete stale checkpoints for", filename)
+	}
+	for _, step := range plan.Steps {
+		if step.Repeatable {
+			fmt.Println("would run repeatable", step.Filename)
+			continue
+		}
+		if step.Resume == len(step.Statements) {
+			fmt.Printf("would record %s, whose statements all ran\n",
+				step.Filename)
+			continue
+		}
+		if step.Resume > 0 {
+			fmt.Printf("would migrate %s from statement %d of %d\n",
+				step.Filename, step.Resume+1, len(step.Statements))
+			continue
+		}
+		fmt.Println("would migrate", step.Filename)
+	}
+}
+
+type source struct {
+	namespace string
+	dir       string
+}
+
+// parseSources parses the -dir flag, which is either a single directory or
+// comma-separated namespace=dir pairs.
+func parseSources(flagVal string) ([]source, error) {
+	parts := strings.Split(flagVal, ",")
+	if len(parts) == 1 && !strings.Contains(parts[0], "=") {
+		return []source{{dir: parts[0]}}, nil
+	}
+	sources := make([]source, len(parts))
+	for i, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad -dir %q: want namespace=dir", part)
+		}
+		sources[i] = source{namespace: kv[0], dir: kv[1]}
+	}
+	return sources, nil
+}
+
+// drift reports any differences between the live database and a scratch
+// database migrated from the files in dir. It returns an error if there are
+// any, so that we exit non-zero.
+func drift(db migrate.Store, opts []migrate.Option) error {
+	diffs, err := migrate.Drift(db, opts...)
+	if err != nil {
+		return errors.Wrap(err, "drift")
+	}
+	if len(diffs) == 0 {
+		fmt.Println("no drift")
+		return nil
+	}
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	return fmt.Errorf("found %d differences", len(diffs))
+}
+
+// squash prints a single migration which replaces every file through the
+// given one. Progress is logged to stderr, so the output can be redirected
+// into the new file.
+func squash(db migrate.Store, through string, opts []migrate.Option) error {
+	content, err := migrate.Squash(db, through, opts...)
+	if err != nil {
+		return errors.Wrap(err, "squash")
+	}
+	fmt.Print(content)
+	return nil
+}
+
+// migrateTenants migrates each tenant, either listed or returned by a query,
+// then prints a summary of each one's status. It returns an error if any
+// failed.
+func migrateTenants(
+	db migrate.Store,
+	list, query string,
+	cfg migrate.TenantConfig,
+	opts []migrate.Option,
+) error {
+	var names []string
+	if query != "" {
+		t, ok := db.(migrate.Tenanter)
+		if !ok {
+			return errors.New("store does not support tenants")
+		}
+		var err error
+		names, err = t.TenantNames(query)
+		if err != nil {
+			return errors.Wrap(err, "tenant names")
+		}
 	} else {
-		fmt.Println("up to date")
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return fmt.Errorf("empty tenant name in %q", list)
+			}
+			names = append(names, name)
+		}
+	}
+	results, err := migrate.MigrateTenants(db, names, cfg, opts...)
+	if err != nil {
+		return errors.Wrap(err, "migrate tenants")
+	}
+
+	var failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tSTATUS\tERROR")
+	for _, r := range results {
+		var msg string
+		if r.Err != nil {
+			failed++
+			msg = r.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Tenant, r.Status, msg)
+	}
+	if err = w.Flush(); err != nil {
+		return errors.Wrap(err, "flush")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tenants failed", failed,
+			len(results))
 	}
 	return nil
 }
+
+type stderrLogger struct{}
+
+func (l stderrLogger) Printf(s string, vs ...interface{}) {
+	fmt.Fprintf(os.Stderr, s, vs...)
+}
+
+func (l stderrLogger) Println(vs ...interface{}) {
+	fmt.Fprintln(os.Stderr, vs...)
+}
@@ -0,0 +1,528 @@
+//go:build cgo
+// +build cgo
+
+// Package duckdb is a Store for DuckDB database files. Its driver requires
+// cgo.
+package duckdb
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/egtann/migrate"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+// regexIndexColumns matches the column list at the end of a CREATE INDEX
+// statement.
+var regexIndexColumns = regexp.MustCompile(`(?s)\((.*)\)\s*;?\s*$`)
+
+type DB struct {
+	filepath string
+
+	// inTx is set between BeginMigration and CommitMigration or
+	// RollbackMigration.
+	inTx bool
+
+	// Embed the sqlx DB struct
+	*sqlx.DB
+}
+
+func New(dbFile string) *DB {
+	return &DB{filepath: dbFile}
+}
+
+func (db *DB) MetaExists() (bool, error) {
+	var n int
+	q := `
+		SELECT COUNT(*) FROM duckdb_tables()
+		WHERE schema_name = current_schema() AND table_name = 'meta'`
+	if err := db.Get(&n, q); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db *DB) CreateMetaVersionIfNotExists() (migrate.MetaVersion, error) {
+	q := `CREATE TABLE IF NOT EXISTS metaversion (
+		version INTEGER NOT NULL,
+		migraterelease TEXT NOT NULL
+	)`
+	if _, err := db.Exec(q); err != nil {
+		return migrate.MetaVersion{}, errors.Wrap(err,
+			"create metaversion table")
+	}
+	return db.GetMetaVersion()
+}
+
+// GetMetaVersion reports the version of the meta tables without changing
+// them. It's zero if there's no metaversion table.
+func (db *DB) GetMetaVersion() (migrate.MetaVersion, error) {
+	var v migrate.MetaVersion
+	var n int
+	q := `
+		SELECT COUNT(*) FROM duckdb_tables()
+		WHERE schema_name = current_schema() AND table_name = 'metaversion'`
+	if err := db.Get(&n, q); err != nil {
+		return v, errors.Wrap(err, "metaversion exists")
+	}
+	if n == 0 {
+		return v, nil
+	}
+
+	q = `SELECT version, migraterelease FROM metaversion`
+	err := db.Get(&v, q)
+	switch {
+	case err == sql.ErrNoRows:
+		return v, nil
+	case err != nil:
+		return v, errors.Wrap(err, "get version")
+	}
+	return v, nil
+}
+
+func (db *DB) CreateMetaIfNotExists() error {
+	q := `CREATE TABLE IF NOT EXISTS meta (
+		filename TEXT UNIQUE NOT NULL,
+		md5 TEXT NOT NULL,
+		content TEXT NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT current_timestamp
+	)`
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaCheckpointsIfNotExists() error {
+	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
+		filename TEXT NOT NULL,
+		content TEXT NOT NULL,
+		idx INTEGER NOT NULL,
+		md5 TEXT NOT NULL,
+		createdat TIMESTAMP NOT NULL DEFAULT current_timestamp,
+		PRIMARY KEY (filename, idx)
+	)`
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metacheckpoints table")
+	}
+	return nil
+}
+
+func (db *DB) GetMigrations() ([]migrate.Migration, error) {
+	migrations := []migrate.Migration{}
+	q := `SELECT filename, content, md5 AS checksum FROM meta`
+	err := db.Select(&migrations, q)
+	return migrations, err
+}
+
+func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
+	checkpoints := []string{}
+	q := `SELECT md5 FROM metacheckpoints WHERE filename=$1 ORDER BY idx`
+	err := db.Select(&checkpoints, q, filename)
+	return checkpoints, err
+}
+
+func (db *DB) UpsertMigration(filename, content, checksum string) error {
+	q := `
+		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
+		ON CONFLICT (filename) DO UPDATE
+		SET md5=excluded.md5, content=excluded.content`
+	_, err := db.Exec(q, filename, content, checksum)
+	return err
+}
+
+func (db *DB) ReplaceMigrations(
+	old []string,
+	filename, content, checksum string,
+) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := `DELETE FROM meta WHERE filename=$1`
+	for _, name := range old {
+		if _, err = tx.Exec(q, name); err != nil {
+			err = errors.Wrapf(err, "delete %s", name)
+			return
+		}
+	}
+	q = `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
+	if _, err = tx.Exec(q, filename, content, checksum); err != nil {
+		err = errors.Wrap(err, "insert migration")
+		return
+	}
+	return nil
+}
+
+func (db *DB) InsertMetaCheckpoint(
+	filename, content, checksum string,
+	idx int,
+) error {
+	q := `
+		INSERT INTO metacheckpoints (filename, content, idx, md5)
+		VALUES ($1, $2, $3, $4)`
+	_, err := db.Exec(q, filename, content, idx, checksum)
+	return err
+}
+
+func (db *DB) InsertMigration(filename, content, checksum string) error {
+	q := `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
+	_, err := db.Exec(q, filename, content, checksum)
+	return err
+}
+
+func (db *DB) DeleteMetaCheckpoints(filename string) error {
+	q := `DELETE FROM metacheckpoints WHERE filename=$1`
+	_, err := db.Exec(q, filename)
+	return err
+}
+
+func (db *DB) GetMetaCheckpointFilenames() ([]string, error) {
+	filenames := []string{}
+	q := `SELECT DISTINCT filename FROM metacheckpoints`
+	err := db.Select(&filenames, q)
+	return filenames, err
+}
+
+// CompleteMigration deletes a file's checkpoints and records it in meta in a
+// single transaction, or within the current one after BeginMigration.
+func (db *DB) CompleteMigration(
+	filename, content, checksum string,
+) (err error) {
+	var ex sqlx.Execer = db.DB
+	if !db.inTx {
+		var tx *sqlx.Tx
+		tx, err = db.Beginx()
+		if err != nil {
+			return errors.Wrap(err, "begin tx")
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+		ex = tx
+	}
+
+	q := `DELETE FROM metacheckpoints WHERE filename=$1`
+	if _, err = ex.Exec(q, filename); err != nil {
+		return errors.Wrap(err, "delete checkpoints")
+	}
+	q = `
+		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
+		ON CONFLICT (filename) DO UPDATE
+		SET md5=excluded.md5, content=excluded.content`
+	if _, err = ex.Exec(q, filename, content, checksum); err != nil {
+		return errors.Wrap(err, "upsert migration")
+	}
+	return nil
+}
+
+// MetaUpgradeSQL returns the statements which upgrade the meta tables to
+// version. DuckDB support began at version 2, so its meta tables are always
+// created at the current version and there are no upgrades yet.
+func (db *DB) MetaUpgradeSQL(
+	version int,
+	migrations []migrate.Migration,
+) ([]migrate.MetaStatement, error) {
+	return nil, fmt.Errorf("unknown meta version %d", version)
+}
+
+// UpgradeMeta runs stmts in a single transaction and records v as the meta
+// version.
+func (db *DB) UpgradeMeta(
+	v migrate.MetaVersion,
+	stmts []migrate.MetaStatement,
+) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt.SQL, stmt.Args...); err != nil {
+			return errors.Wrapf(err, "exec %q", stmt.SQL)
+		}
+	}
+	q := `DELETE FROM metaversion`
+	if _, err = tx.Exec(q); err != nil {
+		return errors.Wrap(err, "delete metaversion")
+	}
+	q = `INSERT INTO metaversion (version, migraterelease) VALUES ($1, $2)`
+	if _, err = tx.Exec(q, v.Version, v.Release); err != nil {
+		return errors.Wrap(err, "insert metaversion")
+	}
+	return nil
+}
+
+func (db *DB) Open() error {
+	var err error
+	db.DB, err = sqlx.Open("duckdb", db.filepath)
+	if err != nil {
+		return errors.Wrap(err, "open db connection")
+	}
+
+	// Use a single connection, so transactions begun by BeginMigration
+	// span every statement
+	db.SetMaxOpenConns(1)
+	return nil
+}
+
+// SetTimeouts does nothing but report success. DuckDB allows a single
+// process to write to a file, which fails to open rather than waiting while
+// another holds it, so there are no locks to wait on. It has no statement
+// timeout of its own, so that's enforced only by migrate canceling the
+// statement.
+func (db *DB) SetTimeouts(statement, lock time.Duration) error {
+	return nil
+}
+
+// BeginMigration starts a transaction on the single open connection.
+func (db *DB) BeginMigration() error {
+	_, err := db.Exec(`BEGIN TRANSACTION`)
+	db.inTx = err == nil
+	return err
+}
+
+func (db *DB) CommitMigration() error {
+	_, err := db.Exec(`COMMIT`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) RollbackMigration() error {
+	_, err := db.Exec(`ROLLBACK`)
+	db.inTx = false
+	return err
+}
+
+// IsLockTimeout always reports false, since statements never wait on locks.
+func (db *DB) IsLockTimeout(err error) bool {
+	return false
+}
+
+// Schema describes the tables in the current schema. NOT NULL constraints
+// are reported by each Column, rather than as constraints.
+func (db *DB) Schema() (*migrate.Schema, error) {
+	tables := []string{}
+	q := `
+		SELECT table_name FROM duckdb_tables()
+		WHERE schema_name = current_schema() AND NOT temporary`
+	if err := db.Select(&tables, q); err != nil {
+		return nil, errors.Wrap(err, "select tables")
+	}
+	schema := migrate.NewSchema()
+	for _, name := range tables {
+		if !migrate.IsMetaTable(name) {
+			schema.Table(name)
+		}
+	}
+
+	cols := []struct {
+		Table    string         `db:"table_name"`
+		Name     string         `db:"column_name"`
+		Type     string         `db:"data_type"`
+		Nullable bool           `db:"is_nullable"`
+		Default  sql.NullString `db:"column_default"`
+	}{}
+	q = `
+		SELECT table_name, column_name, data_type, is_nullable,
+			column_default
+		FROM duckdb_columns()
+		WHERE schema_name = current_schema()
+		ORDER BY table_name, column_index`
+	if err := db.Select(&cols, q); err != nil {
+		return nil, errors.Wrap(err, "select columns")
+	}
+	for _, c := range cols {
+		t, ok := schema.Tables[c.Table]
+		if !ok {
+			continue
+		}
+		t.Columns = append(t.Columns, migrate.Column{
+			Name:     c.Name,
+			Type:     c.Type,
+			Nullable: c.Nullable,
+			Default:  c.Default.String,
+		})
+	}
+
+	// duckdb_indexes doesn't report columns, so we take them from the
+	// statement which created the index
+	idxs := []struct {
+		Table  string `db:"table_name"`
+		Name   string `db:"index_name"`
+		Unique bool   `db:"is_unique"`
+		SQL    string `db:"sql"`
+	}{}
+	q = `
+		SELECT table_name, index_name, is_unique, sql
+		FROM duckdb_indexes()
+		WHERE schema_name = current_schema()`
+	if err := db.Select(&idxs, q); err != nil {
+		return nil, errors.Wrap(err, "select indexes")
+	}
+	for _, idx := range idxs {
+		t, ok := schema.Tables[idx.Table]
+		if !ok {
+			continue
+		}
+		index := migrate.Index{Name: idx.Name, Unique: idx.Unique}
+		if m := regexIndexColumns.FindStringSubmatch(idx.SQL); m != nil {
+			for _, col := range strings.Split(m[1], ",") {
+				index.Columns = append(index.Columns,
+					strings.TrimSpace(col))
+			}
+		}
+		t.Indexes = append(t.Indexes, index)
+	}
+
+	// Constraints are unnamed. The text of primary keys and unique
+	// constraints can repeat columns, so we describe those ourselves.
+	cons := []struct {
+		Table   string `db:"table_name"`
+		Type    string `db:"constraint_type"`
+		Text    string `db:"constraint_text"`
+		Columns string `db:"columns"`
+	}{}
+	q = `
+		SELECT table_name, constraint_type, constraint_text,
+			array_to_string(constraint_column_names, ', ') AS columns
+		FROM duckdb_constraints()
+		WHERE schema_name = current_schema()
+			AND constraint_type <> 'NOT NULL'`
+	if err := db.Select(&cons, q); err != nil {
+		return nil, errors.Wrap(err, "select constraints")
+	}
+	for _, c := range cons {
+		t, ok := schema.Tables[c.Table]
+		if !ok {
+			continue
+		}
+		def := c.Text
+		switch c.Type {
+		case "PRIMARY KEY", "UNIQUE":
+			def = fmt.Sprintf("%s (%s)", c.Type, c.Columns)
+		}
+		t.Constraints = append(t.Constraints, migrate.Constraint{
+			Type:       c.Type,
+			Definition: def,
+		})
+	}
+	for _, t := range schema.Tables {
+		sort.Slice(t.Indexes, func(i, j int) bool {
+			return t.Indexes[i].Name < t.Indexes[j].Name
+		})
+		sort.Slice(t.Constraints, func(i, j int) bool {
+			return t.Constraints[i].Definition <
+				t.Constraints[j].Definition
+		})
+	}
+	return schema, nil
+}
+
+// DumpSchema returns the statements which created every table, view and
+// index in the current schema, in the order they were created.
+func (db *DB) DumpSchema() ([]string, error) {
+	objs := []struct {
+		Table string `db:"table_name"`
+		SQL   string `db:"sql"`
+	}{}
+	q := `
+		SELECT table_name, sql FROM (
+			SELECT table_name, sql, table_oid AS oid, 0 AS kind
+			FROM duckdb_tables()
+			WHERE schema_name = current_schema() AND NOT temporary
+			UNION ALL
+			SELECT view_name, sql, view_oid, 1
+			FROM duckdb_views()
+			WHERE schema_name = current_schema() AND NOT internal
+				AND NOT temporary
+			UNION ALL
+			SELECT table_name, sql, index_oid, 2
+			FROM duckdb_indexes()
+			WHERE schema_name = current_schema()
+		)
+		ORDER BY kind, oid`
+	if err := db.Select(&objs, q); err != nil {
+		return nil, errors.Wrap(err, "select schema")
+	}
+	var stmts []string
+	for _, o := range objs {
+		if migrate.IsMetaTable(o.Table) {
+			continue
+		}
+		stmt := strings.TrimSuffix(strings.TrimSpace(o.SQL), ";")
+		stmts = append(stmts, stmt)
+	}
+	return stmts, nil
+}
+
+// Scratch creates a database file in a temporary directory. DuckDB won't
+// open an existing empty file, so it's created by Open.
+func (db *DB) Scratch() (migrate.Store, func() error, error) {
+	dir, err := ioutil.TempDir("", "migrate-scratch-")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "temp dir")
+	}
+	scratch := New(filepath.Join(dir, "scratch.duckdb"))
+	if err = scratch.Open(); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, nil, errors.Wrap(err, "open")
+	}
+	cleanup := func() error {
+		if err := scratch.Close(); err != nil {
+			return errors.Wrap(err, "close")
+		}
+		return os.RemoveAll(dir)
+	}
+	return scratch, cleanup, nil
+}
+
+// Tenant opens the named database file. DuckDB has no concept of tenants, so
+// each is a separate file.
+func (db *DB) Tenant(name string) (migrate.Store, func() error, error) {
+	tenant := New(name)
+	if err := tenant.Open(); err != nil {
+		return nil, nil, errors.Wrap(err, "open")
+	}
+	return tenant, tenant.Close, nil
+}
+
+// TenantNames runs a query which returns the path to a database file in each
+// row.
+func (db *DB) TenantNames(query string) ([]string, error) {
+	names := []string{}
+	if err := db.Select(&names, query); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
@@ -0,0 +1,211 @@
+//go:build cgo
+// +build cgo
+
+package duckdb
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/egtann/migrate"
+)
+
+func TestCreateMetaIfNotExists(t *testing.T) {
+	db := newDB(t)
+	defer db.Close()
+
+	exists, err := db.MetaExists()
+	check(t, err)
+	if exists {
+		t.Fatal("expected no meta table")
+	}
+	check(t, db.CreateMetaIfNotExists())
+	check(t, db.CreateMetaCheckpointsIfNotExists())
+
+	// Creating the tables twice is harmless
+	check(t, db.CreateMetaIfNotExists())
+	exists, err = db.MetaExists()
+	check(t, err)
+	if !exists {
+		t.Fatal("expected a meta table")
+	}
+}
+
+func TestUpsertMigration(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	check(t, db.UpsertMigration("1.sql", "SELECT 1;", "md5"))
+	check(t, db.UpsertMigration("1.sql", "SELECT 11;", "md5-2"))
+	check(t, db.UpsertMigration("2.sql", "SELECT 2;", "md5"))
+
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %+v", ms)
+	}
+	if ms[0].Content != "SELECT 11;" || ms[0].Checksum != "md5-2" {
+		t.Fatalf("expected 1.sql to be updated, got %+v", ms[0])
+	}
+}
+
+func TestCompleteMigration(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	check(t, db.InsertMetaCheckpoint("1.sql", "SELECT 1;", "md5", 0))
+	check(t, db.CompleteMigration("1.sql", "SELECT 1;", "md5"))
+	mcs, err := db.GetMetaCheckpoints("1.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected no checkpoints, got %v", mcs)
+	}
+
+	// Within a migration's transaction, a rollback undoes it
+	check(t, db.BeginMigration())
+	check(t, db.CompleteMigration("2.sql", "SELECT 2;", "md5"))
+	check(t, db.RollbackMigration())
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "1.sql" {
+		t.Fatalf("expected only 1.sql, got %+v", ms)
+	}
+}
+
+func TestReplaceMigrations(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	check(t, db.InsertMigration("1.sql", "SELECT 1;", "md5"))
+	check(t, db.InsertMigration("2.sql", "SELECT 2;", "md5"))
+	err := db.ReplaceMigrations([]string{"1.sql", "2.sql"}, "2_squash.sql",
+		"SELECT 1;", "md5")
+	check(t, err)
+
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "2_squash.sql" {
+		t.Fatalf("expected only 2_squash.sql, got %+v", ms)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	q := `
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			email TEXT UNIQUE NOT NULL,
+			name TEXT DEFAULT 'anon'
+		);
+		CREATE TABLE posts (
+			id INTEGER PRIMARY KEY,
+			userid INTEGER NOT NULL REFERENCES users(id),
+			body TEXT
+		);
+		CREATE INDEX posts_userid_idx ON posts (userid);`
+	_, err := db.Exec(q)
+	check(t, err)
+
+	schema, err := db.Schema()
+	check(t, err)
+	if len(schema.Tables) != 2 {
+		t.Fatalf("expected 2 tables, got %d", len(schema.Tables))
+	}
+	users := schema.Tables["users"]
+	if len(users.Columns) != 3 || users.Columns[1].Nullable {
+		t.Fatalf("unexpected columns %+v", users.Columns)
+	}
+	if len(users.Constraints) != 2 {
+		t.Fatalf("expected 2 constraints, got %+v", users.Constraints)
+	}
+	posts := schema.Tables["posts"]
+	if len(posts.Indexes) != 1 || posts.Indexes[0].Name != "posts_userid_idx" ||
+		strings.Join(posts.Indexes[0].Columns, ",") != "userid" {
+		t.Fatalf("unexpected indexes %+v", posts.Indexes)
+	}
+}
+
+func TestDumpSchema(t *testing.T) {
+	db := setupDB(t)
+	defer db.Close()
+
+	q := `
+		CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT NOT NULL);
+		CREATE INDEX users_email_idx ON users (email);
+		CREATE VIEW emails AS SELECT email FROM users;`
+	_, err := db.Exec(q)
+	check(t, err)
+
+	stmts, err := db.DumpSchema()
+	check(t, err)
+	if len(stmts) != 3 {
+		t.Fatalf("expected 3 statements, got %v", stmts)
+	}
+	if !strings.HasPrefix(stmts[0], "CREATE TABLE users") ||
+		!strings.HasPrefix(stmts[1], "CREATE VIEW emails") ||
+		!strings.HasPrefix(stmts[2], "CREATE INDEX users_email_idx") {
+		t.Fatalf("unexpected statements %v", stmts)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": {Data: []byte(`CREATE TABLE users (id INTEGER PRIMARY KEY);`)},
+		"2.sql": {Data: []byte(`ALTER TABLE users ADD COLUMN email TEXT;`)},
+	}
+
+	db := New(filepath.Join(t.TempDir(), "live.duckdb"))
+	check(t, db.Open())
+	defer db.Close()
+
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	diffs, err := migrate.Drift(db, migrate.WithFS(fsys))
+	check(t, err)
+	if len(diffs) != 0 {
+		t.Fatalf("expected no drift, got %v", diffs)
+	}
+
+	// Hot-fix the live database by hand
+	_, err = db.Exec(`CREATE INDEX users_email_idx ON users (email)`)
+	check(t, err)
+	diffs, err = migrate.Drift(db, migrate.WithFS(fsys))
+	check(t, err)
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 difference, got %v", diffs)
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDB opens an in-memory database, which is private to its connection.
+func newDB(t *testing.T) *DB {
+	t.Helper()
+	db := New("")
+	check(t, db.Open())
+	return db
+}
+
+// setupDB opens an in-memory database with meta tables at the current
+// version.
+func setupDB(t *testing.T) *DB {
+	t.Helper()
+	db := newDB(t)
+	_, err := db.CreateMetaVersionIfNotExists()
+	check(t, err)
+	check(t, db.CreateMetaIfNotExists())
+	check(t, db.CreateMetaCheckpointsIfNotExists())
+	return db
+}
@@ -0,0 +1,146 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ChecksumMismatchError is returned when a migration which already ran no
+// longer matches the checksum recorded when it ran.
+type ChecksumMismatchError struct {
+	File   string
+	Stored string
+	Actual string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum does not match %s. has the file changed?",
+		e.File)
+}
+
+// OutOfOrderError is returned when a migration file was added before one
+// which already ran. Migrations must be appended.
+type OutOfOrderError struct {
+	// File was added to the directory before Ran, which was already
+	// migrated.
+	File string
+	Ran  string
+}
+
+func (e *OutOfOrderError) Error() string {
+	return fmt.Sprintf(
+		"failed to migrate. migrations must be appended: %s was added to history before %s",
+		e.File, e.Ran)
+}
+
+// MissingMigrationError is returned when migrations which already ran are
+// missing from the directory.
+type MissingMigrationError struct {
+	Files []string
+}
+
+func (e *MissingMigrationError) Error() string {
+	return fmt.Sprintf("cannot continue with missing migrations: %s",
+		strings.Join(e.Files, ", "))
+}
+
+// StatementError is returned when a statement in a migration file fails.
+// Index is the statement's position in the file, starting at 0, and Line is
+// the line on which it begins, starting at 1.
+//
+// Stores which implement ErrorDescriber also report the error's Code, such as
+// a SQLSTATE, any Detail and Hint, and ErrorLine, the line in the file where
+// the error occurred within the statement.
+type StatementError struct {
+	File  string
+	Index int
+	SQL   string
+	Line  int
+	Cause error
+
+	Code      string
+	Detail    string
+	Hint      string
+	ErrorLine int
+}
+
+func (e *StatementError) Error() string {
+	msg := fmt.Sprintf("%s: statement %d on line %d", e.File, e.Index,
+		e.Line)
+	if e.ErrorLine > 0 && e.ErrorLine != e.Line {
+		msg += fmt.Sprintf(" (error on line %d)", e.ErrorLine)
+	}
+	msg += ": " + e.Cause.Error()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Hint != "" {
+		msg += " (hint: " + e.Hint + ")"
+	}
+	return msg
+}
+
+func (e *StatementError) Unwrap() error { return e.Cause }
+
+// SchemaVersionTooNewError is returned when the database's meta tables were
+// created by a newer version of migrate than this one. Release is the release
+// of migrate they require, if recorded.
+type SchemaVersionTooNewError struct {
+	Version   int
+	Supported int
+	Release   string
+}
+
+func (e *SchemaVersionTooNewError) Error() string {
+	if e.Release != "" {
+		cur := Release
+		if cur == "" {
+			cur = "this build"
+		}
+		return fmt.Sprintf(
+			"meta version %d requires migrate %s or later, but %s supports version %d: go get github.com/egtann/migrate@%s",
+			e.Version, e.Release, cur, e.Supported, e.Release)
+	}
+	return fmt.Sprintf(
+		"must upgrade migrate: go get -u github.com/egtann/migrate (meta version %d > %d)",
+		e.Version, e.Supported)
+}
+
+// LockTimeoutError is returned when a statement could not acquire a lock
+// within the lock timeout, even after retrying.
+type LockTimeoutError struct {
+	File     string
+	Timeout  time.Duration
+	Attempts int
+	Err      error
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("lock timeout after %d attempts: %s", e.Attempts,
+		e.Err)
+}
+
+func (e *LockTimeoutError) Unwrap() error { return e.Err }
+
+// UpgradeRequiredError is returned by Apply when the meta tables were created
+// by an older version of migrate and must be upgraded first.
+type UpgradeRequiredError struct {
+	Version  int
+	Required int
+}
+
+func (e *UpgradeRequiredError) Error() string {
+	return fmt.Sprintf("meta tables are version %d, but %d is required: upgrade them first",
+		e.Version, e.Required)
+}
+
+// StalePlanError is returned by Apply when the migration history changed
+// after the plan was made. Plan again.
+type StalePlanError struct {
+	Reason string
+}
+
+func (e *StalePlanError) Error() string {
+	return "database changed since planning: " + e.Reason
+}
@@ -0,0 +1,130 @@
+package migrate
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Hooks receive callbacks as migrations run, for example to record metrics
+// or send notifications. Returning an error from a hook aborts the
+// migration. Embed NopHooks to implement only some of them.
+type Hooks interface {
+	// BeforeMigration is called before a file is migrated.
+	BeforeMigration(filename string) error
+
+	// AfterStatement is called after each statement succeeds and is
+	// checkpointed, so a statement whose hook fails isn't run again.
+	AfterStatement(StatementEvent) error
+
+	// AfterMigration is called after a file is migrated and recorded.
+	AfterMigration(filename string, d time.Duration) error
+
+	// OnError is called when migrating a file fails.
+	OnError(filename string, err error)
+
+	// OnCheckpointResume is called when a file which previously failed
+	// resumes from its checkpoints, skipping the statements which already
+	// ran.
+	OnCheckpointResume(filename string, checkpoints int) error
+}
+
+// StatementEvent describes a statement which ran successfully.
+type StatementEvent struct {
+	Filename string
+	Index    int
+	SQL      string
+	Duration time.Duration
+
+	// RowsAffected by the statement, or -1 if the database doesn't
+	// report it.
+	RowsAffected int64
+}
+
+// NopHooks implements Hooks by doing nothing.
+type NopHooks struct{}
+
+func (NopHooks) BeforeMigration(string) error               { return nil }
+func (NopHooks) AfterStatement(StatementEvent) error        { return nil }
+func (NopHooks) AfterMigration(string, time.Duration) error { return nil }
+func (NopHooks) OnError(string, error)                      {}
+func (NopHooks) OnCheckpointResume(string, int) error       { return nil }
+
+// logHooks reports progress to a Logger. It's always the first of our hooks.
+type logHooks struct {
+	NopHooks
+	log LevelLogger
+}
+
+func (h logHooks) AfterStatement(e StatementEvent) error {
+	h.log.Debug("ran statement", "file", e.Filename, "statement", e.Index,
+		"duration", e.Duration, "rows", e.RowsAffected)
+	return nil
+}
+
+func (h logHooks) AfterMigration(filename string, d time.Duration) error {
+	h.log.Info("migrated", "file", filename, "duration", d)
+	return nil
+}
+
+func (h logHooks) OnError(filename string, err error) {
+	var stmtErr *StatementError
+	if errors.As(err, &stmtErr) {
+		h.log.Error("failed", "file", filename, "statement",
+			stmtErr.Index, "line", stmtErr.Line, "sql", stmtErr.SQL,
+			"error", stmtErr.Cause)
+		return
+	}
+	h.log.Error("failed", "file", filename, "error", err)
+}
+
+func (h logHooks) OnCheckpointResume(filename string, n int) error {
+	h.log.Info("resuming from checkpoints", "file", filename,
+		"checkpoints", n)
+	return nil
+}
+
+// multiHooks calls each of its hooks in order, stopping at the first error.
+type multiHooks []Hooks
+
+func (hs multiHooks) BeforeMigration(filename string) error {
+	for _, h := range hs {
+		if err := h.BeforeMigration(filename); err != nil {
+			return errors.Wrap(err, "before migration hook")
+		}
+	}
+	return nil
+}
+
+func (hs multiHooks) AfterStatement(e StatementEvent) error {
+	for _, h := range hs {
+		if err := h.AfterStatement(e); err != nil {
+			return errors.Wrap(err, "after statement hook")
+		}
+	}
+	return nil
+}
+
+func (hs multiHooks) AfterMigration(filename string, d time.Duration) error {
+	for _, h := range hs {
+		if err := h.AfterMigration(filename, d); err != nil {
+			return errors.Wrap(err, "after migration hook")
+		}
+	}
+	return nil
+}
+
+func (hs multiHooks) OnError(filename string, err error) {
+	for _, h := range hs {
+		h.OnError(filename, err)
+	}
+}
+
+func (hs multiHooks) OnCheckpointResume(filename string, n int) error {
+	for _, h := range hs {
+		if err := h.OnCheckpointResume(filename, n); err != nil {
+			return errors.Wrap(err, "checkpoint resume hook")
+		}
+	}
+	return nil
+}
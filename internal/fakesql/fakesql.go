@@ -0,0 +1,181 @@
+// Package fakesql is a database/sql driver which records the statements run
+// through it and answers queries with canned rows, so Store tests can run
+// without a server.
+package fakesql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Responder returns the rows for a query, whose leading and trailing space is
+// trimmed.
+type Responder func(q string, args []driver.Value) (*Rows, error)
+
+// Open a database whose queries are answered by respond, or return no rows
+// when it's nil.
+func Open(respond Responder) (*sql.DB, *Server) {
+	srv := &Server{respond: respond}
+	return sql.OpenDB(connector{srv}), srv
+}
+
+// Server records the statements run through its connections. Driver
+// transactions are recorded as begin, commit and rollback.
+type Server struct {
+	mu      sync.Mutex
+	queries []Query
+	resets  int
+	respond Responder
+}
+
+type Query struct {
+	SQL  string
+	Args []driver.Value
+}
+
+func (s *Server) record(q string, args []driver.NamedValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = append(s.queries, Query{SQL: q, Args: values(args)})
+}
+
+// Log returns the statements run so far, in order.
+func (s *Server) Log() []Query {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Query(nil), s.queries...)
+}
+
+// Resets reports how many times database/sql reset a connection's session
+// before reusing it from the pool, as drivers like go-mssqldb do.
+func (s *Server) Resets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resets
+}
+
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries = nil
+	s.resets = 0
+}
+
+// Summary reports the first line of each statement, up to any WHERE, WITH or
+// opening parenthesis, separated by commas.
+func (s *Server) Summary() string {
+	var parts []string
+	for _, q := range s.Log() {
+		line := strings.TrimSpace(q.SQL)
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		for _, sep := range []string{" WHERE", " WITH", " ("} {
+			if i := strings.Index(line, sep); i >= 0 {
+				line = line[:i]
+			}
+		}
+		parts = append(parts, line)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Rows answers a query.
+type Rows struct {
+	Cols []string
+	Data [][]driver.Value
+	i    int
+}
+
+func (r *Rows) Columns() []string { return r.Cols }
+
+func (r *Rows) Close() error { return nil }
+
+func (r *Rows) Next(dest []driver.Value) error {
+	if r.i >= len(r.Data) {
+		return io.EOF
+	}
+	copy(dest, r.Data[r.i])
+	r.i++
+	return nil
+}
+
+type connector struct{ srv *Server }
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{srv: c.srv}, nil
+}
+
+func (c connector) Driver() driver.Driver { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("use the connector")
+}
+
+type conn struct{ srv *Server }
+
+func (c *conn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) ResetSession(context.Context) error {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+	c.srv.resets++
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	c.srv.record("begin", nil)
+	return tx{srv: c.srv}, nil
+}
+
+func (c *conn) ExecContext(
+	_ context.Context,
+	q string,
+	args []driver.NamedValue,
+) (driver.Result, error) {
+	c.srv.record(q, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *conn) QueryContext(
+	_ context.Context,
+	q string,
+	args []driver.NamedValue,
+) (driver.Rows, error) {
+	c.srv.record(q, args)
+	if c.srv.respond == nil {
+		return &Rows{}, nil
+	}
+	return c.srv.respond(strings.TrimSpace(q), values(args))
+}
+
+type tx struct{ srv *Server }
+
+func (t tx) Commit() error {
+	t.srv.record("commit", nil)
+	return nil
+}
+
+func (t tx) Rollback() error {
+	t.srv.record("rollback", nil)
+	return nil
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vals[i] = arg.Value
+	}
+	return vals
+}
@@ -1,15 +1,35 @@
 package migrate
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type Logger interface {
 	Printf(string, ...interface{})
 	Println(...interface{})
 }
 
+// LevelLogger logs a message at a level along with alternating keys and
+// values, such as "file", "1.sql". migrate uses these keys consistently:
+//
+//	file        migration filename
+//	statement   index of the statement in the file, starting at 0
+//	checksum    checksum of a file or statement
+//	duration    time taken to run a file or statement
+//
+// *slog.Logger implements LevelLogger, so it can be passed directly to
+// WithLogger.
+type LevelLogger interface {
+	Debug(msg string, kvs ...interface{})
+	Info(msg string, kvs ...interface{})
+	Warn(msg string, kvs ...interface{})
+	Error(msg string, kvs ...interface{})
+}
+
 // StdLogger is a helper type that simply logs to stdout using fmt. Unless you
 // want to structure logs or redirect them in some way, this is probably what
-// you want to use in migrate.New().
+// you want to use with migrate.FromLogger.
 type StdLogger struct{}
 
 func (l StdLogger) Printf(s string, vs ...interface{}) {
@@ -19,3 +39,38 @@ func (l StdLogger) Printf(s string, vs ...interface{}) {
 func (l StdLogger) Println(vs ...interface{}) {
 	fmt.Println(vs...)
 }
+
+// FromLogger adapts a Logger to a LevelLogger. Loggers have no levels, so
+// debug messages are discarded and everything else is logged, formatted as
+// the message followed by key=value pairs.
+func FromLogger(l Logger) LevelLogger {
+	return levelAdapter{l}
+}
+
+type levelAdapter struct{ log Logger }
+
+func (a levelAdapter) Debug(msg string, kvs ...interface{}) {}
+func (a levelAdapter) Info(msg string, kvs ...interface{})  { a.print(msg, kvs) }
+func (a levelAdapter) Warn(msg string, kvs ...interface{})  { a.print(msg, kvs) }
+func (a levelAdapter) Error(msg string, kvs ...interface{}) { a.print(msg, kvs) }
+
+func (a levelAdapter) print(msg string, kvs []interface{}) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(kvs); i += 2 {
+		if i+1 < len(kvs) {
+			fmt.Fprintf(&b, " %v=%v", kvs[i], kvs[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", kvs[i])
+		}
+	}
+	a.log.Println(b.String())
+}
+
+// nopLogger discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
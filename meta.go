@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Release of migrate. It's recorded alongside the meta version, so older
+// releases can report which one they must be upgraded to. Release builds set
+// it from their tag:
+//
+//	go build -ldflags "-X github.com/egtann/migrate.Release=$(git describe --tags)"
+//
+// It's empty in other builds.
+var Release string
+
+// version of the migrate tool's database schema. It's the Version of the last
+// entry in metaUpgrades.
+const version = 2
+
+// metaUpgrades are every change to the meta tables, in order. Add an entry
+// here and the dialect SQL to each Store's MetaUpgradeSQL to change them, and
+// set its Release once a release with it is tagged.
+var metaUpgrades = []MetaUpgrade{
+	{
+		Version:     1,
+		Description: "record the content of each migration and allow files with the same checksum",
+	},
+	{
+		Version:     2,
+		Description: "record the release of migrate required by the meta tables",
+	},
+}
+
+// MetaVersion is the version of the meta tables, and the release of migrate
+// which introduced it. Release is empty when it isn't known, such as for
+// tables created by a development build or before version 2.
+type MetaVersion struct {
+	Version int    `db:"version"`
+	Release string `db:"migraterelease"`
+}
+
+// MetaUpgrade is a change to the meta tables.
+type MetaUpgrade struct {
+	// Version of the meta tables after the upgrade.
+	Version int
+
+	// Release is the first release of migrate which supports Version,
+	// or empty if it hasn't been released.
+	Release string
+
+	Description string
+
+	// Statements are the Store's SQL for the upgrade, which runs in a
+	// single transaction where the database allows it.
+	Statements []MetaStatement
+}
+
+// MetaStatement is a statement in a MetaUpgrade. Args are bound to its
+// placeholders.
+type MetaStatement struct {
+	SQL  string
+	Args []interface{}
+}
+
+// MetaUpgrades reports the upgrades that Upgrade would run, in order, with the
+// SQL for each. It must follow Init.
+func (m *Migrate) MetaUpgrades() ([]MetaUpgrade, error) {
+	if !m.initialized {
+		return nil, errors.New("meta upgrades before init")
+	}
+	return m.metaUpgrades(m.metaVersion)
+}
+
+// metaUpgrades reports the upgrades from meta version cur.
+func (m *Migrate) metaUpgrades(cur int) ([]MetaUpgrade, error) {
+	var (
+		ups        []MetaUpgrade
+		migrations []Migration
+	)
+	for _, up := range metaUpgrades {
+		if up.Version <= cur {
+			continue
+		}
+
+		// Upgrades may backfill the content of migrations which ran
+		// before it was recorded
+		if migrations == nil {
+			var err error
+			migrations, err = migrationsFromFiles(m)
+			if err != nil {
+				return nil, errors.Wrap(err, "migrations from files")
+			}
+		}
+		stmts, err := m.db.MetaUpgradeSQL(up.Version, migrations)
+		if err != nil {
+			return nil, errors.Wrapf(err, "meta upgrade sql v%d",
+				up.Version)
+		}
+		up.Statements = stmts
+		ups = append(ups, up)
+	}
+	return ups, nil
+}
+
+// checkMetaVersion returns a *SchemaVersionTooNewError if the meta tables were
+// created by a newer version of migrate.
+func checkMetaVersion(cur MetaVersion) error {
+	if cur.Version > version {
+		return &SchemaVersionTooNewError{
+			Version:   cur.Version,
+			Supported: version,
+			Release:   cur.Release,
+		}
+	}
+	return nil
+}
+
+// Upgrade the meta tables to match this version of migrate, if they're older.
+// Each upgrade runs in turn, and records its version when it succeeds. It must
+// follow Init, and refuses to run while a migration is only partly complete.
+func (m *Migrate) Upgrade() error {
+	if !m.initialized {
+		return errors.New("upgrade before init")
+	}
+	ups, err := m.MetaUpgrades()
+	if err != nil {
+		return err
+	}
+	if len(ups) == 0 {
+		return nil
+	}
+	filenames, err := m.db.GetMetaCheckpointFilenames()
+	if err != nil {
+		return errors.Wrap(err, "get checkpoint filenames")
+	}
+	if len(filenames) > 0 {
+		return fmt.Errorf("complete %s with the release of migrate which started it before upgrading the meta tables",
+			filenames[0])
+	}
+	for _, up := range ups {
+		v := MetaVersion{Version: up.Version, Release: up.Release}
+		if err = m.db.UpgradeMeta(v, up.Statements); err != nil {
+			return errors.Wrapf(err, "upgrade to v%d", up.Version)
+		}
+		m.metaVersion = up.Version
+		m.log.Info("upgraded meta tables", "version", up.Version)
+	}
+	return nil
+}
@@ -1,32 +1,76 @@
 package migrate
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/pkg/errors"
 )
 
-// version of the migrate tool's database schema.
-const version = 1
-
 type Migrate struct {
 	Migrations []Migration
 	Files      []os.FileInfo
 
-	db  Store
-	log Logger
-	dir string
-	idx int
+	// Repeatables are the R__<name>.sql files, which run after every
+	// versioned file and again whenever they change. Their history is
+	// not included in Migrations.
+	Repeatables []os.FileInfo
+
+	db       Store
+	log      LevelLogger
+	hooks    multiHooks
+	sources  []source
+	baseline string
+
+	// initialized is set by Init. metaVersion is the version of the meta
+	// tables that Init found.
+	initialized bool
+	metaVersion int
+
+	// locked is set while we hold the Store's Locker lock.
+	locked bool
+
+	// metaMissing is set while planning for a database without meta
+	// tables, whose history is empty.
+	metaMissing bool
+
+	// baselineIdx is the index of the baseline file, or -1 without one.
+	baselineIdx int
+
+	// repeated maps the repeatable files which have run to the checksums
+	// they had when they last ran.
+	repeated map[string]string
+
+	// squashes are the squashed files whose superseded migrations are
+	// still recorded in the meta table.
+	squashes []string
+
+	expandEnv   bool
+	timeouts    timeouts
+	timeoutsSet bool
+	lockRetries int
+	lockBackoff time.Duration
+	outOfOrder  OutOfOrderPolicy
+	txMode      TxMode
+	checksum    ChecksumAlgorithm
+}
+
+type timeouts struct {
+	statement time.Duration
+	lock      time.Duration
 }
 
 type Migration struct {
@@ -35,104 +79,290 @@ type Migration struct {
 	Content  string
 }
 
-var regexNum = regexp.MustCompile(`^\d+`)
+var (
+	regexNum = regexp.MustCompile(`^\d+`)
+	regexVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
 
-func New(
-	db Store,
-	log Logger,
-	dir, skip string,
-) (*Migrate, error) {
-	m := &Migrate{db: db, log: log, dir: dir}
+// New prepares db to run the migrations in the current directory, or the
+// source given by WithDir or WithFS. It reads the migration files, but does
+// not touch the database. See Init, Upgrade and Plan.
+func New(db Store, opts ...Option) (*Migrate, error) {
+	m := &Migrate{db: db, log: nopLogger{}}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if len(m.sources) == 0 {
+		m.sources = []source{{fsys: os.DirFS(".")}}
+	}
+	if len(m.sources) > 1 {
+		seen := map[string]struct{}{}
+		for _, src := range m.sources {
+			if src.namespace == "" {
+				return nil, errors.New("multiple sources require namespaces")
+			}
+			if _, ok := seen[src.namespace]; ok {
+				return nil, fmt.Errorf("duplicate namespace %s",
+					src.namespace)
+			}
+			seen[src.namespace] = struct{}{}
+		}
+	}
+	m.hooks = append(multiHooks{logHooks{log: m.log}}, m.hooks...)
+	if m.txMode == TxPerFile {
+		if _, ok := db.(Transactor); !ok {
+			return nil, errors.New("store does not support transactions")
+		}
+		if m.lockRetries > 0 {
+			return nil, errors.New("lock retries cannot be used with transactions")
+		}
+	}
 
 	// Get files in migration dir and sort them
 	var err error
-	m.Files, err = readdir(dir)
+	files, err := readdir(m.sources)
 	if err != nil {
 		return nil, errors.Wrap(err, "get migrations")
 	}
+	for _, fi := range files {
+		if isRepeatable(fi.Name()) {
+			m.Repeatables = append(m.Repeatables, fi)
+		} else {
+			m.Files = append(m.Files, fi)
+		}
+	}
+	sort.Slice(m.Repeatables, func(i, j int) bool {
+		return m.Repeatables[i].Name() < m.Repeatables[j].Name()
+	})
 	if err = sortfiles(m.Files); err != nil {
 		return nil, errors.Wrap(err, "sort")
 	}
+	return m, nil
+}
 
-	// Create meta tables if we need to, so we can store the migration
-	// state in the db itself
-	if err = db.CreateMetaIfNotExists(); err != nil {
-		return nil, errors.Wrap(err, "create meta table")
-	}
-	if err = db.CreateMetaCheckpointsIfNotExists(); err != nil {
-		return nil, errors.Wrap(err, "create meta checkpoints table")
+// NewFromDir prepares db to run the migrations in dir, first recording every
+// file through skip as already run, if skip is not empty. Unlike New, it
+// calls Init, Upgrade and Plan before returning.
+//
+// Deprecated: Use New with WithDir, WithLogger and WithBaseline.
+func NewFromDir(
+	db Store,
+	log Logger,
+	dir, skip string,
+	opts ...Option,
+) (*Migrate, error) {
+	base := []Option{WithDir(dir), WithBaseline(skip)}
+	if log != nil {
+		base = append(base, WithLogger(FromLogger(log)))
 	}
-	curVersion, err := db.CreateMetaVersionIfNotExists()
+	m, err := New(db, append(base, opts...)...)
 	if err != nil {
-		return nil, errors.Wrap(err, "create meta version table")
+		return nil, err
 	}
-
-	// Migrate the database schema to match the tool's expectations
-	// automatically
-	if curVersion > version {
-		return nil, errors.New("must upgrade migrate: go get -u github.com/egtann/migrate")
+	if err = m.Init(); err != nil {
+		return nil, err
 	}
-	if curVersion < 1 {
-		tmpMigrations, err := migrationsFromFiles(m)
-		if err != nil {
-			return nil, errors.Wrap(err, "migrations from files")
-		}
-		if err = db.UpgradeToV1(tmpMigrations); err != nil {
-			return nil, errors.Wrap(err, "upgrade to v1")
-		}
+	if err = m.Upgrade(); err != nil {
+		return nil, err
+	}
+	if _, err = m.Plan(); err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
-	// If skip, then we record the migrations but do not perform them. This
-	// enables you to start using this package on an existing database
-	if skip != "" {
-		m.idx, err = m.skip(skip)
-		if err != nil {
-			return nil, errors.Wrap(err, "skip ahead")
+// Init creates the meta tables if they don't exist, so we can store the
+// migration state in the db itself. New tables are created at the current
+// version. It returns a *SchemaVersionTooNewError if they were created by a
+// newer version of migrate.
+func (m *Migrate) Init() error {
+	exists, err := m.db.MetaExists()
+	if err != nil {
+		return errors.Wrap(err, "meta exists")
+	}
+	if err = m.db.CreateMetaIfNotExists(); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	if err = m.db.CreateMetaCheckpointsIfNotExists(); err != nil {
+		return errors.Wrap(err, "create meta checkpoints table")
+	}
+	cur, err := m.db.CreateMetaVersionIfNotExists()
+	if err != nil {
+		return errors.Wrap(err, "create meta version table")
+	}
+	if err = checkMetaVersion(cur); err != nil {
+		return err
+	}
+	if !exists && cur.Version == 0 {
+		cur = MetaVersion{Version: version, Release: Release}
+		if err = m.db.UpgradeMeta(cur, nil); err != nil {
+			return errors.Wrap(err, "record meta version")
 		}
-		m.log.Println("skipped ahead")
 	}
+	m.metaVersion = cur.Version
+	m.initialized = true
+	return nil
+}
 
-	// Get all migrations
-	m.Migrations, err = db.GetMigrations()
+// getMigrations from the database, sorted in the same order as our files.
+// Stores may not return them in order. Repeatable migrations are kept
+// separately.
+func (m *Migrate) getMigrations() error {
+	all, err := m.db.GetMigrations()
 	if err != nil {
-		return nil, errors.Wrap(err, "get migrations")
+		return errors.Wrap(err, "get migrations")
 	}
-
-	if err = m.validHistory(); err != nil {
-		return nil, err
+	m.Migrations = nil
+	m.repeated = map[string]string{}
+	for _, mg := range all {
+		if isRepeatable(mg.Filename) {
+			m.repeated[mg.Filename] = mg.Checksum
+			continue
+		}
+		m.Migrations = append(m.Migrations, mg)
 	}
-	return m, nil
+	sort.SliceStable(m.Migrations, func(i, j int) bool {
+		return lessFile(m.Migrations[i].Filename,
+			m.Migrations[j].Filename)
+	})
+	return nil
 }
 
 // Migrate all files in the directory. This function reports whether any
 // migration took place.
-func (m *Migrate) Migrate() (bool, error) {
-	var migrated bool
-	for i := len(m.Migrations); i < len(m.Files); i++ {
-		filename := m.Files[i].Name()
-		if err := m.migrateFile(filename); err != nil {
-			return false, errors.Wrap(err, "migrate file")
+//
+// If Init has not been called, Migrate calls Init and Upgrade. Call them
+// yourself to control when the meta tables are upgraded. Migrate then plans
+// and applies the plan.
+//
+// If the Store implements Locker, Migrate holds its lock throughout.
+func (m *Migrate) Migrate() (migrated bool, err error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err2 := unlock(); err2 != nil && err == nil {
+			migrated, err = false, err2
+		}
+	}()
+
+	if !m.initialized {
+		if err = m.Init(); err != nil {
+			return false, err
+		}
+		if err = m.Upgrade(); err != nil {
+			return false, err
 		}
-		m.log.Println("migrated", filename)
-		migrated = true
 	}
-	return migrated, nil
+	plan, err := m.Plan()
+	if err != nil {
+		return false, err
+	}
+	if err = m.Apply(plan); err != nil {
+		return false, err
+	}
+	return len(plan.Steps) > 0, nil
 }
 
-func (m *Migrate) validHistory() error {
-	for i := len(m.Files); i < len(m.Migrations); i++ {
-		m.log.Printf("missing already-run migration %q\n", m.Migrations[i])
+// lock the Store's migrations if it implements Locker and we don't hold the
+// lock already. Call the returned function to unlock them.
+func (m *Migrate) lock() (func() error, error) {
+	l, ok := m.db.(Locker)
+	if !ok || m.locked {
+		return func() error { return nil }, nil
+	}
+	if err := l.Lock(); err != nil {
+		return nil, errors.Wrap(err, "lock")
+	}
+	m.locked = true
+	return func() error {
+		m.locked = false
+		if err := l.Unlock(); err != nil {
+			return errors.Wrap(err, "unlock")
+		}
+		return nil
+	}, nil
+}
+
+// pending returns the files which have not yet been migrated, in order,
+// excluding those recorded by the baseline or superseded by squashed
+// migrations. Pending files follow every migrated file unless out-of-order
+// migrations are allowed.
+func (m *Migrate) pending() []string {
+	done := make(map[string]struct{}, len(m.Migrations))
+	for _, mg := range m.Migrations {
+		done[mg.Filename] = struct{}{}
 	}
-	if len(m.Files) < len(m.Migrations) {
-		return errors.New("cannot continue with missing migrations")
+	for _, name := range m.squashes {
+		done[name] = struct{}{}
 	}
-	for i := m.idx; i < len(m.Migrations); i++ {
-		mg := m.Migrations[i]
-		if mg.Filename != m.Files[i].Name() {
-			m.log.Printf("\n%s was added to history before %s.",
-				m.Files[i].Name(), mg.Filename)
-			return errors.New("failed to migrate. migrations must be appended")
+	var names []string
+	for i, fi := range m.Files {
+		if i <= m.baselineIdx {
+			continue
+		}
+		if _, ok := done[fi.Name()]; !ok {
+			names = append(names, fi.Name())
+		}
+	}
+	return names
+}
+
+func (m *Migrate) validHistory() error {
+	ran := make(map[string]struct{}, len(m.Migrations))
+	for _, mg := range m.Migrations {
+		ran[mg.Filename] = struct{}{}
+	}
+
+	// i indexes our files and j indexes the migrations in our history.
+	// They diverge when a single squashed file supersedes many
+	// migrations, or when a file is added out of order.
+	var i, j int
+	for ; j < len(m.Migrations); i++ {
+		if i >= len(m.Files) {
+			missing := &MissingMigrationError{}
+			for ; j < len(m.Migrations); j++ {
+				m.log.Error("missing already-run migration",
+					"file", m.Migrations[j].Filename)
+				missing.Files = append(missing.Files,
+					m.Migrations[j].Filename)
+			}
+			return missing
+		}
+		name := m.Files[i].Name()
+		originals, err := m.squashed(name)
+		if err != nil {
+			return errors.Wrap(err, "squashed")
+		}
+		ok, err := supersedes(m.Migrations[j:], originals)
+		if err != nil {
+			return err
+		}
+		if ok {
+			m.squashes = append(m.squashes, name)
+			j += len(originals)
+			continue
+		}
+		// Files through the baseline are recorded without checking them,
+		// whether or not they've been recorded already
+		mg := m.Migrations[j]
+		if i <= m.baselineIdx {
+			if mg.Filename == name {
+				j++
+			}
+			continue
+		}
+		if mg.Filename != name {
+			_, inHistory := ran[name]
+			if !inHistory && m.outOfOrder == OutOfOrderAllow {
+				m.log.Warn("migrating out of order", "file", name,
+					"after", mg.Filename)
+				continue
+			}
+			return &OutOfOrderError{File: name, Ran: mg.Filename}
 		}
+		j++
 		if err := m.checkHash(mg); err != nil {
 			return errors.Wrap(err, "check hash")
 		}
@@ -141,176 +371,485 @@ func (m *Migrate) validHistory() error {
 }
 
 func (m *Migrate) checkHash(mg Migration) error {
-	fi, err := os.Open(filepath.Join(m.dir, mg.Filename))
-	if err != nil {
-		return err
-	}
-	defer fi.Close()
-	_, check, err := computeChecksum(fi)
+	byt, err := m.readFile(mg.Filename)
 	if err != nil {
 		return err
 	}
+
+	// Compare using the algorithm which computed the stored checksum, so
+	// history recorded before changing algorithms remains valid
+	check := checksumAlgorithm(mg.Checksum).sum(byt)
 	if check != mg.Checksum {
-		m.log.Println("comparing", check, mg.Checksum)
-		return fmt.Errorf("checksum does not match %s. has the file changed?",
-			mg.Filename)
+		m.log.Debug("comparing checksums", "file", mg.Filename,
+			"checksum", check, "stored", mg.Checksum)
+		return &ChecksumMismatchError{
+			File:   mg.Filename,
+			Stored: mg.Checksum,
+			Actual: check,
+		}
 	}
 	return nil
 }
 
-func (m *Migrate) migrateFile(filename string) error {
-	pth := filepath.Join(m.dir, filename)
-	byt, err := ioutil.ReadFile(pth)
-	if err != nil {
+// applyStep runs a step, calling hooks before and after.
+func (m *Migrate) applyStep(step Step) error {
+	start := time.Now()
+	if err := m.hooks.BeforeMigration(step.Filename); err != nil {
 		return err
 	}
-
-	// Split commands and remove comments at the start of lines
-	cmds := strings.Split(string(byt), ";")
-	filteredCmds := []string{}
-	for _, cmd := range cmds {
-		cmd = strings.TrimSpace(cmd)
-		if len(cmd) > 0 && !strings.HasPrefix(cmd, "--") {
-			filteredCmds = append(filteredCmds, cmd)
-		}
+	if err := m.runStep(step); err != nil {
+		m.hooks.OnError(step.Filename, err)
+		return errors.Wrap(err, "migrate file")
 	}
+	return m.hooks.AfterMigration(step.Filename, time.Since(start))
+}
 
-	// Ensure that commands are present
-	if len(filteredCmds) == 0 {
-		return fmt.Errorf("no sql statements in file: %s", filename)
+// migrateFile plans and runs a single file.
+func (m *Migrate) migrateFile(filename string) error {
+	step, err := m.planStep(filename)
+	if err != nil {
+		return err
 	}
+	return m.runStep(step)
+}
 
-	// Get our checkpoints, if any
-	checkpoints, err := m.db.GetMetaCheckpoints(filename)
+func (m *Migrate) runStep(step Step) (err error) {
+	filename := step.Filename
+
+	// Apply any timeouts to the session. Once we've set them, we must
+	// reset them for each following file, even if it has none.
+	t, err := m.fileTimeouts(filename, step.content)
 	if err != nil {
-		return errors.Wrap(err, "get checkpoints")
-	}
-	if len(checkpoints) > 0 {
-		m.log.Printf("found %d checkpoints\n", len(checkpoints))
+		return err
 	}
-
-	// Ensure commands weren't deleted from the file after we migrated them
-	if len(checkpoints) >= len(filteredCmds) {
-		return fmt.Errorf("len(checkpoints) %d >= len(cmds) %d",
-			len(checkpoints), len(filteredCmds))
+	if t != (timeouts{}) || m.timeoutsSet {
+		if err = m.db.SetTimeouts(t.statement, t.lock); err != nil {
+			return errors.Wrap(err, "set timeouts")
+		}
+		m.timeoutsSet = t != (timeouts{})
 	}
 
-	for i, cmd := range filteredCmds {
-		// Confirm the file up to our checkpoint has not changed
-		if i < len(checkpoints) {
-			r := strings.NewReader(cmd)
-			_, checksum, err := computeChecksum(r)
+	if m.txMode == TxPerFile {
+		tx := m.db.(Transactor)
+		if err = tx.BeginMigration(); err != nil {
+			return errors.Wrap(err, "begin")
+		}
+		defer func() {
 			if err != nil {
-				return errors.Wrap(err, "compute checkpoint checksum")
+				_ = tx.RollbackMigration()
+				return
 			}
-			if checksum != checkpoints[i] {
-				return fmt.Errorf(
-					"checksum does not equal checkpoint. has %s (cmd %d) changed?",
-					filename, i)
+			if err = tx.CommitMigration(); err != nil {
+				err = errors.Wrap(err, "commit")
 			}
-			continue
-		}
+		}()
+	}
 
-		// Execute non-checkpointed commands one by one
-		_, err := m.db.Exec(cmd)
+	if step.Resume > 0 {
+		err = m.hooks.OnCheckpointResume(filename, step.Resume)
 		if err != nil {
-			m.log.Println("failed on", cmd)
-			return fmt.Errorf("%s: %s", filename, err)
+			return err
 		}
+	}
 
-		// Save a checkpoint
-		_, checksum, err := computeChecksum(strings.NewReader(cmd))
+	// Execute non-checkpointed commands one by one
+	for i := step.Resume; i < len(step.Statements); i++ {
+		stmt := step.Statements[i]
+		start := time.Now()
+		rows := int64(-1)
+		switch {
+		case stmt.Rebuild != "":
+			err = m.db.(Rebuilder).RebuildTable(stmt.Rebuild, stmt.SQL)
+		case stmt.Copy:
+			rows, err = m.copyFrom(t, stmt)
+		default:
+			var res sql.Result
+			res, err = m.exec(filename, t, stmt.SQL)
+			if err == nil {
+				if n, err2 := res.RowsAffected(); err2 == nil {
+					rows = n
+				}
+			}
+		}
 		if err != nil {
-			return errors.Wrap(err, "compute checksum")
+			return m.statementError(filename, i, stmt, err)
 		}
-		err = m.db.InsertMetaCheckpoint(filename, cmd, checksum, i)
+		d := time.Since(start)
+
+		// Save a checkpoint before calling hooks, so a hook which fails
+		// can't cause a statement which succeeded to run again
+		checksum := m.checksum.sum([]byte(stmt.SQL))
+		err = m.db.InsertMetaCheckpoint(filename, stmt.SQL, checksum, i)
 		if err != nil {
 			return errors.Wrap(err, "insert checkpoint")
 		}
+		err = m.hooks.AfterStatement(StatementEvent{
+			Filename:     filename,
+			Index:        i,
+			SQL:          stmt.SQL,
+			Duration:     d,
+			RowsAffected: rows,
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	// We've successfully finished migrating the file, so we delete the
-	// temporary progress in metacheckpoints and save the migration
-	if err = m.db.DeleteMetaCheckpoints(); err != nil {
-		return errors.Wrap(err, "delete checkpoints")
+	// temporary progress in metacheckpoints and save the migration. Both
+	// happen at once, so a crash can't leave the file half-recorded
+	err = m.db.CompleteMigration(filename, step.content, step.Checksum)
+	if err != nil {
+		return errors.Wrap(err, "complete migration")
 	}
+	return nil
+}
 
-	_, checksum, err := computeChecksum(bytes.NewReader(byt))
-	if err != nil {
-		return errors.Wrap(err, "compute file checksum")
+// splitStatements splits a migration file into statements on semicolons,
+// skipping any which begin with a comment other than a rebuild directive. The
+// rows following a COPY ... FROM STDIN statement, through a line containing
+// only \., are its data.
+func splitStatements(content string) []Statement {
+	var stmts []Statement
+	for offset := 0; offset < len(content); {
+		end := strings.IndexByte(content[offset:], ';')
+		if end < 0 {
+			end = len(content)
+		} else {
+			end += offset
+		}
+		chunk := content[offset:end]
+		start := offset + len(chunk) - len(strings.TrimLeftFunc(chunk,
+			unicode.IsSpace))
+		offset = end + 1
+		chunk = strings.TrimSpace(chunk)
+		rebuild, rest, skipped := leadingComments(chunk)
+
+		// Rows following a COPY belong to it, even if it's skipped
+		var data string
+		isCopy := regexCopyFromStdin.MatchString(rest) &&
+			offset < len(content)
+		if isCopy {
+			var n int
+			data, n = copyData(content[offset:])
+			offset += n
+		}
+
+		// A statement which begins with a comment is skipped, unless
+		// it's a rebuild directive
+		if rest == "" || (skipped > 0 && rebuild == "") {
+			continue
+		}
+		stmts = append(stmts, Statement{
+			SQL:     rest,
+			Line:    strings.Count(content[:start+skipped], "\n") + 1,
+			Rebuild: rebuild,
+			Copy:    isCopy,
+			Data:    data,
+		})
+	}
+	return stmts
+}
+
+// splitBatches splits a migration file into batches on the lines for which
+// isSeparator reports true. Each batch is a single statement, whatever
+// semicolons it contains, and batches holding only comments are skipped.
+func splitBatches(content string, isSeparator func(string) bool) []Statement {
+	var (
+		stmts []Statement
+		batch strings.Builder
+	)
+	first := 1
+	flush := func() {
+		raw := batch.String()
+		batch.Reset()
+		sql := strings.TrimSpace(raw)
+		if _, rest, _ := leadingComments(sql); rest == "" {
+			return
+		}
+		lead := raw[:len(raw)-len(strings.TrimLeftFunc(raw, unicode.IsSpace))]
+		stmts = append(stmts, Statement{
+			SQL:  sql,
+			Line: first + strings.Count(lead, "\n"),
+		})
+	}
+	for i, line := range strings.SplitAfter(content, "\n") {
+		if isSeparator(strings.TrimRight(line, "\r\n")) {
+			flush()
+			first = i + 2
+			continue
+		}
+		batch.WriteString(line)
 	}
-	if err = m.db.InsertMigration(filename, string(byt), checksum); err != nil {
-		return errors.Wrap(err, "insert migration")
+	flush()
+	return stmts
+}
+
+// regexCopyFromStdin matches a Postgres COPY statement which reads rows that
+// follow it in the file.
+var regexCopyFromStdin = regexp.MustCompile(`(?is)^COPY\s.+\sFROM\s+STDIN\b`)
+
+// copyData returns the rows following a COPY ... FROM STDIN statement, which
+// begin on the next line and end before a line containing only \., and the
+// number of bytes through that line.
+func copyData(content string) (data string, n int) {
+	i := strings.IndexByte(content, '\n')
+	if i < 0 {
+		return "", len(content)
+	}
+	n = i + 1
+	var b strings.Builder
+	for n < len(content) {
+		line := content[n:]
+		if j := strings.IndexByte(line, '\n'); j >= 0 {
+			line = line[:j+1]
+		}
+		n += len(line)
+		if strings.TrimRight(line, "\r\n") == `\.` {
+			break
+		}
+		b.WriteString(line)
 	}
-	return nil
+	return b.String(), n
+}
+
+// copyFrom runs a COPY ... FROM STDIN statement with its data.
+func (m *Migrate) copyFrom(t timeouts, stmt Statement) (int64, error) {
+	ctx, cancel := context.Background(), func() {}
+	if t.statement > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.statement)
+	}
+	defer cancel()
+	return m.db.(Copier).CopyFrom(ctx, stmt.SQL, strings.NewReader(stmt.Data))
+}
+
+// statementError describes a failed statement, including where in the file
+// the error occurred if the Store can tell us.
+func (m *Migrate) statementError(
+	filename string,
+	index int,
+	stmt Statement,
+	err error,
+) error {
+	e := &StatementError{
+		File:  filename,
+		Index: index,
+		SQL:   stmt.SQL,
+		Line:  stmt.Line,
+		Cause: err,
+	}
+	d, ok := m.db.(ErrorDescriber)
+	if !ok {
+		return e
+	}
+	desc := d.DescribeError(err)
+	e.Code, e.Detail, e.Hint = desc.Code, desc.Detail, desc.Hint
+
+	// Position counts characters from 1
+	if desc.Position > 0 {
+		runes := []rune(stmt.SQL)
+		if desc.Position <= len(runes) {
+			before := string(runes[:desc.Position-1])
+			e.ErrorLine = stmt.Line + strings.Count(before, "\n")
+		}
+	}
+	return e
+}
+
+// leadingComments splits the comment lines from the start of a statement,
+// returning the table named by any "-- migrate:rebuild <table>" directive
+// among them, the rest of the statement and the number of bytes before it.
+func leadingComments(chunk string) (table, rest string, skipped int) {
+	rest = chunk
+	for strings.HasPrefix(rest, "--") {
+		line := rest
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i]
+		}
+		rest = strings.TrimSpace(rest[len(line):])
+		fields := strings.Fields(strings.TrimPrefix(line, "--"))
+		if len(fields) == 2 && fields[0] == "migrate:rebuild" {
+			table = fields[1]
+		}
+	}
+	return table, rest, len(chunk) - len(rest)
 }
 
-func (m *Migrate) skip(toFile string) (int, error) {
-	// Get just the filename if skip is a directory
-	_, toFile = filepath.Split(toFile)
+// exec a statement, retrying it if it times out waiting on a lock and retries
+// are enabled.
+func (m *Migrate) exec(filename string, t timeouts, cmd string) (sql.Result, error) {
+	backoff := m.lockBackoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.Background(), func() {}
+		if t.statement > 0 {
+			ctx, cancel = context.WithTimeout(ctx, t.statement)
+		}
+		res, err := m.db.ExecContext(ctx, cmd)
+		cancel()
+		if err == nil || !m.db.IsLockTimeout(err) {
+			return res, err
+		}
+		if attempt > m.lockRetries {
+			return nil, &LockTimeoutError{
+				File:     filename,
+				Timeout:  t.lock,
+				Attempts: attempt,
+				Err:      err,
+			}
+		}
+		m.log.Warn("lock timeout, retrying", "file", filename,
+			"attempt", attempt, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
 
-	// Ensure the file exists
-	index := -1
+// fileTimeouts returns the timeouts for a file, which may be overridden by
+// directives within it.
+func (m *Migrate) fileTimeouts(filename, content string) (timeouts, error) {
+	t := m.timeouts
+	for name, d := range map[string]*time.Duration{
+		"timeout":      &t.statement,
+		"lock-timeout": &t.lock,
+	} {
+		for _, args := range directives(content, name) {
+			if len(args) != 1 {
+				return t, fmt.Errorf("%s: bad %s directive", filename,
+					name)
+			}
+			var err error
+			*d, err = time.ParseDuration(args[0])
+			if err != nil {
+				return t, errors.Wrapf(err, "%s: parse %s", filename,
+					name)
+			}
+		}
+	}
+	return t, nil
+}
+
+// directives returns the arguments of each "-- migrate:<name>" comment in a
+// migration file.
+func directives(content, name string) [][]string {
+	var args [][]string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "--") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "--"))
+		if len(fields) > 0 && fields[0] == "migrate:"+name {
+			args = append(args, fields[1:])
+		}
+	}
+	return args
+}
+
+// baselineIndex returns the index of the baseline file.
+func (m *Migrate) baselineIndex() (int, error) {
+	// Match either the namespaced name or, if the baseline is a path,
+	// just the filename
 	for i, fi := range m.Files {
-		if fi.Name() == toFile {
-			index = i
-			break
+		if fi.Name() == m.baseline {
+			return i, nil
 		}
 	}
-	if index == -1 {
-		return 0, fmt.Errorf("%s does not exist", toFile)
+	_, toFile := filepath.Split(m.baseline)
+	for i, fi := range m.Files {
+		if fi.Name() == toFile {
+			return i, nil
+		}
 	}
-	for i := 0; i <= index; i++ {
-		name := m.Files[i].Name()
-		fi, err := os.Open(filepath.Join(m.dir, name))
+	return -1, fmt.Errorf("%s does not exist", toFile)
+}
+
+// recordBaseline records files as migrated without running them.
+func (m *Migrate) recordBaseline(filenames []string) error {
+	for _, filename := range filenames {
+		mg, err := m.migrationFromFile(filename)
 		if err != nil {
-			return -1, err
+			return err
 		}
-		content, checksum, err := computeChecksum(fi)
+		content, err := m.expand(mg.Filename, mg.Content)
 		if err != nil {
-			fi.Close()
-			return -1, err
+			return err
 		}
-		if err = m.db.UpsertMigration(name, content, checksum); err != nil {
-			fi.Close()
-			return -1, err
-		}
-		if err = fi.Close(); err != nil {
-			return -1, err
+		err = m.db.UpsertMigration(mg.Filename, content, mg.Checksum)
+		if err != nil {
+			return err
 		}
 	}
-	return index, nil
+	return nil
 }
 
-func computeChecksum(r io.Reader) (content string, checksum string, err error) {
-	h := md5.New()
-	byt, err := ioutil.ReadAll(r)
-	if err != nil {
-		return "", "", errors.Wrap(err, "read all")
-	}
-	if _, err := io.Copy(h, bytes.NewReader(byt)); err != nil {
-		return "", "", err
+// expand ${VAR} references in a migration file with the values of their
+// environment variables, if enabled with WithExpandEnv.
+func (m *Migrate) expand(filename, content string) (string, error) {
+	if !m.expandEnv {
+		return content, nil
+	}
+	var unset []string
+	content = regexVar.ReplaceAllStringFunc(content, func(s string) string {
+		name := regexVar.FindStringSubmatch(s)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+			return s
+		}
+		return val
+	})
+	if len(unset) > 0 {
+		return "", fmt.Errorf("%s: unset environment variables: %s",
+			filename, strings.Join(unset, ", "))
 	}
-	return string(byt), fmt.Sprintf("%x", h.Sum(nil)), nil
+	return content, nil
+}
+
+// source of migration files. Files from a source with a namespace are named
+// "<namespace>/<file>".
+type source struct {
+	namespace string
+	fsys      fs.FS
 }
 
-// readdir collects file infos from the migration directory.
-func readdir(dir string) ([]os.FileInfo, error) {
+// namedFileInfo overrides a file's name with its namespaced name.
+type namedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedFileInfo) Name() string { return fi.name }
+
+// readdir collects file infos from the root of each migration source.
+func readdir(sources []source) ([]os.FileInfo, error) {
 	files := []os.FileInfo{}
-	tmp, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, errors.Wrap(err, "read dir")
-	}
-	for _, fi := range tmp {
-		// Skip directories and hidden files
-		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
-			continue
+	for _, src := range sources {
+		entries, err := fs.ReadDir(src.fsys, ".")
+		if err != nil {
+			return nil, errors.Wrap(err, "read dir")
 		}
-		// Skip any non-sql files
-		if filepath.Ext(fi.Name()) != ".sql" {
-			continue
+		for _, e := range entries {
+			// Skip directories and hidden files
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			// Skip any non-sql files, and down migrations, which
+			// only migratetest runs
+			if path.Ext(e.Name()) != ".sql" || isDown(e.Name()) {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil {
+				return nil, errors.Wrap(err, "info")
+			}
+			if src.namespace != "" {
+				fi = namedFileInfo{
+					FileInfo: fi,
+					name:     src.namespace + "/" + fi.Name(),
+				}
+			}
+			files = append(files, fi)
 		}
-		files = append(files, fi)
 	}
 	if len(files) == 0 {
 		return nil, errors.New("no sql migration files found (might be the wrong -dir)")
@@ -318,40 +857,112 @@ func readdir(dir string) ([]os.FileInfo, error) {
 	return files, nil
 }
 
+// readFile reads a migration file from its source.
+func (m *Migrate) readFile(filename string) ([]byte, error) {
+	ns := namespace(filename)
+	for _, src := range m.sources {
+		if src.namespace == ns {
+			return fs.ReadFile(src.fsys, path.Base(filename))
+		}
+	}
+	return nil, fmt.Errorf("no source for %s", filename)
+}
+
 // sortfiles by name, ensuring that something like 1.sql, 2.sql, 10.sql is
-// ordered correctly.
+// ordered correctly. Files from different namespaces are merged into one
+// order, so they may share a number, but files within a namespace may not.
 func sortfiles(files []os.FileInfo) error {
-	var nameErr error
-	sort.Slice(files, func(i, j int) bool {
-		if nameErr != nil {
-			return false
-		}
-		fiName1 := regexNum.FindString(files[i].Name())
-		fiName2 := regexNum.FindString(files[j].Name())
-		fiNum1, err := strconv.ParseUint(fiName1, 10, 64)
-		if err != nil {
-			nameErr = errors.Wrapf(err, "parse uint in file %s", files[i].Name())
-			return false
+	for _, fi := range files {
+		num := regexNum.FindString(path.Base(fi.Name()))
+		if _, err := strconv.ParseUint(num, 10, 64); err != nil {
+			return errors.Wrapf(err, "parse uint in file %s", fi.Name())
 		}
-		fiNum2, err := strconv.ParseUint(fiName2, 10, 64)
-		if err != nil {
-			nameErr = errors.Wrapf(err, "parse uint in file %s", files[i].Name())
-			return false
-		}
-		if fiNum1 == fiNum2 {
-			nameErr = fmt.Errorf("cannot have duplicate timestamp: %d", fiNum1)
-			return false
-		}
-		return fiNum1 < fiNum2
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return lessFile(files[i].Name(), files[j].Name())
 	})
-	return nameErr
+	for i := 1; i < len(files); i++ {
+		a, b := files[i-1].Name(), files[i].Name()
+		if fileNum(a) == fileNum(b) && namespace(a) == namespace(b) {
+			return fmt.Errorf("cannot have duplicate timestamp: %d in %s and %s",
+				fileNum(a), a, b)
+		}
+	}
+	return nil
+}
+
+// isDown reports whether a file is a down migration, named like the file it
+// reverses with a .down.sql extension. migrate never runs them, but
+// migratetest.WithReversibility checks that they reverse their files.
+func isDown(filename string) bool {
+	return strings.HasSuffix(filename, ".down.sql")
+}
+
+// isRepeatable reports whether a file is a repeatable migration.
+func isRepeatable(filename string) bool {
+	return strings.HasPrefix(path.Base(filename), "R__")
+}
+
+// lessFile reports whether migration file a runs before b.
+func lessFile(a, b string) bool {
+	if fileNum(a) != fileNum(b) {
+		return fileNum(a) < fileNum(b)
+	}
+	return namespace(a) < namespace(b)
+}
+
+// namespace of a migration file, which is empty unless it came from a source
+// added with WithSource.
+func namespace(filename string) string {
+	dir := path.Dir(filename)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// sum returns the hex-encoded checksum of byt.
+func (a ChecksumAlgorithm) sum(byt []byte) string {
+	if a == ChecksumSHA256 {
+		return fmt.Sprintf("%x", sha256.Sum256(byt))
+	}
+	return fmt.Sprintf("%x", md5.Sum(byt))
+}
+
+// checksumAlgorithm identifies the algorithm which computed a checksum by its
+// length.
+func checksumAlgorithm(checksum string) ChecksumAlgorithm {
+	if len(checksum) == 2*sha256.Size {
+		return ChecksumSHA256
+	}
+	return ChecksumMD5
+}
+
+// fileNum returns the leading number of a migration filename, or 0 if it
+// has none.
+func fileNum(filename string) uint64 {
+	base := path.Base(filename)
+	num, _ := strconv.ParseUint(regexNum.FindString(base), 10, 64)
+	return num
+}
+
+// migrationFromFile reads a migration file's content and checksum.
+func (m *Migrate) migrationFromFile(filename string) (Migration, error) {
+	byt, err := m.readFile(filename)
+	if err != nil {
+		return Migration{}, err
+	}
+	return Migration{
+		Filename: filename,
+		Content:  string(byt),
+		Checksum: m.checksum.sum(byt),
+	}, nil
 }
 
 func migrationsFromFiles(m *Migrate) ([]Migration, error) {
 	ms := make([]Migration, len(m.Files))
 	for i, fileInfo := range m.Files {
-		filename := filepath.Join(m.dir, fileInfo.Name())
-		byt, err := ioutil.ReadFile(filename)
+		byt, err := m.readFile(fileInfo.Name())
 		if err != nil {
 			return nil, errors.Wrap(err, "read file")
 		}
@@ -0,0 +1,1107 @@
+package migrate_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/egtann/migrate"
+	"github.com/egtann/migrate/migratetest"
+	"github.com/pkg/errors"
+)
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql":  file(`CREATE TABLE a (id INT); CREATE TABLE b (id INT);`),
+		"2.sql":  file(`-- Only a comment;` + "\n" + `ALTER TABLE a ADD x INT;`),
+		"10.sql": file(`DROP TABLE b;`),
+	}
+	db := migratetest.New()
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	ran, err := m.Migrate()
+	check(t, err)
+	if !ran {
+		t.Fatal("expected migrations to run")
+	}
+	want := "CREATE TABLE a (id INT),CREATE TABLE b (id INT)," +
+		"ALTER TABLE a ADD x INT,DROP TABLE b"
+	if got := strings.Join(db.Executed(), ","); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	assertMigrated(t, db, "1.sql", "2.sql", "10.sql")
+
+	// Migrating again does nothing
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	ran, err = m.Migrate()
+	check(t, err)
+	if ran {
+		t.Fatal("expected no migrations to run")
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE a (id INT);`)}
+	db := migrated(t, fsys)
+
+	fsys["1.sql"] = file(`CREATE TABLE a (id BIGINT);`)
+	_, err := plan(t, db, fsys)
+	var mismatch *migrate.ChecksumMismatchError
+	if !errors.As(err, &mismatch) || mismatch.File != "1.sql" {
+		t.Fatalf("expected a checksum mismatch in 1.sql, got %v", err)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`SELECT 1;`),
+		"3.sql": file(`SELECT 3;`),
+	}
+	db := migrated(t, fsys)
+
+	fsys["2.sql"] = file(`SELECT 2;`)
+	_, err := plan(t, db, fsys)
+	var outOfOrder *migrate.OutOfOrderError
+	if !errors.As(err, &outOfOrder) || outOfOrder.File != "2.sql" ||
+		outOfOrder.Ran != "3.sql" {
+		t.Fatalf("expected 2.sql to be out of order, got %v", err)
+	}
+
+	// Allowing it runs the file
+	m, err := migrate.New(db, migrate.WithFS(fsys),
+		migrate.WithOutOfOrder(migrate.OutOfOrderAllow))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	assertMigrated(t, db, "1.sql", "3.sql", "2.sql")
+}
+
+func TestMissingMigration(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`SELECT 1;`),
+		"2.sql": file(`SELECT 2;`),
+	}
+	db := migrated(t, fsys)
+
+	delete(fsys, "2.sql")
+	_, err := plan(t, db, fsys)
+	var missing *migrate.MissingMigrationError
+	if !errors.As(err, &missing) || len(missing.Files) != 1 ||
+		missing.Files[0] != "2.sql" {
+		t.Fatalf("expected 2.sql to be missing, got %v", err)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`SELECT 1;`),
+		"2.sql": file(`SELECT 2;`),
+		"3.sql": file(`SELECT 3;`),
+	}
+	db := migratetest.New()
+	m, err := migrate.New(db, migrate.WithFS(fsys),
+		migrate.WithBaseline("2.sql"))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Files through the baseline are recorded without running them
+	if got := strings.Join(db.Executed(), ","); got != "SELECT 3" {
+		t.Fatalf("expected only SELECT 3 to run, got %s", got)
+	}
+	assertMigrated(t, db, "1.sql", "2.sql", "3.sql")
+}
+
+func TestCheckpointResume(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file("SELECT 1;\nSELECT 2;\nSELECT 3;"),
+	}
+	db := migratetest.New()
+	db.FailExec(2, nil)
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	var stmtErr *migrate.StatementError
+	if !errors.As(err, &stmtErr) || stmtErr.Index != 1 ||
+		stmtErr.Line != 2 || !errors.Is(err, migratetest.ErrInjected) {
+		t.Fatalf("expected statement 1 on line 2 to fail, got %v", err)
+	}
+	assertMigrated(t, db)
+
+	// The next attempt resumes at the failed statement
+	p, err := plan(t, db, fsys)
+	check(t, err)
+	if len(p.Steps) != 1 || p.Steps[0].Resume != 1 {
+		t.Fatalf("expected to resume at statement 1, got %+v", p.Steps)
+	}
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	want := "SELECT 1,SELECT 2,SELECT 2,SELECT 3"
+	if got := strings.Join(db.Executed(), ","); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	assertMigrated(t, db, "1.sql")
+	names, err := db.GetMetaCheckpointFilenames()
+	check(t, err)
+	if len(names) != 0 {
+		t.Fatalf("expected no checkpoints, got %v", names)
+	}
+}
+
+func TestCheckpointChanged(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file("SELECT 1;\nSELECT 2;")}
+	db := migratetest.New()
+	db.FailExec(2, nil)
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// Changing a statement which already ran can't be resumed
+	fsys["1.sql"] = file("SELECT 10;\nSELECT 2;")
+	_, err = plan(t, db, fsys)
+	var mismatch *migrate.ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestCrashBeforeComplete(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file("SELECT 1;\nSELECT 2;")}
+	db := migratetest.New()
+	db.FailMethod("CompleteMigration", nil)
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	if _, err = m.Migrate(); !errors.Is(err, migratetest.ErrInjected) {
+		t.Fatalf("expected an injected fault, got %v", err)
+	}
+
+	// Every statement was checkpointed, so the file is only recorded
+	p, err := plan(t, db, fsys)
+	check(t, err)
+	if len(p.Steps) != 1 || p.Steps[0].Resume != 2 {
+		t.Fatalf("expected every statement to have run, got %+v",
+			p.Steps)
+	}
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if n := len(db.Executed()); n != 2 {
+		t.Fatalf("expected 2 statements to run, got %d", n)
+	}
+	assertMigrated(t, db, "1.sql")
+}
+
+func TestCheckpointFailure(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file("SELECT 1;\nSELECT 2;")}
+	db := migratetest.New()
+	db.FailMethod("InsertMetaCheckpoint", nil)
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	if _, err = m.Migrate(); !errors.Is(err, migratetest.ErrInjected) {
+		t.Fatalf("expected an injected fault, got %v", err)
+	}
+
+	// The statement ran, but without a checkpoint it runs again
+	p, err := plan(t, db, fsys)
+	check(t, err)
+	if len(p.Steps) != 1 || p.Steps[0].Resume != 0 {
+		t.Fatalf("expected to resume at statement 0, got %+v", p.Steps)
+	}
+}
+
+func TestHookFailure(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file("SELECT 1;\nALTER TABLE a ADD x INT;\nSELECT 3;"),
+	}
+	db := migratetest.New()
+	hooks := &failHooks{index: 1}
+	m, err := migrate.New(db, migrate.WithFS(fsys), migrate.WithHooks(hooks))
+	check(t, err)
+	if _, err = m.Migrate(); !errors.Is(err, migratetest.ErrInjected) {
+		t.Fatalf("expected an injected fault, got %v", err)
+	}
+
+	// The statement succeeded before its hook failed, so it isn't run
+	// again
+	p, err := plan(t, db, fsys)
+	check(t, err)
+	if len(p.Steps) != 1 || p.Steps[0].Resume != 2 {
+		t.Fatalf("expected to resume at statement 2, got %+v", p.Steps)
+	}
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	want := "SELECT 1,ALTER TABLE a ADD x INT,SELECT 3"
+	if got := strings.Join(db.Executed(), ","); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file("SELECT 1;\nSELECT 2;")}
+	db := migratetest.New()
+	db.FailExec(2, nil)
+	m, err := migrate.New(db, migrate.WithFS(fsys),
+		migrate.WithTransactions(migrate.TxPerFile))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// The rollback removed the checkpoint, so the file starts over
+	p, err := plan(t, db, fsys)
+	check(t, err)
+	if len(p.Steps) != 1 || p.Steps[0].Resume != 0 {
+		t.Fatalf("expected to start over, got %+v", p.Steps)
+	}
+}
+
+func TestLockRetries(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file("SELECT 1;\n-- migrate:lock-timeout 1s\n"),
+	}
+	db := migratetest.New()
+	db.FailExec(1, migratetest.ErrLockTimeout)
+	m, err := migrate.New(db, migrate.WithFS(fsys),
+		migrate.WithLockRetries(1, time.Millisecond))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if n := len(db.Executed()); n != 2 {
+		t.Fatalf("expected the statement to be retried, got %d", n)
+	}
+	if _, lock := db.Timeouts(); lock != time.Second {
+		t.Fatalf("expected a 1s lock timeout, got %s", lock)
+	}
+
+	// Without retries, the timeout fails the migration
+	db = migratetest.New()
+	db.FailExec(1, migratetest.ErrLockTimeout)
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	var lockErr *migrate.LockTimeoutError
+	if !errors.As(err, &lockErr) || lockErr.Attempts != 1 {
+		t.Fatalf("expected a lock timeout, got %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`SELECT 1;`)}
+	db := migratetest.New()
+	hooks := &lockHooks{db: db}
+	m, err := migrate.New(db, migrate.WithFS(fsys), migrate.WithHooks(hooks))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if !hooks.locked {
+		t.Fatal("expected the store to be locked while migrating")
+	}
+	if db.Locked() {
+		t.Fatal("expected the store to be unlocked")
+	}
+
+	// Apply takes the lock itself when planned separately
+	fsys["2.sql"] = file(`SELECT 2;`)
+	hooks.locked = false
+	m, err = migrate.New(db, migrate.WithFS(fsys), migrate.WithHooks(hooks))
+	check(t, err)
+	check(t, m.Init())
+	p, err := m.Plan()
+	check(t, err)
+	check(t, m.Apply(p))
+	if !hooks.locked || db.Locked() {
+		t.Fatal("expected the store to be locked only while applying")
+	}
+
+	// Another process holds the lock
+	check(t, db.Lock())
+	fsys["3.sql"] = file(`SELECT 3;`)
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil ||
+		!strings.Contains(err.Error(), "already locked") {
+		t.Fatalf("expected the lock to be taken, got %v", err)
+	}
+	if len(db.Executed()) != 2 {
+		t.Fatal("expected nothing to run without the lock")
+	}
+}
+
+func TestLockRetriesInTransaction(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`SELECT 1;`)}
+	db := migratetest.New()
+	_, err := migrate.New(db, migrate.WithFS(fsys),
+		migrate.WithTransactions(migrate.TxPerFile),
+		migrate.WithLockRetries(1, time.Millisecond))
+	if err == nil {
+		t.Fatal("expected lock retries to be rejected with transactions")
+	}
+
+	// A retry would fail anyway, since the timeout aborts the transaction
+	check(t, db.BeginMigration())
+	db.FailExec(1, migratetest.ErrLockTimeout)
+	if _, err = db.Exec(`SELECT 1`); !db.IsLockTimeout(err) {
+		t.Fatalf("expected a lock timeout, got %v", err)
+	}
+	if _, err = db.Exec(`SELECT 1`); err != migratetest.ErrTxAborted {
+		t.Fatalf("expected an aborted transaction, got %v", err)
+	}
+	check(t, db.RollbackMigration())
+	_, err = db.Exec(`SELECT 1`)
+	check(t, err)
+}
+
+func TestStalePlan(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`SELECT 1;`)}
+	db := migratetest.New()
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	check(t, m.Init())
+	p, err := m.Plan()
+	check(t, err)
+
+	// Another process migrates in the meantime
+	migrated(t, fsys, db)
+
+	var stale *migrate.StalePlanError
+	if err = m.Apply(p); !errors.As(err, &stale) {
+		t.Fatalf("expected a stale plan, got %v", err)
+	}
+}
+
+func TestUpgradeRequired(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`SELECT 1;`)}
+	db := migratetest.New()
+	db.SetMetaVersion(migrate.MetaVersion{Version: 1})
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	check(t, m.Init())
+	plan, err := m.Plan()
+	check(t, err)
+	if len(plan.MetaUpgrades) != 1 || plan.MetaUpgrades[0].Version != 2 {
+		t.Fatalf("expected an upgrade to v2, got %+v", plan.MetaUpgrades)
+	}
+	var upgrade *migrate.UpgradeRequiredError
+	err = m.Apply(plan)
+	if !errors.As(err, &upgrade) || upgrade.Version != 1 {
+		t.Fatalf("expected an upgrade to be required, got %v", err)
+	}
+	check(t, m.Upgrade())
+	plan, err = m.Plan()
+	check(t, err)
+	check(t, m.Apply(plan))
+}
+
+func TestSquashTrigger(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE a (id INT);`)}
+	db := &introStore{Store: migratetest.New(), dump: []string{
+		`CREATE TABLE a (id INT)`,
+		"CREATE TRIGGER a_audit AFTER INSERT ON a BEGIN\n\tSELECT 1;\nEND",
+	}}
+
+	// The trigger's body would be split into separate statements
+	_, err := migrate.Squash(db, "1", migrate.WithFS(fsys))
+	if err == nil || !strings.Contains(err.Error(), "CREATE TRIGGER a_audit") {
+		t.Fatalf("expected the trigger to be refused, got %v", err)
+	}
+
+	db.dump = db.dump[:1]
+	content, err := migrate.Squash(db, "1", migrate.WithFS(fsys))
+	check(t, err)
+	if !strings.HasPrefix(content, "CREATE TABLE a (id INT);\n") {
+		t.Fatalf("expected the table, got %s", content)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`CREATE TABLE users (id INT);`),
+		"2.sql": file(`CREATE TABLE posts (id INT);`),
+	}
+	_, err := migrate.Drift(migratetest.New(), migrate.WithFS(fsys))
+	if err == nil {
+		t.Fatal("expected drift to require an Introspector")
+	}
+
+	db := &introStore{Store: migrated(t, fsys)}
+	diffs, err := migrate.Drift(db, migrate.WithFS(fsys))
+	check(t, err)
+	if len(diffs) != 0 {
+		t.Fatalf("expected no drift, got %v", diffs)
+	}
+
+	// Hot-fix the live database by hand
+	_, err = db.Exec(`CREATE TABLE audits (id INT)`)
+	check(t, err)
+	diffs, err = migrate.Drift(db, migrate.WithFS(fsys))
+	check(t, err)
+	if len(diffs) != 1 || diffs[0] != "table audits is not in the migrations" {
+		t.Fatalf("expected audits to drift, got %v", diffs)
+	}
+}
+
+func TestSquash(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`CREATE TABLE users (id INT);`),
+		"2.sql": file(`CREATE TABLE posts (id INT);`),
+		"3.sql": file(`CREATE TABLE tags (id INT);`),
+	}
+	db := &introStore{Store: migrated(t, fsys)}
+
+	content, err := migrate.Squash(db, "2", migrate.WithFS(fsys))
+	check(t, err)
+	delete(fsys, "1.sql")
+	delete(fsys, "2.sql")
+	fsys["2_squash.sql"] = file(content)
+
+	// The live database should record the squashed file in place of the
+	// originals
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	ran, err := m.Migrate()
+	check(t, err)
+	if ran {
+		t.Fatal("expected nothing to migrate")
+	}
+	if len(m.Migrations) != 2 || m.Migrations[0].Filename != "2_squash.sql" {
+		t.Fatalf("expected 2_squash.sql, 3.sql, got %+v", m.Migrations)
+	}
+
+	// And a fresh database should match it
+	diffs, err := migrate.Drift(db, migrate.WithFS(fsys))
+	check(t, err)
+	if len(diffs) != 0 {
+		t.Fatalf("expected no drift, got %v", diffs)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": file(`CREATE TABLE ${MIGRATE_TEST_TABLE} (id INT);`),
+	}
+	db := migratetest.New()
+
+	// Unset variables are an error
+	m, err := migrate.New(db, migrate.WithFS(fsys), migrate.WithExpandEnv())
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected error for unset variable")
+	}
+
+	t.Setenv("MIGRATE_TEST_TABLE", "users")
+	_, err = m.Migrate()
+	check(t, err)
+	ms, err := db.GetMigrations()
+	check(t, err)
+	want := `CREATE TABLE users (id INT);`
+	if len(ms) != 1 || ms[0].Content != want {
+		t.Fatalf("expected expanded content, got %+v", ms)
+	}
+
+	// The checksum is computed over the raw file, so history remains valid
+	// when the environment changes
+	t.Setenv("MIGRATE_TEST_TABLE", "accounts")
+	m, err = migrate.New(db, migrate.WithFS(fsys), migrate.WithExpandEnv())
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+}
+
+func TestStatementError(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE users (id INT);
+
+CREATE TABLE posts (id INT);
+SELECT 1;`)}
+	db := migratetest.New()
+	db.FailExec(2, migratetest.ErrInjected)
+
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	var stmtErr *migrate.StatementError
+	if !errors.As(err, &stmtErr) {
+		t.Fatalf("expected statement error, got %v", err)
+	}
+	if stmtErr.File != "1.sql" || stmtErr.Index != 1 || stmtErr.Line != 3 {
+		t.Fatalf("unexpected statement error %+v", stmtErr)
+	}
+	if !errors.Is(err, migratetest.ErrInjected) {
+		t.Fatalf("expected the cause to be kept, got %v", err)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`
+			CREATE TABLE users (id INT);
+			INSERT INTO users (id) VALUES (1), (2);`),
+		"2.sql": file(`DROP TABLE users;`),
+	}
+	db := migratetest.New()
+
+	hooks := &recordHooks{stop: "2.sql"}
+	m, err := migrate.New(db, migrate.WithFS(fsys), migrate.WithHooks(hooks))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected hook to stop the migration")
+	}
+	if len(hooks.stmts) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(hooks.stmts))
+	}
+	e := hooks.stmts[1]
+	if e.Filename != "1.sql" || e.Index != 1 ||
+		e.SQL != `INSERT INTO users (id) VALUES (1), (2)` {
+		t.Fatalf("unexpected statement event %+v", e)
+	}
+	assertMigrated(t, db, "1.sql")
+}
+
+func TestWithLogger(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE users (id INT);`)}
+
+	log := &recordLogger{}
+	m, err := migrate.New(migratetest.New(), migrate.WithFS(fsys),
+		migrate.WithLogger(log))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if len(log.infos) != 1 {
+		t.Fatalf("expected 1 info message, got %v", log.infos)
+	}
+	got := log.infos[0]
+	if got[0] != "migrated" || got[1] != "file" || got[2] != "1.sql" {
+		t.Fatalf("unexpected message %v", got)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE users (id INT);`)}
+	db := migratetest.New()
+	m, err := migrate.New(db, migrate.WithFS(fsys),
+		migrate.WithChecksum(migrate.ChecksumSHA256))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// Switching back to md5 must still accept the sha256 history
+	fsys["2.sql"] = file(`CREATE TABLE posts (id INT);`)
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 2 {
+		t.Fatalf("expected 2 migrations, got %d", len(ms))
+	}
+	for _, mg := range ms {
+		want := 32
+		if mg.Filename == "1.sql" {
+			want = 64
+		}
+		if len(mg.Checksum) != want {
+			t.Fatalf("%s: expected checksum of length %d, got %s",
+				mg.Filename, want, mg.Checksum)
+		}
+	}
+}
+
+func TestInitUpgradePlan(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE users (id INT);`)}
+	db := migratetest.New()
+	assertNoMeta := func() {
+		t.Helper()
+		exists, err := db.MetaExists()
+		check(t, err)
+		if exists {
+			t.Fatal("expected no meta tables")
+		}
+	}
+
+	// New must not touch the database
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	assertNoMeta()
+
+	// Planning before Init only reads, so a dry run leaves it untouched
+	plan, err := m.Plan()
+	check(t, err)
+	if len(plan.Steps) != 1 {
+		t.Fatalf("expected 1 step, got %+v", plan.Steps)
+	}
+	assertNoMeta()
+	if err = m.Apply(plan); err == nil {
+		t.Fatal("expected apply before init to fail")
+	}
+	if len(db.Executed()) != 0 {
+		t.Fatalf("expected nothing to run, got %v", db.Executed())
+	}
+
+	// A fresh database's meta tables are created at the current version
+	check(t, m.Init())
+	ups, err := m.MetaUpgrades()
+	check(t, err)
+	if len(ups) != 0 {
+		t.Fatalf("expected no meta upgrades, got %+v", ups)
+	}
+	_, err = m.Plan()
+	check(t, err)
+
+	ran, err := m.Migrate()
+	check(t, err)
+	if !ran || len(m.Migrations) != 1 {
+		t.Fatalf("expected 1 migration, got %+v", m.Migrations)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`
+			CREATE TABLE posts (id INT);
+			CREATE TABLE teams (id INT);`),
+		"2.sql": file(`CREATE TABLE users (id INT);`),
+	}
+
+	// A previous attempt ran the first statement in 1.sql
+	db := migratetest.New()
+	db.FailExec(2, nil)
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	p, err := plan(t, db, fsys)
+	check(t, err)
+	if len(p.Steps) != 2 {
+		t.Fatalf("expected 2 steps, got %d", len(p.Steps))
+	}
+	if p.Steps[0].Resume != 1 || len(p.Steps[0].Statements) != 2 {
+		t.Fatalf("expected to resume 1.sql at 1, got %+v", p.Steps[0])
+	}
+
+	// Migrating elsewhere makes the plan stale
+	migrated(t, fsys, db)
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	check(t, m.Init())
+	var stale *migrate.StalePlanError
+	if err = m.Apply(p); !errors.As(err, &stale) {
+		t.Fatalf("expected stale plan error, got %v", err)
+	}
+
+	p, err = m.Plan()
+	check(t, err)
+	if !p.Empty() {
+		t.Fatalf("expected empty plan, got %+v", p)
+	}
+	check(t, m.Apply(p))
+}
+
+func TestMigrateTenants(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE users (id INT);`)}
+	db := &tenantStore{
+		Store: migratetest.New(),
+		tenants: map[string]*migratetest.Store{
+			"a": migratetest.New(),
+			"c": migratetest.New(),
+		},
+	}
+
+	tenants := []string{"a", "missing", "c"}
+	cfg := migrate.TenantConfig{Concurrency: 2, ContinueOnError: true}
+	results, err := migrate.MigrateTenants(db, tenants, cfg,
+		migrate.WithFS(fsys))
+	check(t, err)
+	want := []migrate.TenantStatus{
+		migrate.TenantMigrated,
+		migrate.TenantFailed,
+		migrate.TenantMigrated,
+	}
+	for i, r := range results {
+		if r.Status != want[i] {
+			t.Fatalf("%s: expected %s, got %s (%v)", r.Tenant,
+				want[i], r.Status, r.Err)
+		}
+	}
+	assertMigrated(t, db.tenants["a"], "1.sql")
+
+	// Without ContinueOnError, tenants after a failure are skipped
+	cfg = migrate.TenantConfig{Concurrency: 1}
+	results, err = migrate.MigrateTenants(db, tenants, cfg,
+		migrate.WithFS(fsys))
+	check(t, err)
+	want = []migrate.TenantStatus{
+		migrate.TenantUpToDate,
+		migrate.TenantFailed,
+		migrate.TenantSkipped,
+	}
+	for i, r := range results {
+		if r.Status != want[i] {
+			t.Fatalf("%s: expected %s, got %s (%v)", r.Tenant,
+				want[i], r.Status, r.Err)
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	t.Parallel()
+	billing := fstest.MapFS{"1.sql": file(`CREATE TABLE invoices (id INT);`)}
+	auth := fstest.MapFS{
+		"1.sql": file(`CREATE TABLE users (id INT);`),
+		"2.sql": file(`CREATE TABLE sessions (id INT);`),
+	}
+	db := migratetest.New()
+	m, err := migrate.New(db, migrate.WithSource("billing", billing),
+		migrate.WithSource("auth", auth))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	assertMigrated(t, db, "auth/1.sql", "billing/1.sql", "auth/2.sql")
+
+	// Numbers must still be unique within a namespace
+	auth["01.sql"] = file(`SELECT 1;`)
+	_, err = migrate.New(db, migrate.WithSource("billing", billing),
+		migrate.WithSource("auth", auth))
+	if err == nil {
+		t.Fatal("expected duplicate number error")
+	}
+}
+
+func TestRepeatable(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": file(`CREATE TABLE users (id INT, email TEXT);`),
+		"R__views.sql": file(`
+			DROP VIEW IF EXISTS emails;
+			CREATE VIEW emails AS SELECT email FROM users;`),
+	}
+	db := migrated(t, fsys)
+	if n := len(db.Executed()); n != 3 {
+		t.Fatalf("expected 3 statements, got %d", n)
+	}
+
+	// Unchanged repeatables don't run again
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	ran, err := m.Migrate()
+	check(t, err)
+	if ran || len(db.Executed()) != 3 {
+		t.Fatal("expected nothing to migrate")
+	}
+
+	// Changed repeatables run after new versioned files
+	fsys["2.sql"] = file(`ALTER TABLE users ADD name TEXT;`)
+	fsys["R__views.sql"] = file(`
+		DROP VIEW IF EXISTS emails;
+		CREATE VIEW emails AS SELECT email, name FROM users;`)
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	executed := db.Executed()
+	if len(executed) != 6 || executed[3] != `ALTER TABLE users ADD name TEXT` {
+		t.Fatalf("unexpected statements %v", executed[3:])
+	}
+	if len(m.Migrations) != 2 {
+		t.Fatalf("expected 2 versioned migrations, got %d",
+			len(m.Migrations))
+	}
+	assertMigrated(t, db, "1.sql", "R__views.sql", "2.sql")
+}
+
+func TestRecoverCheckpoints(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`CREATE TABLE posts (id INT);`)}
+
+	// A previous attempt ran every statement in 1.sql, then crashed before
+	// recording it, and another left checkpoints for a file which no longer
+	// exists
+	db := migratetest.New()
+	db.FailMethod("CompleteMigration", nil)
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	if _, err = m.Migrate(); err == nil {
+		t.Fatal("expected an error")
+	}
+	check(t, db.InsertMetaCheckpoint("9.sql", "SELECT 9", "md5", 0))
+
+	p, err := plan(t, db, fsys)
+	check(t, err)
+	if len(p.Steps) != 1 || p.Steps[0].Resume != 1 {
+		t.Fatalf("expected to record 1.sql, got %+v", p.Steps)
+	}
+	if len(p.StaleCheckpoints) != 1 || p.StaleCheckpoints[0] != "9.sql" {
+		t.Fatalf("expected stale 9.sql, got %v", p.StaleCheckpoints)
+	}
+
+	// The statement isn't run again
+	m, err = migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	check(t, m.Init())
+	check(t, m.Apply(p))
+	if n := len(db.Executed()); n != 1 {
+		t.Fatalf("expected 1 statement to run, got %d", n)
+	}
+	assertMigrated(t, db, "1.sql")
+	filenames, err := db.GetMetaCheckpointFilenames()
+	check(t, err)
+	if len(filenames) != 0 {
+		t.Fatalf("expected no checkpoints, got %v", filenames)
+	}
+
+	p, err = m.Plan()
+	check(t, err)
+	if !p.Empty() {
+		t.Fatalf("expected empty plan, got %+v", p)
+	}
+}
+
+func TestSchemaVersionTooNew(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file(`SELECT 1;`)}
+	db := migratetest.New()
+	db.SetMetaVersion(migrate.MetaVersion{Version: 99, Release: "v9.0.0"})
+
+	// Older releases refuse newer meta tables, and report the release they
+	// need
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	var versionErr *migrate.SchemaVersionTooNewError
+	if err = m.Init(); !errors.As(err, &versionErr) {
+		t.Fatalf("expected version too new error, got %v", err)
+	}
+	if versionErr.Release != "v9.0.0" ||
+		!strings.Contains(err.Error(), "v9.0.0") {
+		t.Fatalf("expected error to name v9.0.0, got %v", err)
+	}
+}
+
+func TestCopyUnsupported(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{"1.sql": file("CREATE TABLE posts (title TEXT);\n" +
+		"INSERT INTO posts (title) VALUES ('a');\n" +
+		"COPY posts (title) FROM STDIN;\n" +
+		"b; c\n" +
+		"\\.\n")}
+
+	m, err := migrate.New(migratetest.New(), migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	if err == nil || !strings.Contains(err.Error(),
+		"line 3: store does not support COPY") {
+		t.Fatalf("expected unsupported COPY on line 3, got %v", err)
+	}
+}
+
+// failHooks fails the AfterStatement hook for the statement at index.
+type failHooks struct {
+	migrate.NopHooks
+	index int
+}
+
+func (h *failHooks) AfterStatement(e migrate.StatementEvent) error {
+	if e.Index == h.index {
+		return migratetest.ErrInjected
+	}
+	return nil
+}
+
+// lockHooks records whether db was locked while a file migrated.
+type lockHooks struct {
+	migrate.NopHooks
+	db     *migratetest.Store
+	locked bool
+}
+
+func (h *lockHooks) BeforeMigration(string) error {
+	h.locked = h.db.Locked()
+	return nil
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func file(content string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(content)}
+}
+
+// migrated runs the migrations in fsys against db, or a new Store if db is
+// omitted, and returns it.
+func migrated(
+	t *testing.T,
+	fsys fstest.MapFS,
+	db ...*migratetest.Store,
+) *migratetest.Store {
+	t.Helper()
+	s := migratetest.New()
+	if len(db) > 0 {
+		s = db[0]
+	}
+	m, err := migrate.New(s, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	return s
+}
+
+// plan the migrations in fsys against db.
+func plan(
+	t *testing.T,
+	db *migratetest.Store,
+	fsys fstest.MapFS,
+) (*migrate.Plan, error) {
+	t.Helper()
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	check(t, m.Init())
+	return m.Plan()
+}
+
+// assertMigrated fails unless db recorded exactly the named files, in order.
+func assertMigrated(t *testing.T, db *migratetest.Store, want ...string) {
+	t.Helper()
+	ms, err := db.GetMigrations()
+	check(t, err)
+	var got []string
+	for _, mg := range ms {
+		got = append(got, mg.Filename)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %v to be migrated, got %v", want, got)
+	}
+}
+
+// introStore is an Introspector whose schema holds the tables created by the
+// statements it executed. It dumps those statements, or dump if set, which its
+// scratch databases share.
+type introStore struct {
+	*migratetest.Store
+	dump []string
+}
+
+func (s *introStore) Schema() (*migrate.Schema, error) {
+	schema := migrate.NewSchema()
+	for _, q := range s.Executed() {
+		if strings.HasPrefix(q, "CREATE TABLE ") {
+			schema.Table(strings.Fields(q)[2])
+		}
+	}
+	return schema, nil
+}
+
+func (s *introStore) Scratch() (migrate.Store, func() error, error) {
+	scratch := &introStore{Store: migratetest.New(), dump: s.dump}
+	return scratch, func() error { return nil }, nil
+}
+
+func (s *introStore) DumpSchema() ([]string, error) {
+	if s.dump != nil {
+		return s.dump, nil
+	}
+	var stmts []string
+	for _, q := range s.Executed() {
+		if strings.HasPrefix(q, "CREATE TABLE ") {
+			stmts = append(stmts, q)
+		}
+	}
+	return stmts, nil
+}
+
+// recordHooks records the statements which ran, and stops before a file.
+type recordHooks struct {
+	migrate.NopHooks
+	stmts []migrate.StatementEvent
+	stop  string
+}
+
+func (h *recordHooks) BeforeMigration(filename string) error {
+	if filename == h.stop {
+		return errors.New("stopped by policy")
+	}
+	return nil
+}
+
+func (h *recordHooks) AfterStatement(e migrate.StatementEvent) error {
+	h.stmts = append(h.stmts, e)
+	return nil
+}
+
+// recordLogger records the info messages it's given, with their key-value
+// pairs.
+type recordLogger struct {
+	infos [][]interface{}
+}
+
+func (l *recordLogger) Debug(string, ...interface{}) {}
+func (l *recordLogger) Warn(string, ...interface{})  {}
+func (l *recordLogger) Error(string, ...interface{}) {}
+
+func (l *recordLogger) Info(msg string, kvs ...interface{}) {
+	l.infos = append(l.infos, append([]interface{}{msg}, kvs...))
+}
+
+// tenantStore is a Tenanter with a Store for each of its tenants. Any other
+// tenant fails to open.
+type tenantStore struct {
+	*migratetest.Store
+	tenants map[string]*migratetest.Store
+}
+
+func (s *tenantStore) Tenant(name string) (migrate.Store, func() error, error) {
+	tenant, ok := s.tenants[name]
+	if !ok {
+		return nil, nil, errors.Errorf("tenant %s does not exist", name)
+	}
+	return tenant, func() error { return nil }, nil
+}
+
+func (s *tenantStore) TenantNames(query string) ([]string, error) {
+	names := []string{}
+	for name := range s.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
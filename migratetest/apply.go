@@ -0,0 +1,281 @@
+package migratetest
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/egtann/migrate"
+	"github.com/pkg/errors"
+)
+
+// Option configures Apply.
+type Option func(*config)
+
+type config struct {
+	opts       []migrate.Option
+	reversible bool
+}
+
+// WithOptions passes opts to migrate.New, after the source.
+func WithOptions(opts ...migrate.Option) Option {
+	return func(c *config) {
+		c.opts = append(c.opts, opts...)
+	}
+}
+
+// WithReversibility checks each file which has a down migration, named like
+// the file with a .down.sql extension, such as 2_add_email.down.sql for
+// 2_add_email.sql. migrate itself ignores down migrations. After the file
+// runs, Apply runs its down migration and then the file again. If db
+// implements migrate.Introspector, the schema must then match the schema
+// before and after the file ran, respectively.
+func WithReversibility() Option {
+	return func(c *config) {
+		c.reversible = true
+	}
+}
+
+// Apply runs every migration in fsys against a fresh database and fails the
+// test with the file, statement and line that broke if any fails. It returns
+// the migrated Store, for checks of the resulting schema.
+//
+// If db implements migrate.Introspector, the migrations run against a scratch
+// database alongside it, such as a temporary SQLite file, which is removed
+// when the test ends. db must then be open only if creating the scratch
+// database needs its connection, as for a Postgres server. Otherwise db must
+// be open and empty, as a new Store is.
+//
+// A service can then test its migrations in a line:
+//
+//	migratetest.Apply(t, migrations.FS, sqlite.New(":memory:"))
+func Apply(
+	t testing.TB,
+	fsys fs.FS,
+	db migrate.Store,
+	opts ...Option,
+) migrate.Store {
+	t.Helper()
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	live, ok := db.(migrate.Introspector)
+	if ok {
+		scratch, cleanup, err := live.Scratch()
+		if err != nil {
+			t.Fatalf("create scratch db: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := cleanup(); err != nil {
+				t.Errorf("clean up scratch db: %v", err)
+			}
+		})
+		db = scratch
+	}
+
+	// Down migrations are read before the meta tables exist, while a plan
+	// lists every file as pending
+	var downs map[string]migrate.Step
+	if c.reversible {
+		downs = planDowns(t, fsys, db, c.opts)
+	}
+
+	m, err := migrate.New(db, append([]migrate.Option{
+		migrate.WithFS(fsys)}, c.opts...)...)
+	if err != nil {
+		t.Fatalf("read migrations: %v", err)
+	}
+	if !c.reversible {
+		if _, err = m.Migrate(); err != nil {
+			fatal(t, "migrate", err)
+		}
+		return db
+	}
+
+	// Apply one file at a time, so each can be reversed before the next
+	if err = m.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if err = m.Upgrade(); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	for {
+		plan, err := m.Plan()
+		if err != nil {
+			fatal(t, "plan", err)
+		}
+		if plan.Empty() {
+			return db
+		}
+		steps := plan.Steps
+		if len(steps) > 0 {
+			plan.Steps = steps[:1]
+		}
+		before := schema(t, db)
+		if err = m.Apply(plan); err != nil {
+			fatal(t, "migrate", err)
+		}
+		if len(steps) == 0 {
+			continue
+		}
+		step := steps[0]
+		down, ok := downs[step.Filename]
+		if !ok || step.Repeatable {
+			continue
+		}
+		after := schema(t, db)
+		run(t, db, downName(step.Filename), down.Statements)
+		assertSchema(t, db, before, "after "+downName(step.Filename))
+		run(t, db, step.Filename, step.Statements)
+		assertSchema(t, db, after, "after reapplying "+step.Filename)
+	}
+}
+
+// planDowns splits the down migrations in fsys into statements, keyed by the
+// files they reverse. db must not have meta tables yet.
+func planDowns(
+	t testing.TB,
+	fsys fs.FS,
+	db migrate.Store,
+	opts []migrate.Option,
+) map[string]migrate.Step {
+	t.Helper()
+
+	// Every file keeps its name, so options such as migrate.WithBaseline
+	// still apply, but has the content of its down migration if it has one
+	downFS := fstest.MapFS{}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("read migrations: %v", err)
+	}
+	hasDown := map[string]bool{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") ||
+			strings.HasSuffix(name, ".down.sql") {
+			continue
+		}
+		byt, err := fs.ReadFile(fsys, downName(name))
+		switch {
+		case err == nil:
+			hasDown[name] = true
+		case errors.Is(err, fs.ErrNotExist):
+			byt, err = fs.ReadFile(fsys, name)
+			if err != nil {
+				t.Fatalf("read %s: %v", name, err)
+			}
+		default:
+			t.Fatalf("read %s: %v", downName(name), err)
+		}
+		downFS[name] = &fstest.MapFile{Data: byt}
+	}
+
+	m, err := migrate.New(db, append(append([]migrate.Option{},
+		opts...), migrate.WithFS(downFS))...)
+	if err != nil {
+		t.Fatalf("read down migrations: %v", err)
+	}
+	plan, err := m.Plan()
+	if err != nil {
+		fatal(t, "plan down migrations", err)
+	}
+	downs := map[string]migrate.Step{}
+	for _, step := range plan.Steps {
+		if hasDown[step.Filename] {
+			downs[step.Filename] = step
+		}
+	}
+	return downs
+}
+
+// run executes stmts outside of migrate, since the files they come from are
+// already recorded as migrated.
+func run(
+	t testing.TB,
+	db migrate.Store,
+	filename string,
+	stmts []migrate.Statement,
+) {
+	t.Helper()
+	for i, stmt := range stmts {
+		var err error
+		switch {
+		case stmt.Rebuild != "":
+			r, ok := db.(migrate.Rebuilder)
+			if !ok {
+				t.Fatalf("%s: store does not support rebuilding tables",
+					filename)
+			}
+			err = r.RebuildTable(stmt.Rebuild, stmt.SQL)
+		case stmt.Copy:
+			c, ok := db.(migrate.Copier)
+			if !ok {
+				t.Fatalf("%s: store does not support COPY FROM STDIN",
+					filename)
+			}
+			_, err = c.CopyFrom(context.Background(), stmt.SQL,
+				strings.NewReader(stmt.Data))
+		default:
+			_, err = db.Exec(stmt.SQL)
+		}
+		if err != nil {
+			fatal(t, "run", &migrate.StatementError{
+				File:  filename,
+				Index: i,
+				SQL:   stmt.SQL,
+				Line:  stmt.Line,
+				Cause: err,
+			})
+		}
+	}
+}
+
+// schema returns the schema of db, or nil if it can't be introspected.
+func schema(t testing.TB, db migrate.Store) *migrate.Schema {
+	t.Helper()
+	intro, ok := db.(migrate.Introspector)
+	if !ok {
+		return nil
+	}
+	s, err := intro.Schema()
+	if err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	return s
+}
+
+// assertSchema fails the test unless db has the schema we want.
+func assertSchema(
+	t testing.TB,
+	db migrate.Store,
+	want *migrate.Schema,
+	when string,
+) {
+	t.Helper()
+	if want == nil {
+		return
+	}
+	diffs := migrate.Diff(want, schema(t, db))
+	if len(diffs) > 0 {
+		t.Fatalf("schema differs %s: %s", when, strings.Join(diffs, "; "))
+	}
+}
+
+// downName returns the name of the down migration which reverses filename.
+func downName(filename string) string {
+	return strings.TrimSuffix(filename, ".sql") + ".down.sql"
+}
+
+// fatal fails the test with err, including the statement which broke if
+// there is one.
+func fatal(t testing.TB, msg string, err error) {
+	t.Helper()
+	var stmtErr *migrate.StatementError
+	if errors.As(err, &stmtErr) {
+		t.Fatalf("%v\n%s", stmtErr, stmtErr.SQL)
+	}
+	t.Fatalf("%s: %v", msg, err)
+}
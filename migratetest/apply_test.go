@@ -0,0 +1,113 @@
+package migratetest
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestApply(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": {Data: []byte(`CREATE TABLE a (id INT);`)},
+		"2.sql": {Data: []byte("ALTER TABLE a ADD x INT;\nDROP TABLE b;")},
+	}
+	db := New()
+	if got := Apply(t, fsys, db); got != db {
+		t.Fatal("expected the store to be migrated in place")
+	}
+	if n := len(db.Executed()); n != 3 {
+		t.Fatalf("expected 3 statements, got %d", n)
+	}
+}
+
+func TestApplyFailure(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql": {Data: []byte(`CREATE TABLE a (id INT);`)},
+		"2.sql": {Data: []byte("ALTER TABLE a ADD x INT;\nDROP TABLE b;")},
+	}
+	db := New()
+	db.FailExec(3, nil)
+
+	ft := &fatalT{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Apply(ft, fsys, db)
+	}()
+	<-done
+	want := "2.sql: statement 1 on line 2: migratetest: injected fault\nDROP TABLE b"
+	if !strings.Contains(ft.msg, want) {
+		t.Fatalf("expected %q, got %q", want, ft.msg)
+	}
+}
+
+func TestApplyReversibility(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.sql":            {Data: []byte(`CREATE TABLE a (id INT);`)},
+		"2_x.sql":          {Data: []byte(`ALTER TABLE a ADD x INT;`)},
+		"2_x.down.sql":     {Data: []byte(`ALTER TABLE a DROP x;`)},
+		"3.sql":            {Data: []byte(`CREATE TABLE b (id INT);`)},
+		"3.down.sql":       {Data: []byte(`DROP TABLE b;`)},
+		"R__view.sql":      {Data: []byte(`CREATE VIEW v AS SELECT 1;`)},
+		"R__view.down.sql": {Data: []byte(`DROP VIEW v;`)},
+	}
+
+	// Without the option, down migrations are ignored
+	db := New()
+	Apply(t, fsys, db)
+	want := "CREATE TABLE a (id INT),ALTER TABLE a ADD x INT," +
+		"CREATE TABLE b (id INT),CREATE VIEW v AS SELECT 1"
+	if got := strings.Join(db.Executed(), ","); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	// With it, each down migration runs after its file, which then runs
+	// again
+	db = New()
+	Apply(t, fsys, db, WithReversibility())
+	want = "CREATE TABLE a (id INT)," +
+		"ALTER TABLE a ADD x INT,ALTER TABLE a DROP x,ALTER TABLE a ADD x INT," +
+		"CREATE TABLE b (id INT),DROP TABLE b,CREATE TABLE b (id INT)," +
+		"CREATE VIEW v AS SELECT 1"
+	if got := strings.Join(db.Executed(), ","); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	ms, err := db.GetMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 4 {
+		t.Fatalf("expected 4 migrations, got %+v", ms)
+	}
+
+	// A down migration which fails is reported like a migration
+	db = New()
+	db.FailExec(3, nil)
+	ft := &fatalT{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Apply(ft, fsys, db, WithReversibility())
+	}()
+	<-done
+	want = "2_x.down.sql: statement 0 on line 1: migratetest: injected fault\nALTER TABLE a DROP x"
+	if !strings.Contains(ft.msg, want) {
+		t.Fatalf("expected %q, got %q", want, ft.msg)
+	}
+}
+
+// fatalT records the message of a fatal error. Like testing.T, Fatalf stops
+// the goroutine which calls it.
+type fatalT struct {
+	testing.TB
+	msg string
+}
+
+func (t *fatalT) Helper() {}
+
+func (t *fatalT) Fatalf(format string, args ...interface{}) {
+	t.msg = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
@@ -0,0 +1,522 @@
+// Package migratetest helps test migrations and code built on migrate. Store
+// is an in-memory Store with fault injection, so the migrate package's
+// behavior can be tested without a database.
+package migratetest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/egtann/migrate"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInjected is returned by a fault armed without an error of its
+	// own.
+	ErrInjected = errors.New("migratetest: injected fault")
+
+	// ErrLockTimeout is reported by IsLockTimeout. Arm it with FailExec
+	// to test retrying statements.
+	ErrLockTimeout = errors.New("migratetest: lock timeout")
+
+	// ErrTxAborted is returned by statements which follow a failed one in
+	// the same transaction.
+	ErrTxAborted = errors.New("migratetest: current transaction is aborted")
+)
+
+// Store keeps the meta tables in memory and records every statement it
+// executes without running it. It implements migrate.Transactor: rolling back
+// restores the meta tables, but not the record of executed statements. As in
+// Postgres, a statement which fails within a transaction aborts it, and every
+// statement after fails with ErrTxAborted until it's rolled back. It also
+// implements migrate.Locker. It's safe for concurrent use.
+type Store struct {
+	mu sync.Mutex
+
+	metaCreated bool
+	version     migrate.MetaVersion
+
+	// migrations are the rows of the meta table, in the order they were
+	// inserted, and checkpoints map filenames to the rows of the
+	// metacheckpoints table.
+	migrations  []migrate.Migration
+	checkpoints map[string][]checkpoint
+
+	// snapshot holds the meta tables as they were at BeginMigration,
+	// until the migration commits or rolls back.
+	snapshot *snapshot
+
+	// aborted is set when a statement fails within a transaction.
+	aborted bool
+
+	executed []string
+	timeouts [2]time.Duration
+	locked   bool
+
+	// execFault is the number of statements to execute before failing
+	// with execErr, or 0 if none should fail. methodFaults map Store
+	// method names to the error their next call returns.
+	execFault    int
+	execErr      error
+	methodFaults map[string]error
+}
+
+type checkpoint struct {
+	idx      int
+	checksum string
+	content  string
+}
+
+type snapshot struct {
+	migrations  []migrate.Migration
+	checkpoints map[string][]checkpoint
+}
+
+// New returns an empty Store, as if connected to a new database.
+func New() *Store {
+	return &Store{
+		checkpoints:  map[string][]checkpoint{},
+		methodFaults: map[string]error{},
+	}
+}
+
+// FailExec fails the nth statement executed from now, counting from 1, with
+// err. A nil err fails with ErrInjected. The fault fires once.
+func (s *Store) FailExec(n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		err = ErrInjected
+	}
+	s.execFault, s.execErr = n, err
+}
+
+// FailMethod fails the next call of the named Store method, such as
+// "InsertMetaCheckpoint", with err. A nil err fails with ErrInjected. The
+// fault fires once. Failing "CompleteMigration" simulates a crash after every
+// statement in a file ran and was checkpointed, but before the file was
+// recorded.
+func (s *Store) FailMethod(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		err = ErrInjected
+	}
+	s.methodFaults[name] = err
+}
+
+// fault returns and disarms any fault for the named method. The caller must
+// hold s.mu.
+func (s *Store) fault(name string) error {
+	err := s.methodFaults[name]
+	delete(s.methodFaults, name)
+	return err
+}
+
+// Executed reports every statement executed, in order, including those which
+// failed with an injected fault.
+func (s *Store) Executed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.executed...)
+}
+
+// Timeouts reports the statement and lock timeouts last set.
+func (s *Store) Timeouts() (statement, lock time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timeouts[0], s.timeouts[1]
+}
+
+func (s *Store) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fault("Open")
+}
+
+func (s *Store) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), query, args...)
+}
+
+func (s *Store) ExecContext(
+	ctx context.Context,
+	query string,
+	args ...interface{},
+) (sql.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.aborted {
+		return nil, ErrTxAborted
+	}
+	s.executed = append(s.executed, query)
+	if s.execFault > 0 {
+		s.execFault--
+		if s.execFault == 0 {
+			s.aborted = s.snapshot != nil
+			return nil, s.execErr
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (s *Store) SetTimeouts(statement, lock time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("SetTimeouts"); err != nil {
+		return err
+	}
+	s.timeouts = [2]time.Duration{statement, lock}
+	return nil
+}
+
+// IsLockTimeout reports whether err is ErrLockTimeout.
+func (s *Store) IsLockTimeout(err error) bool {
+	return errors.Is(err, ErrLockTimeout)
+}
+
+func (s *Store) MetaExists() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("MetaExists"); err != nil {
+		return false, err
+	}
+	return s.metaCreated, nil
+}
+
+func (s *Store) CreateMetaVersionIfNotExists() (migrate.MetaVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("CreateMetaVersionIfNotExists"); err != nil {
+		return migrate.MetaVersion{}, err
+	}
+	return s.version, nil
+}
+
+func (s *Store) GetMetaVersion() (migrate.MetaVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("GetMetaVersion"); err != nil {
+		return migrate.MetaVersion{}, err
+	}
+	return s.version, nil
+}
+
+func (s *Store) CreateMetaIfNotExists() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("CreateMetaIfNotExists"); err != nil {
+		return err
+	}
+	s.metaCreated = true
+	return nil
+}
+
+func (s *Store) CreateMetaCheckpointsIfNotExists() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fault("CreateMetaCheckpointsIfNotExists")
+}
+
+func (s *Store) GetMigrations() ([]migrate.Migration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("GetMigrations"); err != nil {
+		return nil, err
+	}
+	return append([]migrate.Migration{}, s.migrations...), nil
+}
+
+func (s *Store) InsertMigration(filename, content, checksum string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("InsertMigration"); err != nil {
+		return err
+	}
+	if s.aborted {
+		return ErrTxAborted
+	}
+	if s.indexOf(filename) >= 0 {
+		return errors.Errorf("duplicate migration %s", filename)
+	}
+	s.migrations = append(s.migrations, migrate.Migration{
+		Filename: filename,
+		Content:  content,
+		Checksum: checksum,
+	})
+	return nil
+}
+
+func (s *Store) UpsertMigration(filename, content, checksum string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("UpsertMigration"); err != nil {
+		return err
+	}
+	if s.aborted {
+		return ErrTxAborted
+	}
+	s.upsert(filename, content, checksum)
+	return nil
+}
+
+func (s *Store) ReplaceMigrations(
+	old []string,
+	filename, content, checksum string,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("ReplaceMigrations"); err != nil {
+		return err
+	}
+	if s.aborted {
+		return ErrTxAborted
+	}
+	for _, name := range old {
+		if i := s.indexOf(name); i >= 0 {
+			s.migrations = append(s.migrations[:i], s.migrations[i+1:]...)
+		}
+	}
+	s.upsert(filename, content, checksum)
+	return nil
+}
+
+func (s *Store) GetMetaCheckpoints(filename string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("GetMetaCheckpoints"); err != nil {
+		return nil, err
+	}
+	checksums := []string{}
+	for _, c := range s.checkpoints[filename] {
+		checksums = append(checksums, c.checksum)
+	}
+	return checksums, nil
+}
+
+func (s *Store) InsertMetaCheckpoint(
+	filename, content, checksum string,
+	idx int,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("InsertMetaCheckpoint"); err != nil {
+		return err
+	}
+	if s.aborted {
+		return ErrTxAborted
+	}
+	cs := s.checkpoints[filename]
+	for _, c := range cs {
+		if c.idx == idx {
+			return errors.Errorf("duplicate checkpoint %d for %s",
+				idx, filename)
+		}
+	}
+	cs = append(cs, checkpoint{idx: idx, checksum: checksum,
+		content: content})
+	sort.Slice(cs, func(i, j int) bool { return cs[i].idx < cs[j].idx })
+	s.checkpoints[filename] = cs
+	return nil
+}
+
+func (s *Store) DeleteMetaCheckpoints(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("DeleteMetaCheckpoints"); err != nil {
+		return err
+	}
+	if s.aborted {
+		return ErrTxAborted
+	}
+	delete(s.checkpoints, filename)
+	return nil
+}
+
+func (s *Store) GetMetaCheckpointFilenames() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("GetMetaCheckpointFilenames"); err != nil {
+		return nil, err
+	}
+	filenames := []string{}
+	for filename := range s.checkpoints {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+func (s *Store) CompleteMigration(filename, content, checksum string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("CompleteMigration"); err != nil {
+		return err
+	}
+	if s.aborted {
+		return ErrTxAborted
+	}
+	delete(s.checkpoints, filename)
+	s.upsert(filename, content, checksum)
+	return nil
+}
+
+// MetaUpgradeSQL returns no statements, since there are no tables to change.
+func (s *Store) MetaUpgradeSQL(
+	version int,
+	migrations []migrate.Migration,
+) ([]migrate.MetaStatement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("MetaUpgradeSQL"); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *Store) UpgradeMeta(
+	v migrate.MetaVersion,
+	stmts []migrate.MetaStatement,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("UpgradeMeta"); err != nil {
+		return err
+	}
+	s.version = v
+	return nil
+}
+
+// SetMetaVersion records v as the version of the meta tables, as if they were
+// created by another release of migrate.
+func (s *Store) SetMetaVersion(v migrate.MetaVersion) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metaCreated = true
+	s.version = v
+}
+
+func (s *Store) BeginMigration() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("BeginMigration"); err != nil {
+		return err
+	}
+	if s.snapshot != nil {
+		return errors.New("migration already begun")
+	}
+	s.snapshot = &snapshot{
+		migrations:  append([]migrate.Migration(nil), s.migrations...),
+		checkpoints: copyCheckpoints(s.checkpoints),
+	}
+	return nil
+}
+
+func (s *Store) CommitMigration() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("CommitMigration"); err != nil {
+		return err
+	}
+	if s.snapshot == nil {
+		return errors.New("commit without begin")
+	}
+	if s.aborted {
+		return ErrTxAborted
+	}
+	s.snapshot = nil
+	return nil
+}
+
+// RollbackMigration restores the meta tables to their state at
+// BeginMigration.
+func (s *Store) RollbackMigration() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("RollbackMigration"); err != nil {
+		return err
+	}
+	if s.snapshot == nil {
+		return errors.New("rollback without begin")
+	}
+	s.migrations = s.snapshot.migrations
+	s.checkpoints = s.snapshot.checkpoints
+	s.snapshot = nil
+	s.aborted = false
+	return nil
+}
+
+// Lock fails, rather than waiting, if the Store is already locked.
+func (s *Store) Lock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("Lock"); err != nil {
+		return err
+	}
+	if s.locked {
+		return errors.New("already locked")
+	}
+	s.locked = true
+	return nil
+}
+
+func (s *Store) Unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.fault("Unlock"); err != nil {
+		return err
+	}
+	if !s.locked {
+		return errors.New("unlock without lock")
+	}
+	s.locked = false
+	return nil
+}
+
+// Locked reports whether the Store is locked.
+func (s *Store) Locked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.locked
+}
+
+// indexOf returns the index of filename's migration, or -1 if it hasn't been
+// recorded. The caller must hold s.mu.
+func (s *Store) indexOf(filename string) int {
+	for i, mg := range s.migrations {
+		if mg.Filename == filename {
+			return i
+		}
+	}
+	return -1
+}
+
+// upsert records a migration, replacing any earlier record of the same file.
+// The caller must hold s.mu.
+func (s *Store) upsert(filename, content, checksum string) {
+	mg := migrate.Migration{
+		Filename: filename,
+		Content:  content,
+		Checksum: checksum,
+	}
+	if i := s.indexOf(filename); i >= 0 {
+		s.migrations[i] = mg
+		return
+	}
+	s.migrations = append(s.migrations, mg)
+}
+
+func copyCheckpoints(m map[string][]checkpoint) map[string][]checkpoint {
+	c := make(map[string][]checkpoint, len(m))
+	for filename, cs := range m {
+		c[filename] = append([]checkpoint(nil), cs...)
+	}
+	return c
+}
@@ -0,0 +1,64 @@
+package migratetest
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestLock(t *testing.T) {
+	db := New()
+	if err := db.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if !db.Locked() {
+		t.Fatal("expected the store to be locked")
+	}
+	if err := db.Lock(); err == nil {
+		t.Fatal("expected a second lock to fail")
+	}
+	if err := db.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Unlock(); err == nil {
+		t.Fatal("expected unlock without lock to fail")
+	}
+}
+
+func TestAbortedTransaction(t *testing.T) {
+	db := New()
+	if err := db.BeginMigration(); err != nil {
+		t.Fatal(err)
+	}
+	db.FailExec(1, nil)
+	if _, err := db.Exec(`CREATE TABLE a (id INT)`); err != ErrInjected {
+		t.Fatalf("expected the injected fault, got %v", err)
+	}
+
+	// Like Postgres, everything fails until the transaction rolls back
+	if _, err := db.Exec(`SELECT 1`); !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("expected an aborted transaction, got %v", err)
+	}
+	err := db.CompleteMigration("1.sql", "SELECT 1;", "md5")
+	if !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("expected an aborted transaction, got %v", err)
+	}
+	if err = db.CommitMigration(); !errors.Is(err, ErrTxAborted) {
+		t.Fatalf("expected an aborted transaction, got %v", err)
+	}
+	if err = db.RollbackMigration(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`SELECT 1`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outside of a transaction, a failure affects only its statement
+	db.FailExec(1, nil)
+	if _, err = db.Exec(`SELECT 1`); err != ErrInjected {
+		t.Fatalf("expected the injected fault, got %v", err)
+	}
+	if _, err = db.Exec(`SELECT 1`); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,486 @@
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/egtann/migrate"
+	"github.com/jmoiron/sqlx"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/pkg/errors"
+)
+
+// regexBatchSeparator matches the GO lines which divide a migration into
+// batches, as in sqlcmd and SQL Server Management Studio.
+var regexBatchSeparator = regexp.MustCompile(`(?i)^\s*GO\s*(--.*)?$`)
+
+type DB struct {
+	connURL string
+
+	// inTx is set between BeginMigration and CommitMigration or
+	// RollbackMigration.
+	inTx bool
+
+	// conn is the connection every statement runs on. The driver resets
+	// a session whenever its connection returns to the pool, which would
+	// undo timeouts and end transactions and applocks, so we hold one
+	// connection from Open until Close.
+	conn *sql.Conn
+
+	// Embed the sqlx DB struct
+	*sqlx.DB
+}
+
+func New(user, pass, host, dbName string, port int) *DB {
+	q := url.Values{}
+	q.Set("database", dbName)
+	u := &url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(user, pass),
+		Host:     net.JoinHostPort(host, strconv.Itoa(port)),
+		RawQuery: q.Encode(),
+	}
+	return &DB{connURL: u.String()}
+}
+
+func (db *DB) MetaExists() (bool, error) {
+	var n int
+	q := `SELECT CASE WHEN OBJECT_ID(N'meta', N'U') IS NULL THEN 0 ELSE 1 END`
+	if err := db.Get(&n, q); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db *DB) CreateMetaVersionIfNotExists() (migrate.MetaVersion, error) {
+	q := `
+		IF OBJECT_ID(N'metaversion', N'U') IS NULL
+		CREATE TABLE [metaversion] (
+			[version] INT NOT NULL,
+			[migraterelease] NVARCHAR(255) NOT NULL
+		)`
+	if _, err := db.Exec(q); err != nil {
+		return migrate.MetaVersion{}, errors.Wrap(err,
+			"create metaversion table")
+	}
+	return db.GetMetaVersion()
+}
+
+// GetMetaVersion reports the version of the meta tables without changing
+// them. It's zero if there's no metaversion table.
+func (db *DB) GetMetaVersion() (migrate.MetaVersion, error) {
+	var v migrate.MetaVersion
+	var n int
+	q := `SELECT CASE WHEN OBJECT_ID(N'metaversion', N'U') IS NULL THEN 0 ELSE 1 END`
+	if err := db.Get(&n, q); err != nil {
+		return v, errors.Wrap(err, "metaversion exists")
+	}
+	if n == 0 {
+		return v, nil
+	}
+
+	q = `SELECT [version], [migraterelease] FROM [metaversion]`
+	err := db.Get(&v, q)
+	switch {
+	case err == sql.ErrNoRows:
+		return v, nil
+	case err != nil:
+		return v, errors.Wrap(err, "get version")
+	}
+	return v, nil
+}
+
+func (db *DB) CreateMetaIfNotExists() error {
+	q := `
+		IF OBJECT_ID(N'meta', N'U') IS NULL
+		CREATE TABLE [meta] (
+			[filename] NVARCHAR(255) UNIQUE NOT NULL,
+			[md5] NVARCHAR(255) NOT NULL,
+			[content] NVARCHAR(MAX) NOT NULL,
+			[createdat] DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME()
+		)`
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create meta table")
+	}
+	return nil
+}
+
+func (db *DB) CreateMetaCheckpointsIfNotExists() error {
+	q := `
+		IF OBJECT_ID(N'metacheckpoints', N'U') IS NULL
+		CREATE TABLE [metacheckpoints] (
+			[filename] NVARCHAR(255) NOT NULL,
+			[idx] INT NOT NULL,
+			[md5] NVARCHAR(255) NOT NULL,
+			[content] NVARCHAR(MAX) NOT NULL,
+			[createdat] DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+			PRIMARY KEY ([filename], [idx])
+		)`
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "create metacheckpoints table")
+	}
+	return nil
+}
+
+func (db *DB) GetMigrations() ([]migrate.Migration, error) {
+	migrations := []migrate.Migration{}
+	q := `SELECT [filename], [content], [md5] AS [checksum] FROM [meta]`
+	err := db.Select(&migrations, q)
+	return migrations, err
+}
+
+func (db *DB) GetMetaCheckpoints(filename string) ([]string, error) {
+	checkpoints := []string{}
+	q := `
+		SELECT [md5] FROM [metacheckpoints] WHERE [filename]=@p1
+		ORDER BY [idx]`
+	err := db.Select(&checkpoints, q, filename)
+	return checkpoints, err
+}
+
+// upsertMigration records a migration in meta, replacing any earlier record
+// of the same file. HOLDLOCK prevents a concurrent MERGE from inserting the
+// same file between the match and the insert.
+const upsertMigration = `
+	MERGE [meta] WITH (HOLDLOCK) AS [t]
+	USING (SELECT @p1 AS [filename], @p2 AS [content], @p3 AS [md5]) AS [s]
+	ON [t].[filename] = [s].[filename]
+	WHEN MATCHED THEN
+		UPDATE SET [content] = [s].[content], [md5] = [s].[md5]
+	WHEN NOT MATCHED THEN
+		INSERT ([filename], [content], [md5])
+		VALUES ([s].[filename], [s].[content], [s].[md5]);`
+
+func (db *DB) UpsertMigration(filename, content, checksum string) error {
+	_, err := db.Exec(upsertMigration, filename, content, checksum)
+	return err
+}
+
+func (db *DB) ReplaceMigrations(
+	old []string,
+	filename, content, checksum string,
+) (err error) {
+	tx, err := db.begin()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := `DELETE FROM [meta] WHERE [filename]=@p1`
+	for _, name := range old {
+		if _, err = tx.Exec(q, name); err != nil {
+			err = errors.Wrapf(err, "delete %s", name)
+			return
+		}
+	}
+	q = `INSERT INTO [meta] ([filename], [content], [md5]) VALUES (@p1, @p2, @p3)`
+	if _, err = tx.Exec(q, filename, content, checksum); err != nil {
+		err = errors.Wrap(err, "insert migration")
+		return
+	}
+	return nil
+}
+
+func (db *DB) InsertMetaCheckpoint(
+	filename, content, checksum string,
+	idx int,
+) error {
+	q := `
+		INSERT INTO [metacheckpoints] ([filename], [content], [idx], [md5])
+		VALUES (@p1, @p2, @p3, @p4)`
+	_, err := db.Exec(q, filename, content, idx, checksum)
+	return err
+}
+
+func (db *DB) InsertMigration(filename, content, checksum string) error {
+	q := `INSERT INTO [meta] ([filename], [content], [md5]) VALUES (@p1, @p2, @p3)`
+	_, err := db.Exec(q, filename, content, checksum)
+	return err
+}
+
+func (db *DB) DeleteMetaCheckpoints(filename string) error {
+	q := `DELETE FROM [metacheckpoints] WHERE [filename]=@p1`
+	_, err := db.Exec(q, filename)
+	return err
+}
+
+func (db *DB) GetMetaCheckpointFilenames() ([]string, error) {
+	filenames := []string{}
+	q := `SELECT DISTINCT [filename] FROM [metacheckpoints]`
+	err := db.Select(&filenames, q)
+	return filenames, err
+}
+
+// CompleteMigration deletes a file's checkpoints and records it in meta in a
+// single transaction, or within the current one after BeginMigration.
+func (db *DB) CompleteMigration(
+	filename, content, checksum string,
+) (err error) {
+	var ex sqlx.Execer = db
+	if !db.inTx {
+		var tx *sql.Tx
+		tx, err = db.begin()
+		if err != nil {
+			return errors.Wrap(err, "begin tx")
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+		ex = tx
+	}
+
+	q := `DELETE FROM [metacheckpoints] WHERE [filename]=@p1`
+	if _, err = ex.Exec(q, filename); err != nil {
+		return errors.Wrap(err, "delete checkpoints")
+	}
+	_, err = ex.Exec(upsertMigration, filename, content, checksum)
+	if err != nil {
+		return errors.Wrap(err, "upsert migration")
+	}
+	return nil
+}
+
+// MetaUpgradeSQL returns the statements which upgrade the meta tables to
+// version. SQL Server support began at version 2, so its meta tables are
+// always created at the current version and there are no upgrades yet.
+func (db *DB) MetaUpgradeSQL(
+	version int,
+	migrations []migrate.Migration,
+) ([]migrate.MetaStatement, error) {
+	return nil, fmt.Errorf("unknown meta version %d", version)
+}
+
+// UpgradeMeta runs stmts in a single transaction and records v as the meta
+// version.
+func (db *DB) UpgradeMeta(
+	v migrate.MetaVersion,
+	stmts []migrate.MetaStatement,
+) (err error) {
+	tx, err := db.begin()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt.SQL, stmt.Args...); err != nil {
+			return errors.Wrapf(err, "exec %q", stmt.SQL)
+		}
+	}
+	q := `DELETE FROM [metaversion]`
+	if _, err = tx.Exec(q); err != nil {
+		return errors.Wrap(err, "delete metaversion")
+	}
+	q = `INSERT INTO [metaversion] ([version], [migraterelease]) VALUES (@p1, @p2)`
+	if _, err = tx.Exec(q, v.Version, v.Release); err != nil {
+		return errors.Wrap(err, "insert metaversion")
+	}
+	return nil
+}
+
+// IsBatchSeparator reports whether line is GO, which ends a batch. Each batch
+// runs as a single statement, as statements like CREATE PROCEDURE must be
+// alone in theirs. GO with a repeat count isn't supported.
+func (db *DB) IsBatchSeparator(line string) bool {
+	return regexBatchSeparator.MatchString(line)
+}
+
+// Lock takes an application lock on migrations in the current database,
+// waiting until it's available. The lock is owned by our session, so it's
+// held across transactions until Unlock or the connection closes.
+func (db *DB) Lock() error {
+	var result int
+	q := `
+		DECLARE @resource NVARCHAR(255) = LEFT(N'migrate:' + DB_NAME(), 255);
+		DECLARE @result INT;
+		EXEC @result = sp_getapplock @Resource = @resource,
+			@LockMode = 'Exclusive', @LockOwner = 'Session',
+			@LockTimeout = -1;
+		SELECT @result;`
+	if err := db.Get(&result, q); err != nil {
+		return err
+	}
+
+	// 0 and 1 report the lock was granted, immediately or after waiting
+	if result < 0 {
+		return fmt.Errorf("failed to get lock: sp_getapplock returned %d",
+			result)
+	}
+	return nil
+}
+
+func (db *DB) Unlock() error {
+	q := `
+		DECLARE @resource NVARCHAR(255) = LEFT(N'migrate:' + DB_NAME(), 255);
+		EXEC sp_releaseapplock @Resource = @resource, @LockOwner = 'Session';`
+	_, err := db.Exec(q)
+	return err
+}
+
+func (db *DB) Open() error {
+	sqlDB, err := sqlx.Open("sqlserver", db.connURL)
+	if err != nil {
+		return errors.Wrap(err, "open db connection")
+	}
+	return db.open(sqlDB)
+}
+
+// open pins the single connection which every statement uses, so settings
+// like timeouts apply to each.
+func (db *DB) open(sqlDB *sqlx.DB) error {
+	sqlDB.SetMaxOpenConns(1)
+	conn, err := sqlDB.Conn(context.Background())
+	if err != nil {
+		_ = sqlDB.Close()
+		return errors.Wrap(err, "connect")
+	}
+	db.DB, db.conn = sqlDB, conn
+	return nil
+}
+
+// Close releases the pinned connection and closes the database.
+func (db *DB) Close() error {
+	if err := db.conn.Close(); err != nil {
+		_ = db.DB.Close()
+		return errors.Wrap(err, "close conn")
+	}
+	return db.DB.Close()
+}
+
+func (db *DB) Exec(q string, args ...interface{}) (sql.Result, error) {
+	return db.conn.ExecContext(context.Background(), q, args...)
+}
+
+func (db *DB) ExecContext(
+	ctx context.Context,
+	q string,
+	args ...interface{},
+) (sql.Result, error) {
+	return db.conn.ExecContext(ctx, q, args...)
+}
+
+// Get scans the first row into dest, or returns sql.ErrNoRows.
+func (db *DB) Get(dest interface{}, q string, args ...interface{}) error {
+	rows, err := db.query(q, args)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err = scanRow(rows, dest); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// Select scans every row into dest, a pointer to a slice.
+func (db *DB) Select(dest interface{}, q string, args ...interface{}) error {
+	rows, err := db.query(q, args)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	slice := reflect.ValueOf(dest).Elem()
+	for rows.Next() {
+		v := reflect.New(slice.Type().Elem())
+		if err = scanRow(rows, v.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, v.Elem()))
+	}
+	return rows.Err()
+}
+
+// query runs q on the pinned connection, returning rows which scan into
+// structs by their db tags.
+func (db *DB) query(q string, args []interface{}) (*sqlx.Rows, error) {
+	rows, err := db.conn.QueryContext(context.Background(), q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlx.Rows{Rows: rows, Mapper: db.Mapper}, nil
+}
+
+// scanRow scans the current row into dest, by column name if it's a struct.
+func scanRow(rows *sqlx.Rows, dest interface{}) error {
+	if reflect.TypeOf(dest).Elem().Kind() == reflect.Struct {
+		return rows.StructScan(dest)
+	}
+	return rows.Scan(dest)
+}
+
+// begin starts a transaction on the pinned connection.
+func (db *DB) begin() (*sql.Tx, error) {
+	return db.conn.BeginTx(context.Background(), nil)
+}
+
+// SetTimeouts sets how long statements wait for locks. SQL Server has no
+// session setting to limit the execution time of statements, so the
+// statement timeout is enforced only by migrate canceling the statement.
+func (db *DB) SetTimeouts(statement, lock time.Duration) error {
+	// -1 restores SQL Server's default of waiting forever
+	ms := int64(-1)
+	if lock > 0 {
+		ms = int64((lock + time.Millisecond - 1) / time.Millisecond)
+	}
+	q := fmt.Sprintf(`SET LOCK_TIMEOUT %d`, ms)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set lock_timeout")
+	}
+	return nil
+}
+
+// BeginMigration starts a transaction on the pinned connection.
+func (db *DB) BeginMigration() error {
+	_, err := db.Exec(`BEGIN TRANSACTION`)
+	db.inTx = err == nil
+	return err
+}
+
+func (db *DB) CommitMigration() error {
+	_, err := db.Exec(`COMMIT TRANSACTION`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) RollbackMigration() error {
+	_, err := db.Exec(`ROLLBACK TRANSACTION`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) IsLockTimeout(err error) bool {
+	var mssqlErr mssql.Error
+	if !errors.As(err, &mssqlErr) {
+		return false
+	}
+	return mssqlErr.Number == 1222 // Lock request time out period exceeded
+}
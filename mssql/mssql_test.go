@@ -0,0 +1,270 @@
+package mssql
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/egtann/migrate"
+	"github.com/egtann/migrate/internal/fakesql"
+	"github.com/jmoiron/sqlx"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/pkg/errors"
+)
+
+func TestCreateMetaIfNotExists(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	check(t, db.CreateMetaIfNotExists())
+	check(t, db.CreateMetaCheckpointsIfNotExists())
+	for _, q := range srv.Log() {
+		if !strings.Contains(q.SQL, "DATETIME2") {
+			t.Fatalf("expected DATETIME2 timestamps, got %s", q.SQL)
+		}
+	}
+	q := srv.Log()[0].SQL
+	if !strings.Contains(q, "OBJECT_ID(N'meta', N'U')") ||
+		!strings.Contains(q, "CREATE TABLE [meta]") {
+		t.Fatalf("expected a conditional create of [meta], got %s", q)
+	}
+}
+
+func TestGetMigrations(t *testing.T) {
+	db, _ := newDB(t, func(q string, args []driver.Value) (*fakesql.Rows, error) {
+		return &fakesql.Rows{
+			Cols: []string{"filename", "content", "checksum"},
+			Data: [][]driver.Value{{"1.sql", "SELECT 1;", "md5"}},
+		}, nil
+	})
+	defer db.Close()
+
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "1.sql" || ms[0].Checksum != "md5" {
+		t.Fatalf("expected 1.sql, got %+v", ms)
+	}
+}
+
+func TestUpsertMigration(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	err := db.UpsertMigration("1.sql", "SELECT 1;", "md5")
+	check(t, err)
+
+	qs := srv.Log()
+	if len(qs) != 1 || !strings.HasPrefix(strings.TrimSpace(qs[0].SQL),
+		"MERGE [meta]") {
+		t.Fatalf("expected a MERGE, got %+v", qs)
+	}
+	if len(qs[0].Args) != 3 || qs[0].Args[0] != "1.sql" {
+		t.Fatalf("expected filename, content and md5, got %v",
+			qs[0].Args)
+	}
+}
+
+func TestCompleteMigration(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	err := db.CompleteMigration("2.sql", "SELECT 2;", "md5")
+	check(t, err)
+	got := srv.Summary()
+	want := "begin,DELETE FROM [metacheckpoints],MERGE [meta],commit"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+
+	// Within a migration's transaction, it doesn't start its own
+	srv.Reset()
+	check(t, db.BeginMigration())
+	check(t, db.CompleteMigration("2.sql", "SELECT 2;", "md5"))
+	check(t, db.CommitMigration())
+	got = srv.Summary()
+	want = "BEGIN TRANSACTION,DELETE FROM [metacheckpoints],MERGE [meta],COMMIT TRANSACTION"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestLock(t *testing.T) {
+	result := int64(0)
+	db, srv := newDB(t, func(q string, args []driver.Value) (*fakesql.Rows, error) {
+		return &fakesql.Rows{
+			Cols: []string{""},
+			Data: [][]driver.Value{{result}},
+		}, nil
+	})
+	defer db.Close()
+
+	check(t, db.Lock())
+	if q := srv.Log()[0].SQL; !strings.Contains(q, "sp_getapplock") ||
+		!strings.Contains(q, "@LockOwner = 'Session'") {
+		t.Fatalf("expected a session applock, got %s", q)
+	}
+	check(t, db.Unlock())
+
+	// sp_getapplock reports failures, such as deadlocks, with negative
+	// results
+	result = -3
+	if err := db.Lock(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestMigrateLocks(t *testing.T) {
+	fsys := fstest.MapFS{"1.sql": {
+		Data: []byte(`CREATE TABLE [users] ([id] INT PRIMARY KEY);`),
+	}}
+
+	db, srv := newDB(t, func(q string, args []driver.Value) (*fakesql.Rows, error) {
+		if strings.Contains(q, "sp_getapplock") ||
+			(strings.Contains(q, "OBJECT_ID(N'meta") &&
+				strings.HasPrefix(q, "SELECT")) {
+			return &fakesql.Rows{
+				Cols: []string{""},
+				Data: [][]driver.Value{{int64(0)}},
+			}, nil
+		}
+		return &fakesql.Rows{}, nil
+	})
+	defer db.Close()
+
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	// The applock is held from before the meta tables are read until
+	// after the file is recorded
+	qs := srv.Log()
+	if !strings.Contains(qs[0].SQL, "sp_getapplock") {
+		t.Fatalf("expected to lock first, got %s", qs[0].SQL)
+	}
+	var migrated bool
+	for _, q := range qs[1 : len(qs)-1] {
+		if strings.Contains(q.SQL, "applock") {
+			t.Fatalf("expected a single lock, got %s", q.SQL)
+		}
+		if strings.HasPrefix(q.SQL, "CREATE TABLE [users]") {
+			migrated = true
+		}
+	}
+	if !migrated {
+		t.Fatal("expected 1.sql to run while locked")
+	}
+	if last := qs[len(qs)-1].SQL; !strings.Contains(last, "sp_releaseapplock") {
+		t.Fatalf("expected to unlock last, got %s", last)
+	}
+}
+
+func TestSession(t *testing.T) {
+	db, srv := newDB(t, func(q string, args []driver.Value) (*fakesql.Rows, error) {
+		return &fakesql.Rows{
+			Cols: []string{""},
+			Data: [][]driver.Value{{int64(0)}},
+		}, nil
+	})
+	defer db.Close()
+
+	// go-mssqldb resets the session of a connection reused from the pool,
+	// which would undo each of these, so they must share one connection
+	check(t, db.Lock())
+	check(t, db.SetTimeouts(0, time.Second))
+	check(t, db.BeginMigration())
+	_, err := db.Exec(`CREATE TABLE [users] ([id] INT)`)
+	check(t, err)
+	check(t, db.CompleteMigration("1.sql", "SELECT 1;", "md5"))
+	check(t, db.CommitMigration())
+	check(t, db.ReplaceMigrations([]string{"1.sql"}, "2.sql", "SELECT 2;", "md5"))
+	check(t, db.Unlock())
+	if n := srv.Resets(); n != 0 {
+		t.Fatalf("expected no session resets, got %d", n)
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	db, srv := newDB(t, nil)
+	defer db.Close()
+
+	check(t, db.SetTimeouts(0, 1500*time.Millisecond))
+	check(t, db.SetTimeouts(0, 0))
+	got := srv.Summary()
+	if got != "SET LOCK_TIMEOUT 1500,SET LOCK_TIMEOUT -1" {
+		t.Fatalf("unexpected timeouts: %s", got)
+	}
+}
+
+func TestIsLockTimeout(t *testing.T) {
+	db := New("sa", "", "127.0.0.1", "migrate_test", 1433)
+	err := errors.Wrap(mssql.Error{Number: 1222}, "exec")
+	if !db.IsLockTimeout(err) {
+		t.Fatal("expected a lock timeout")
+	}
+	if db.IsLockTimeout(mssql.Error{Number: 1205}) {
+		t.Fatal("expected a deadlock not to be a lock timeout")
+	}
+}
+
+func TestBatches(t *testing.T) {
+	fsys := fstest.MapFS{"1.sql": {Data: []byte(`-- Users and their lookup
+CREATE TABLE [users] ([id] INT PRIMARY KEY, [email] NVARCHAR(255));
+CREATE INDEX [users_email_idx] ON [users] ([email]);
+GO
+
+CREATE PROCEDURE [user_by_email] @email NVARCHAR(255) AS
+	SELECT [id] FROM [users] WHERE [email] = @email;
+go
+-- Nothing else
+GO
+`)}}
+
+	db, _ := newDB(t, func(q string, args []driver.Value) (*fakesql.Rows, error) {
+		if strings.Contains(q, "OBJECT_ID(N'meta") &&
+			strings.HasPrefix(q, "SELECT") {
+			return &fakesql.Rows{
+				Cols: []string{""},
+				Data: [][]driver.Value{{int64(0)}},
+			}, nil
+		}
+		return &fakesql.Rows{}, nil
+	})
+	defer db.Close()
+
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+	check(t, m.Init())
+	plan, err := m.Plan()
+	check(t, err)
+	stmts := plan.Steps[0].Statements
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 batches, got %+v", stmts)
+	}
+	if stmts[0].Line != 1 || !strings.Contains(stmts[0].SQL,
+		"CREATE INDEX") {
+		t.Fatalf("expected the table and index together, got %+v",
+			stmts[0])
+	}
+	if stmts[1].Line != 6 || !strings.HasPrefix(stmts[1].SQL,
+		"CREATE PROCEDURE") {
+		t.Fatalf("expected the procedure on line 6, got %+v", stmts[1])
+	}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newDB connects to a fake driver, so the tests run without a server.
+func newDB(t *testing.T, respond fakesql.Responder) (*DB, *fakesql.Server) {
+	sqlDB, srv := fakesql.Open(respond)
+	db := &DB{}
+	check(t, db.open(sqlx.NewDb(sqlDB, "sqlserver")))
+	return db, srv
+}
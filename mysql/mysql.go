@@ -1,12 +1,16 @@
 package mysql
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/egtann/migrate"
 	"github.com/go-sql-driver/mysql"
@@ -14,52 +18,112 @@ import (
 	"github.com/pkg/errors"
 )
 
+var regexAutoIncrement = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
 type DB struct {
 	connURL   string
-	tlsConfig *tlsConfig
+	tlsConfig *tls.Config
+
+	// inTx is set between BeginMigration and CommitMigration or
+	// RollbackMigration.
+	inTx bool
 
 	// Embed the sqlx DB struct
 	*sqlx.DB
 }
 
+// New connects with the given settings. sslMode is one of disable, prefer,
+// require, verify-ca or verify-full, as in libpq. When it's empty, it's
+// verify-full if any ssl file is given and disable otherwise. The client key
+// and cert are optional, so a CA alone verifies the server.
 func New(
 	user, pass, host, dbName string,
 	port int,
-	sslKey, sslCert, sslCA, sslServerName string,
+	sslMode, sslKey, sslCert, sslCA, sslServerName string,
 ) (*DB, error) {
 	db := &DB{}
 	db.connURL = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", user,
 		pass, host, port, dbName)
-	if sslKey != "" {
-		db.connURL = fmt.Sprintf("%s&tls=%s", db.connURL, sslServerName)
+	if sslMode == "" {
+		sslMode = "disable"
+		if sslKey != "" || sslCert != "" || sslCA != "" {
+			sslMode = "verify-full"
+		}
+	}
+	switch sslMode {
+	case "disable":
+		if sslKey != "" || sslCert != "" || sslCA != "" {
+			return nil, errors.New("ssl files given with sslmode disable")
+		}
+	case "prefer":
+		// The driver falls back to plaintext only with its own config,
+		// which can't verify the server or present a client cert
+		if sslKey != "" || sslCert != "" || sslCA != "" {
+			return nil, errors.New("ssl files given with sslmode prefer")
+		}
+		db.connURL += "&tls=preferred"
+	case "require", "verify-ca", "verify-full":
 		var err error
-		db.tlsConfig, err = newTLSConfig(dbName, sslKey,
-			sslCert, sslCA, sslServerName)
+		db.tlsConfig, err = newTLSConfig(sslMode, sslKey, sslCert,
+			sslCA, sslServerName)
 		if err != nil {
 			return nil, errors.Wrap(err, "new tls config")
 		}
+		db.connURL += "&tls=" + tlsConfigName
+	default:
+		return nil, fmt.Errorf("unknown sslmode %q", sslMode)
 	}
 	return db, nil
 }
 
-func (db *DB) CreateMetaVersionIfNotExists() (int, error) {
+func (db *DB) MetaExists() (bool, error) {
+	var n int
+	q := `
+		SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = 'meta'`
+	if err := db.Get(&n, q); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db *DB) CreateMetaVersionIfNotExists() (migrate.MetaVersion, error) {
 	q := `CREATE TABLE IF NOT EXISTS metaversion (
-		version INTEGER NOT NULL
+		version INTEGER NOT NULL,
+		migraterelease VARCHAR(255) NOT NULL
 	)`
 	if _, err := db.Exec(q); err != nil {
-		return 0, errors.Wrap(err, "create metaversion table")
+		return migrate.MetaVersion{}, errors.Wrap(err,
+			"create metaversion table")
+	}
+	return db.GetMetaVersion()
+}
+
+// GetMetaVersion reports the version of the meta tables without changing
+// them. It's zero if there's no metaversion table.
+func (db *DB) GetMetaVersion() (migrate.MetaVersion, error) {
+	var v migrate.MetaVersion
+	var n int
+	q := `
+		SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = 'metaversion'`
+	if err := db.Get(&n, q); err != nil {
+		return v, errors.Wrap(err, "metaversion exists")
+	}
+	if n == 0 {
+		return v, nil
 	}
 
-	var version int
-	q = `SELECT version FROM metaversion`
-	err := db.Get(&version, q)
+	// Tables from before v2 have no release column
+	q = `SELECT * FROM metaversion`
+	err := db.Get(&v, q)
 	switch {
 	case err == sql.ErrNoRows:
-		return 0, nil
+		return v, nil
 	case err != nil:
-		return 0, errors.Wrap(err, "get version")
+		return v, errors.Wrap(err, "get version")
 	}
-	return version, nil
+	return v, nil
 }
 
 func (db *DB) CreateMetaIfNotExists() error {
@@ -116,6 +180,37 @@ func (db *DB) UpsertMigration(filename, content, checksum string) error {
 	return err
 }
 
+func (db *DB) ReplaceMigrations(
+	old []string,
+	filename, content, checksum string,
+) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := `DELETE FROM meta WHERE filename=?`
+	for _, name := range old {
+		if _, err = tx.Exec(q, name); err != nil {
+			err = errors.Wrapf(err, "delete %s", name)
+			return
+		}
+	}
+	q = `INSERT INTO meta (filename, content, md5) VALUES (?, ?, ?)`
+	if _, err = tx.Exec(q, filename, content, checksum); err != nil {
+		err = errors.Wrap(err, "insert migration")
+		return
+	}
+	return nil
+}
+
 func (db *DB) InsertMetaCheckpoint(
 	filename, content, checksum string,
 	idx int,
@@ -133,17 +228,122 @@ func (db *DB) InsertMigration(filename, content, checksum string) error {
 	return err
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
+func (db *DB) DeleteMetaCheckpoints(filename string) error {
+	q := `DELETE FROM metacheckpoints WHERE filename=?`
+	_, err := db.Exec(q, filename)
 	return err
 }
 
-// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
-// migrations before running this function; this will not succeed if have any
-// existing metacheckpoints.
-func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
-	// Begin Tx
+func (db *DB) GetMetaCheckpointFilenames() ([]string, error) {
+	filenames := []string{}
+	q := `SELECT DISTINCT filename FROM metacheckpoints`
+	err := db.Select(&filenames, q)
+	return filenames, err
+}
+
+// CompleteMigration deletes a file's checkpoints and records it in meta in a
+// single transaction, or within the current one after BeginMigration.
+func (db *DB) CompleteMigration(
+	filename, content, checksum string,
+) (err error) {
+	var ex sqlx.Execer = db.DB
+	if !db.inTx {
+		var tx *sqlx.Tx
+		tx, err = db.Beginx()
+		if err != nil {
+			return errors.Wrap(err, "begin tx")
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+		ex = tx
+	}
+
+	q := `DELETE FROM metacheckpoints WHERE filename=?`
+	if _, err = ex.Exec(q, filename); err != nil {
+		return errors.Wrap(err, "delete checkpoints")
+	}
+	q = `
+		INSERT INTO meta (filename, content, md5) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE md5=?, content=?`
+	_, err = ex.Exec(q, filename, content, checksum, checksum, content)
+	if err != nil {
+		return errors.Wrap(err, "upsert migration")
+	}
+	return nil
+}
+
+// MetaUpgradeSQL returns the statements which upgrade the meta tables to
+// version. MySQL commits implicitly after each change to a table, so the
+// upgrade to version 2 builds a new table and swaps it in with a single
+// RENAME TABLE, which is atomic.
+func (db *DB) MetaUpgradeSQL(
+	version int,
+	migrations []migrate.Migration,
+) ([]migrate.MetaStatement, error) {
+	var stmts []migrate.MetaStatement
+	add := func(q string, args ...interface{}) {
+		stmts = append(stmts, migrate.MetaStatement{SQL: q, Args: args})
+	}
+	switch version {
+	case 1:
+		// Remove the uniqueness constraint from md5
+		add(`ALTER TABLE meta DROP INDEX md5`)
+
+		// Add a content column to record the exact migration that ran
+		// alongside the md5, insert the appropriate data, then set not
+		// null
+		add(`ALTER TABLE meta ADD COLUMN content TEXT`)
+		for _, m := range migrations {
+			add(`UPDATE meta SET content=? WHERE filename=?`,
+				m.Content, m.Filename)
+		}
+		add(`ALTER TABLE meta MODIFY COLUMN content TEXT NOT NULL`)
+
+		// Add the content column to metacheckpoints, which must be
+		// empty. MySQL can't add a column only if it doesn't exist, so
+		// the table is recreated.
+		add(`DROP TABLE metacheckpoints`)
+		add(`CREATE TABLE metacheckpoints (
+			filename VARCHAR(255) NOT NULL,
+			idx INTEGER NOT NULL,
+			md5 VARCHAR(255) NOT NULL,
+			content TEXT NOT NULL,
+			createdat DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+			PRIMARY KEY (filename, idx)
+		)`)
+	case 2:
+		// Add the release column. The old version is copied, so if the
+		// upgrade fails after the swap, it's retried. Tables left by
+		// an earlier failure are dropped first.
+		add(`DROP TABLE IF EXISTS metaversion_new, metaversion_old`)
+		add(`CREATE TABLE metaversion_new (
+			version INTEGER NOT NULL,
+			migraterelease VARCHAR(255) NOT NULL
+		)`)
+		add(`INSERT INTO metaversion_new (version, migraterelease)
+			SELECT version, '' FROM metaversion`)
+		add(`RENAME TABLE metaversion TO metaversion_old,
+			metaversion_new TO metaversion`)
+		add(`DROP TABLE metaversion_old`)
+	default:
+		return nil, fmt.Errorf("unknown meta version %d", version)
+	}
+	return stmts, nil
+}
+
+// UpgradeMeta runs stmts in a single transaction and records v as the meta
+// version. MySQL commits the transaction implicitly before and after any
+// change to a table, so only the data changes roll back. If an upgrade to
+// version 1 fails part way through, the meta tables must be repaired by hand.
+func (db *DB) UpgradeMeta(
+	v migrate.MetaVersion,
+	stmts []migrate.MetaStatement,
+) (err error) {
 	tx, err := db.Beginx()
 	if err != nil {
 		return errors.Wrap(err, "begin tx")
@@ -156,69 +356,318 @@ func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
 		err = tx.Commit()
 	}()
 
-	// Remove the uniqueness constraint from md5
-	q := `ALTER TABLE meta DROP INDEX md5`
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt.SQL, stmt.Args...); err != nil {
+			return errors.Wrapf(err, "exec %q", stmt.SQL)
+		}
+	}
+	q := `DELETE FROM metaversion`
 	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "remove md5 unique")
-		return
+		return errors.Wrap(err, "delete metaversion")
+	}
+	q = `INSERT INTO metaversion (version, migraterelease) VALUES (?, ?)`
+	if _, err = tx.Exec(q, v.Version, v.Release); err != nil {
+		return errors.Wrap(err, "insert metaversion")
 	}
+	return nil
+}
 
-	// Add a content column to record the exact migration that ran
-	// alongside the md5, insert the appropriate data, then set not null
-	q = `ALTER TABLE meta ADD COLUMN content TEXT`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "add content column")
-		return
+// Schema describes the tables in the connected database. CHECK constraints
+// are not included.
+func (db *DB) Schema() (*migrate.Schema, error) {
+	tables := []string{}
+	q := `
+		SELECT table_name AS name
+		FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'`
+	if err := db.Select(&tables, q); err != nil {
+		return nil, errors.Wrap(err, "select tables")
 	}
-	for _, m := range migrations {
-		q = `UPDATE meta SET content=? WHERE filename=?`
-		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
-			err = errors.Wrap(err, "update meta content")
-			return
+	schema := migrate.NewSchema()
+	for _, name := range tables {
+		if !migrate.IsMetaTable(name) {
+			schema.Table(name)
 		}
 	}
-	q = `ALTER TABLE meta MODIFY COLUMN content TEXT NOT NULL`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "update meta content not null")
-		return
+
+	cols := []struct {
+		Table    string         `db:"tablename"`
+		Name     string         `db:"name"`
+		Type     string         `db:"type"`
+		Nullable bool           `db:"nullable"`
+		Default  sql.NullString `db:"dflt"`
+	}{}
+	q = `
+		SELECT table_name AS tablename, column_name AS name,
+			column_type AS type, is_nullable = 'YES' AS nullable,
+			column_default AS dflt
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE()
+		ORDER BY table_name, ordinal_position`
+	if err := db.Select(&cols, q); err != nil {
+		return nil, errors.Wrap(err, "select columns")
+	}
+	for _, c := range cols {
+		t, ok := schema.Tables[c.Table]
+		if !ok {
+			continue
+		}
+		t.Columns = append(t.Columns, migrate.Column{
+			Name:     c.Name,
+			Type:     c.Type,
+			Nullable: c.Nullable,
+			Default:  c.Default.String,
+		})
 	}
 
-	// Add the content column to metacheckpoints
+	idxs := []struct {
+		Table   string `db:"tablename"`
+		Name    string `db:"name"`
+		Unique  bool   `db:"isunique"`
+		Columns string `db:"columns"`
+	}{}
 	q = `
-	ALTER TABLE metacheckpoints
-	ADD COLUMN content TEXT NOT NULL`
-	_, err = tx.Exec(q)
-	if err != nil {
-		// Ignore duplicate column errors
-		if !strings.Contains(err.Error(), "Duplicate column name") {
-			err = errors.Wrap(err, "add metacheckpoints content")
-			return
+		SELECT table_name AS tablename, index_name AS name,
+			non_unique = 0 AS isunique,
+			GROUP_CONCAT(column_name ORDER BY seq_in_index) AS columns
+		FROM information_schema.statistics
+		WHERE table_schema = DATABASE()
+		GROUP BY table_name, index_name, non_unique
+		ORDER BY table_name, index_name`
+	if err := db.Select(&idxs, q); err != nil {
+		return nil, errors.Wrap(err, "select indexes")
+	}
+	for _, idx := range idxs {
+		t, ok := schema.Tables[idx.Table]
+		if !ok {
+			continue
 		}
+		t.Indexes = append(t.Indexes, migrate.Index{
+			Name:    idx.Name,
+			Columns: strings.Split(idx.Columns, ","),
+			Unique:  idx.Unique,
+		})
 	}
 
+	cons := []struct {
+		Table      string `db:"tablename"`
+		Name       string `db:"name"`
+		Type       string `db:"type"`
+		Definition string `db:"definition"`
+	}{}
 	q = `
-	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "create metaversion table")
-		return
+		SELECT k.table_name AS tablename, k.constraint_name AS name,
+			tc.constraint_type AS type,
+			CONCAT('(',
+				GROUP_CONCAT(k.column_name ORDER BY k.ordinal_position),
+				')',
+				IFNULL(CONCAT(' REFERENCES ',
+					MAX(k.referenced_table_name), '(',
+					GROUP_CONCAT(k.referenced_column_name
+						ORDER BY k.ordinal_position),
+					')'), '')) AS definition
+		FROM information_schema.key_column_usage k
+		JOIN information_schema.table_constraints tc
+			ON tc.constraint_schema = k.constraint_schema
+			AND tc.table_name = k.table_name
+			AND tc.constraint_name = k.constraint_name
+		WHERE k.table_schema = DATABASE()
+		GROUP BY k.table_name, k.constraint_name, tc.constraint_type
+		ORDER BY k.table_name, k.constraint_name`
+	if err := db.Select(&cons, q); err != nil {
+		return nil, errors.Wrap(err, "select constraints")
 	}
-	q = `DELETE FROM metaversion`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "delete metaversion")
-		return
+	for _, c := range cons {
+		t, ok := schema.Tables[c.Table]
+		if !ok {
+			continue
+		}
+		t.Constraints = append(t.Constraints, migrate.Constraint{
+			Name:       c.Name,
+			Type:       c.Type,
+			Definition: c.Definition,
+		})
 	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "insert metaversion")
-		return
+	return schema, nil
+}
+
+// DumpSchema returns the statements needed to recreate the tables and views
+// in the connected database. Tables are ordered so that each is created after
+// any tables its foreign keys reference.
+func (db *DB) DumpSchema() ([]string, error) {
+	tables := []string{}
+	q := `
+		SELECT table_name AS name
+		FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'
+		ORDER BY create_time, table_name`
+	if err := db.Select(&tables, q); err != nil {
+		return nil, errors.Wrap(err, "select tables")
+	}
+	refs := []struct {
+		Table      string `db:"tablename"`
+		Referenced string `db:"referenced"`
+	}{}
+	q = `
+		SELECT table_name AS tablename,
+			referenced_table_name AS referenced
+		FROM information_schema.referential_constraints
+		WHERE constraint_schema = DATABASE()`
+	if err := db.Select(&refs, q); err != nil {
+		return nil, errors.Wrap(err, "select references")
+	}
+	deps := map[string][]string{}
+	for _, r := range refs {
+		deps[r.Table] = append(deps[r.Table], r.Referenced)
+	}
+
+	var stmts []string
+	done := map[string]bool{}
+	var visit func(table string) error
+	visit = func(table string) error {
+		if done[table] {
+			return nil
+		}
+		done[table] = true
+		for _, dep := range deps[table] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		if migrate.IsMetaTable(table) {
+			return nil
+		}
+		var name, stmt string
+		q := fmt.Sprintf("SHOW CREATE TABLE `%s`", table)
+		if err := db.QueryRowx(q).Scan(&name, &stmt); err != nil {
+			return errors.Wrapf(err, "show create table %s", table)
+		}
+		stmts = append(stmts, regexAutoIncrement.ReplaceAllString(stmt, ""))
+		return nil
+	}
+	for _, table := range tables {
+		if err := visit(table); err != nil {
+			return nil, err
+		}
+	}
+
+	// View definitions qualify tables with the database name, which we
+	// remove so that the statements can run in any database
+	var dbName string
+	if err := db.Get(&dbName, `SELECT DATABASE()`); err != nil {
+		return nil, errors.Wrap(err, "select database")
+	}
+	views := []struct {
+		Name       string `db:"name"`
+		Definition string `db:"definition"`
+	}{}
+	q = `
+		SELECT table_name AS name, view_definition AS definition
+		FROM information_schema.views
+		WHERE table_schema = DATABASE()
+		ORDER BY table_name`
+	if err := db.Select(&views, q); err != nil {
+		return nil, errors.Wrap(err, "select views")
+	}
+	for _, v := range views {
+		def := strings.Replace(v.Definition, "`"+dbName+"`.", "", -1)
+		stmts = append(stmts, fmt.Sprintf("CREATE VIEW `%s` AS %s",
+			v.Name, def))
+	}
+	return stmts, nil
+}
+
+// Scratch creates a throwaway database on the same server, connecting to it
+// with the same credentials. Removing it drops the database.
+func (db *DB) Scratch() (migrate.Store, func() error, error) {
+	cfg, err := mysql.ParseDSN(db.connURL)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse dsn")
+	}
+	byt := make([]byte, 8)
+	if _, err = rand.Read(byt); err != nil {
+		return nil, nil, errors.Wrap(err, "read rand")
+	}
+	cfg.DBName = "migrate_scratch_" + hex.EncodeToString(byt)
+	if _, err = db.Exec(`CREATE DATABASE ` + cfg.DBName); err != nil {
+		return nil, nil, errors.Wrap(err, "create database")
+	}
+	dropDB := func() error {
+		_, err := db.Exec(`DROP DATABASE ` + cfg.DBName)
+		return errors.Wrap(err, "drop database")
+	}
+
+	// Our TLS config, if any, was registered when we opened db, so the
+	// scratch connection can reuse it by name
+	scratch := &DB{connURL: cfg.FormatDSN()}
+	if err = scratch.Open(); err != nil {
+		_ = dropDB()
+		return nil, nil, errors.Wrap(err, "open")
+	}
+	cleanup := func() error {
+		if err := scratch.Close(); err != nil {
+			return errors.Wrap(err, "close")
+		}
+		return dropDB()
+	}
+	return scratch, cleanup, nil
+}
+
+// Tenant opens a Store scoped to the named database, which must exist.
+func (db *DB) Tenant(name string) (migrate.Store, func() error, error) {
+	cfg, err := mysql.ParseDSN(db.connURL)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse dsn")
+	}
+	cfg.DBName = name
+
+	// Our TLS config, if any, was registered when we opened db, so the
+	// tenant connection can reuse it by name
+	tenant := &DB{connURL: cfg.FormatDSN()}
+	if err = tenant.Open(); err != nil {
+		return nil, nil, errors.Wrap(err, "open")
+	}
+	return tenant, tenant.Close, nil
+}
+
+// TenantNames runs a query which returns a database name in each row, such
+// as:
+//
+//	SELECT schema_name FROM information_schema.schemata
+//	WHERE schema_name LIKE 'customer\_%'
+func (db *DB) TenantNames(query string) ([]string, error) {
+	names := []string{}
+	if err := db.Select(&names, query); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Lock takes a named lock on migrations in the current database, waiting
+// until it's available. MySQL limits lock names to 64 characters. The lock
+// belongs to the connection, so it's lost if a statement is canceled; see
+// SetTimeouts.
+func (db *DB) Lock() error {
+	var ok sql.NullInt64
+	q := `SELECT GET_LOCK(LEFT(CONCAT('migrate:', DATABASE()), 64), -1)`
+	if err := db.Get(&ok, q); err != nil {
+		return err
+	}
+	if ok.Int64 != 1 {
+		return errors.New("failed to get lock")
 	}
 	return nil
 }
 
+func (db *DB) Unlock() error {
+	q := `SELECT RELEASE_LOCK(LEFT(CONCAT('migrate:', DATABASE()), 64))`
+	_, err := db.Exec(q)
+	return err
+}
+
 func (db *DB) Open() error {
 	if db.tlsConfig != nil {
-		err := mysql.RegisterTLSConfig(db.tlsConfig.ServerName,
-			db.tlsConfig.Config)
+		err := mysql.RegisterTLSConfig(tlsConfigName, db.tlsConfig)
 		if err != nil {
 			return errors.Wrap(err, "register tls config")
 		}
@@ -228,37 +677,146 @@ func (db *DB) Open() error {
 	if err != nil {
 		return errors.Wrap(err, "open db connection")
 	}
+
+	// Use a single connection, so settings like timeouts apply to every
+	// statement
+	db.SetMaxOpenConns(1)
+	return nil
+}
+
+// SetTimeouts sets max_execution_time and how long statements wait for
+// metadata locks, such as those taken by ALTER TABLE. A zero duration
+// restores the server's default.
+//
+// MySQL's lock_wait_timeout has a resolution of seconds, so the lock timeout
+// is rounded up. max_execution_time limits only SELECT statements, so others
+// are limited by migrate canceling them. The driver cancels a statement by
+// closing its connection, which also releases the lock taken by Lock and
+// these settings, so a statement timeout should be long enough that it only
+// stops a runaway migration.
+func (db *DB) SetTimeouts(statement, lock time.Duration) error {
+	// Zero restores the global default, which a DBA may have changed
+	q := `SET SESSION max_execution_time = DEFAULT`
+	if statement > 0 {
+		q = fmt.Sprintf(`SET SESSION max_execution_time = %d`,
+			statement.Milliseconds())
+	}
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set max_execution_time")
+	}
+	q = `SET SESSION lock_wait_timeout = DEFAULT`
+	if lock > 0 {
+		secs := int64((lock + time.Second - 1) / time.Second)
+		q = fmt.Sprintf(`SET SESSION lock_wait_timeout = %d`, secs)
+	}
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set lock_wait_timeout")
+	}
 	return nil
 }
 
-type tlsConfig struct {
-	ServerName string
-	Config     *tls.Config
+// BeginMigration starts a transaction on the single open connection.
+func (db *DB) BeginMigration() error {
+	_, err := db.Exec(`START TRANSACTION`)
+	db.inTx = err == nil
+	return err
+}
+
+func (db *DB) CommitMigration() error {
+	_, err := db.Exec(`COMMIT`)
+	db.inTx = false
+	return err
 }
 
+func (db *DB) RollbackMigration() error {
+	_, err := db.Exec(`ROLLBACK`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) IsLockTimeout(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == 1205 // ER_LOCK_WAIT_TIMEOUT
+}
+
+// tlsConfigName is the name under which Open registers our TLS config with
+// the driver. Scratch and Tenant connections reuse it through the DSN.
+const tlsConfigName = "migrate"
+
+// newTLSConfig for the sslmode require, verify-ca or verify-full. The client
+// key and cert must be given together, and either may be omitted with the CA.
+// Like libpq, require verifies the CA when one is given.
 func newTLSConfig(
-	dbName, keyPath, certPath, caPath, serverName string,
-) (*tlsConfig, error) {
-	rootCertPool := x509.NewCertPool()
-	pem, err := ioutil.ReadFile(caPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "read sql server cert file")
+	mode, keyPath, certPath, caPath, serverName string,
+) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: serverName}
+	if (keyPath == "") != (certPath == "") {
+		return nil, errors.New("ssl key and cert must be given together")
 	}
-	if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-		return nil, errors.New("failed to append to pem")
+	if keyPath != "" {
+		certs, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "load x509 key pair")
+		}
+		conf.Certificates = []tls.Certificate{certs}
 	}
-	certs, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		return nil, errors.Wrap(err, "load x509 key pair")
+	if caPath == "" && mode == "require" {
+		conf.InsecureSkipVerify = true
+		return conf, nil
 	}
-	clientCert := []tls.Certificate{certs}
-	conf := &tlsConfig{
-		ServerName: serverName,
-		Config: &tls.Config{
-			RootCAs:      rootCertPool,
-			Certificates: clientCert,
-			ServerName:   serverName,
-		},
+
+	// Without a CA, the server is verified against the system roots
+	if caPath != "" {
+		rootCertPool := x509.NewCertPool()
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "read sql server cert file")
+		}
+		if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
+			return nil, errors.New("failed to append to pem")
+		}
+		conf.RootCAs = rootCertPool
+	}
+	if mode == "verify-full" {
+		return conf, nil
+	}
+
+	// verify-ca checks the chain but not the host name, which crypto/tls
+	// can't do on its own, so we skip its checks and verify the chain
+	// ourselves
+	conf.InsecureSkipVerify = true
+	conf.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		return verifyChain(conf.RootCAs, raw)
 	}
 	return conf, nil
 }
+
+// verifyChain checks that the first certificate in raw chains to roots,
+// through any of the others.
+func verifyChain(roots *x509.CertPool, raw [][]byte) error {
+	if len(raw) == 0 {
+		return errors.New("no server certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, byt := range raw {
+		var err error
+		certs[i], err = x509.ParseCertificate(byt)
+		if err != nil {
+			return errors.Wrap(err, "parse server certificate")
+		}
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return errors.Wrap(err, "verify server certificate")
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/egtann/migrate"
 	_ "github.com/go-sql-driver/mysql"
@@ -26,6 +27,40 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func TestNewSSLMode(t *testing.T) {
+	db, err := New("root", "", "localhost", "migrate_test", 3306, "", "",
+		"", "", "")
+	check(t, err)
+	if db.tlsConfig != nil || strings.Contains(db.connURL, "tls=") {
+		t.Fatalf("expected no tls, got %s", db.connURL)
+	}
+
+	db, err = New("root", "", "localhost", "migrate_test", 3306, "require",
+		"", "", "", "")
+	check(t, err)
+	if db.tlsConfig == nil || !db.tlsConfig.InsecureSkipVerify {
+		t.Fatal("expected require to skip verification without a CA")
+	}
+
+	db, err = New("root", "", "localhost", "migrate_test", 3306, "prefer",
+		"", "", "", "")
+	check(t, err)
+	if !strings.Contains(db.connURL, "tls=preferred") {
+		t.Fatalf("expected tls=preferred, got %s", db.connURL)
+	}
+
+	_, err = New("root", "", "localhost", "migrate_test", 3306,
+		"verify-ca", "key.pem", "", "", "")
+	if err == nil {
+		t.Fatal("expected an error for a key without a cert")
+	}
+	_, err = New("root", "", "localhost", "migrate_test", 3306, "bad", "",
+		"", "", "")
+	if err == nil {
+		t.Fatal("expected an error for an unknown sslmode")
+	}
+}
+
 func TestCreateMetaIfNotExists(t *testing.T) {
 	db := newDB(t)
 	defer teardown(t, db)
@@ -123,7 +158,7 @@ func TestDeleteMetaCheckpoints(t *testing.T) {
 	db := setupDBV1(t)
 	defer teardown(t, db)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints(checkpointFile)
 	check(t, err)
 
 	mcs, err := db.GetMetaCheckpoints(checkpointFile)
@@ -133,6 +168,196 @@ func TestDeleteMetaCheckpoints(t *testing.T) {
 	}
 }
 
+func TestCompleteMigration(t *testing.T) {
+	db := setupDBV1(t)
+	defer teardown(t, db)
+
+	err := db.CompleteMigration(checkpointFile, "SELECT 2;", "md5")
+	check(t, err)
+
+	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatal("expected 0 checkpoints")
+	}
+	filenames, err := db.GetMetaCheckpointFilenames()
+	check(t, err)
+	if len(filenames) != 0 {
+		t.Fatalf("expected no checkpoint files, got %v", filenames)
+	}
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 2 || ms[1].Filename != checkpointFile {
+		t.Fatalf("expected %s to be recorded, got %+v", checkpointFile, ms)
+	}
+}
+
+func TestReplaceMigrations(t *testing.T) {
+	db := setupDBV1(t)
+	defer teardown(t, db)
+
+	err := db.InsertMigration("2.sql", "SELECT 2;", "md5")
+	check(t, err)
+
+	err = db.ReplaceMigrations([]string{"1.sql", "2.sql"}, "2_squash.sql",
+		"SELECT 1;", "md5")
+	check(t, err)
+
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "2_squash.sql" {
+		t.Fatalf("expected only 2_squash.sql, got %+v", ms)
+	}
+}
+
+func TestDumpSchema(t *testing.T) {
+	db := setupDBV1(t)
+	defer teardown(t, db)
+
+	q := `
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			email VARCHAR(255) NOT NULL
+		)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE INDEX users_email_idx ON users (email)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	stmts, err := db.DumpSchema()
+	check(t, err)
+	if len(stmts) == 0 || !strings.Contains(stmts[0], "CREATE TABLE") {
+		t.Fatalf("expected CREATE TABLE first, got %v", stmts)
+	}
+	if !strings.Contains(stmts[len(stmts)-1], "users_email_idx") {
+		t.Fatalf("expected users_email_idx last, got %v", stmts)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	db := setupDBV1(t)
+	defer teardown(t, db)
+
+	q := `
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			email VARCHAR(255) UNIQUE NOT NULL
+		)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE INDEX users_email_idx ON users (id, email)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	schema, err := db.Schema()
+	check(t, err)
+	if len(schema.Tables) != 1 {
+		t.Fatalf("expected 1 table, got %d", len(schema.Tables))
+	}
+	users := schema.Tables["users"]
+	if len(users.Columns) != 2 {
+		t.Fatalf("expected 2 columns, got %d", len(users.Columns))
+	}
+	if len(users.Constraints) != 2 {
+		t.Fatalf("expected 2 constraints, got %+v", users.Constraints)
+	}
+	var found bool
+	for _, idx := range users.Indexes {
+		if idx.Name == "users_email_idx" && len(idx.Columns) == 2 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing users_email_idx in %+v", users.Indexes)
+	}
+}
+
+func TestUpgradeMetaV2(t *testing.T) {
+	db := setupDBV1(t)
+	defer teardown(t, db)
+
+	// Leave a table as a failed upgrade would, which must be replaced
+	_, err := db.DB.Exec(`CREATE TABLE metaversion_new (x INTEGER)`)
+	check(t, err)
+
+	stmts, err := db.MetaUpgradeSQL(2, nil)
+	check(t, err)
+	v := migrate.MetaVersion{Version: 2, Release: "v1.2.3"}
+	err = db.UpgradeMeta(v, stmts)
+	check(t, err)
+
+	got, err := db.CreateMetaVersionIfNotExists()
+	check(t, err)
+	if got != v {
+		t.Fatalf("expected %+v, got %+v", v, got)
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+	db.SetMaxOpenConns(1)
+
+	err := db.SetTimeouts(time.Second, 250*time.Millisecond)
+	check(t, err)
+
+	var timeout int
+	err = db.Get(&timeout, `SELECT @@SESSION.lock_wait_timeout`)
+	check(t, err)
+	if timeout != 1 {
+		t.Fatalf("expected lock_wait_timeout 1, got %d", timeout)
+	}
+	err = db.Get(&timeout, `SELECT @@SESSION.max_execution_time`)
+	check(t, err)
+	if timeout != 1000 {
+		t.Fatalf("expected max_execution_time 1000, got %d", timeout)
+	}
+
+	err = db.SetTimeouts(0, 0)
+	check(t, err)
+
+	for _, name := range []string{"lock_wait_timeout", "max_execution_time"} {
+		var session, global int
+		q := fmt.Sprintf(`SELECT @@SESSION.%s, @@GLOBAL.%s`, name, name)
+		err = db.QueryRow(q).Scan(&session, &global)
+		check(t, err)
+		if session != global {
+			t.Fatalf("expected %s %d, got %d", name, global, session)
+		}
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+	db.SetMaxOpenConns(1)
+
+	err := db.SetTimeouts(100*time.Millisecond, 0)
+	check(t, err)
+
+	// An interrupted SLEEP returns 1, or the query fails
+	start := time.Now()
+	var interrupted int
+	err = db.Get(&interrupted, `SELECT SLEEP(2)`)
+	if (err == nil && interrupted != 1) || time.Since(start) >= 2*time.Second {
+		t.Fatal("expected max_execution_time to stop the SELECT")
+	}
+}
+
+func TestLock(t *testing.T) {
+	db := newDB(t)
+	defer teardown(t, db)
+	db.SetMaxOpenConns(1)
+
+	err := db.Lock()
+	check(t, err)
+	err = db.Unlock()
+	check(t, err)
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -220,12 +445,16 @@ func teardown(t *testing.T, db *DB) {
 
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
-	err := db.UpgradeToV1([]migrate.Migration{{
+	_, err := db.CreateMetaVersionIfNotExists()
+	check(t, err)
+	stmts, err := db.MetaUpgradeSQL(1, []migrate.Migration{{
 		Filename: "1.sql",
 		Checksum: "md5",
 		Content:  "SELECT 1;",
 	}})
 	check(t, err)
+	err = db.UpgradeMeta(migrate.MetaVersion{Version: 1}, stmts)
+	check(t, err)
 
 	q := `
 		INSERT INTO metacheckpoints (idx, filename, content, md5)
@@ -0,0 +1,174 @@
+package migrate
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Option configures optional behavior in New.
+type Option func(*Migrate)
+
+// WithDir reads migration files from dir.
+func WithDir(dir string) Option {
+	return WithFS(os.DirFS(dir))
+}
+
+// WithFS reads migration files from the root of fsys, such as an embed.FS or
+// a subtree of one from fs.Sub.
+func WithFS(fsys fs.FS) Option {
+	return func(m *Migrate) {
+		m.sources = []source{{fsys: fsys}}
+	}
+}
+
+// WithSource adds migration files from the root of fsys, each named
+// "<namespace>/<file>" in the meta table. Use it once for each of several
+// sources, such as per-module migration directories sharing a database.
+// Files from every source are merged into one order by their numbers, with
+// ties broken by namespace. Numbers must be unique only within a namespace.
+func WithSource(namespace string, fsys fs.FS) Option {
+	return func(m *Migrate) {
+		m.sources = append(m.sources, source{
+			namespace: namespace,
+			fsys:      fsys,
+		})
+	}
+}
+
+// WithBaseline records every migration file up to and including filename as
+// already run, without running it. This enables you to start using migrate on
+// an existing database.
+func WithBaseline(filename string) Option {
+	return func(m *Migrate) {
+		m.baseline = filename
+	}
+}
+
+// OutOfOrderPolicy determines what happens when a migration file which
+// hasn't run sorts before one which has, such as after merging two branches
+// which each added a migration.
+type OutOfOrderPolicy int
+
+const (
+	// OutOfOrderFail refuses to migrate, returning an *OutOfOrderError.
+	// This is the default.
+	OutOfOrderFail OutOfOrderPolicy = iota
+
+	// OutOfOrderAllow runs the file along with any others which are
+	// pending, in order.
+	OutOfOrderAllow
+)
+
+// WithOutOfOrder sets the policy for migration files which haven't run but
+// sort before those which have.
+func WithOutOfOrder(p OutOfOrderPolicy) Option {
+	return func(m *Migrate) {
+		m.outOfOrder = p
+	}
+}
+
+// TxMode determines whether migration files run in transactions.
+type TxMode int
+
+const (
+	// TxNone runs each statement on its own, checkpointing after every
+	// one, so that a failed file resumes where it stopped. This is the
+	// default.
+	TxNone TxMode = iota
+
+	// TxPerFile runs each file and records it in a single transaction,
+	// so that a failed file leaves no trace. The Store must implement
+	// Transactor. Databases like MySQL implicitly commit after most
+	// schema changes, so this offers little protection for those.
+	TxPerFile
+)
+
+// WithTransactions sets whether migration files run in transactions.
+func WithTransactions(mode TxMode) Option {
+	return func(m *Migrate) {
+		m.txMode = mode
+	}
+}
+
+// ChecksumAlgorithm computes the checksums which detect changes to migration
+// files after they've run.
+type ChecksumAlgorithm int
+
+const (
+	// ChecksumMD5 is the default.
+	ChecksumMD5 ChecksumAlgorithm = iota
+	ChecksumSHA256
+)
+
+// WithChecksum records checksums of newly run migrations using alg. Existing
+// checksums are still verified with the algorithm that computed them, so
+// changing algorithms doesn't invalidate history.
+func WithChecksum(alg ChecksumAlgorithm) Option {
+	return func(m *Migrate) {
+		m.checksum = alg
+	}
+}
+
+// WithExpandEnv replaces ${VAR} in each migration file with the value of the
+// environment variable VAR before its statements are run. Referencing an
+// unset variable is an error.
+//
+// Checksums are computed over the file as written, so history is the same in
+// every environment, while the meta table records the expanded content that
+// actually ran.
+func WithExpandEnv() Option {
+	return func(m *Migrate) {
+		m.expandEnv = true
+	}
+}
+
+// WithStatementTimeout cancels any statement which runs longer than d. A
+// file may override it with a directive:
+//
+//	-- migrate:timeout 5m
+func WithStatementTimeout(d time.Duration) Option {
+	return func(m *Migrate) {
+		m.timeouts.statement = d
+	}
+}
+
+// WithLockTimeout fails any statement which waits longer than d to acquire a
+// lock, so that a migration blocked behind a long-running transaction doesn't
+// stall every other query waiting on the same table. A file may override it
+// with a directive:
+//
+//	-- migrate:lock-timeout 10s
+func WithLockTimeout(d time.Duration) Option {
+	return func(m *Migrate) {
+		m.timeouts.lock = d
+	}
+}
+
+// WithLockRetries retries a statement which failed due to a lock timeout up
+// to n times, waiting backoff before the first retry and doubling it before
+// each one after. If every retry fails, the migration fails with a
+// *LockTimeoutError. It can't be combined with TxPerFile, since databases like
+// Postgres abort the transaction when a statement times out.
+func WithLockRetries(n int, backoff time.Duration) Option {
+	return func(m *Migrate) {
+		m.lockRetries = n
+		m.lockBackoff = backoff
+	}
+}
+
+// WithHooks calls h as migrations run. Hooks are called in the order they're
+// added, after the built-in hook which logs progress.
+func WithHooks(h Hooks) Option {
+	return func(m *Migrate) {
+		m.hooks = append(m.hooks, h)
+	}
+}
+
+// WithLogger logs to l. Without it, New logs nothing. Use FromLogger to log
+// to a Logger.
+func WithLogger(l LevelLogger) Option {
+	return func(m *Migrate) {
+		m.log = l
+	}
+}
@@ -0,0 +1,381 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Plan lists the exact work that Apply will do. Create one with Migrate.Plan.
+type Plan struct {
+	// MetaUpgrades lists the upgrades the meta tables need before the
+	// history can be read. While there are any, they're the only work
+	// listed, and Apply refuses to run. Upgrade, then plan again.
+	MetaUpgrades []MetaUpgrade
+
+	// Baseline lists the files through the one given to WithBaseline,
+	// which will be recorded as migrated without running them.
+	Baseline []string
+
+	// Squashes lists the squashed files which will be recorded in place
+	// of the already-run migrations they supersede.
+	Squashes []string
+
+	// Steps lists the pending files in the order they'll run, followed
+	// by any repeatable files which are new or have changed.
+	Steps []Step
+
+	// StaleCheckpoints lists files with checkpoints left by an earlier
+	// attempt which aren't pending, such as files which were renamed or
+	// removed since. Apply deletes their checkpoints.
+	StaleCheckpoints []string
+
+	// history and repeated are the migration history when we planned.
+	// Apply refuses to run if it has since changed.
+	history  []Migration
+	repeated map[string]string
+}
+
+// Step is a pending migration file.
+type Step struct {
+	Filename string
+
+	// Checksum of the file as written.
+	Checksum string
+
+	// Statements in the file, after expanding any environment variables.
+	Statements []Statement
+
+	// Resume is the index of the first statement to run. Statements
+	// before it ran in an earlier attempt which failed, so they're
+	// skipped. If it equals len(Statements), every statement ran but the
+	// file was never recorded, so applying the step only records it.
+	Resume int
+
+	// Repeatable is set for R__<name>.sql files, which replace their
+	// history when they run again.
+	Repeatable bool
+
+	// content is the file after expanding any environment variables,
+	// which is recorded in the meta table once the step completes.
+	content string
+}
+
+// Statement is a single statement in a migration file. Line is the line on
+// which it begins, starting at 1.
+type Statement struct {
+	SQL  string
+	Line int
+
+	// Rebuild is the table named by a "-- migrate:rebuild <table>"
+	// directive before the statement. SQL is then the CREATE TABLE
+	// statement which the table is rebuilt to match.
+	Rebuild string
+
+	// Copy is set for COPY ... FROM STDIN statements, whose rows follow
+	// them in the file. Data holds those rows.
+	Copy bool
+	Data string
+}
+
+// Empty reports whether applying the plan would do nothing.
+func (p *Plan) Empty() bool {
+	return len(p.MetaUpgrades) == 0 && len(p.Baseline) == 0 &&
+		len(p.Squashes) == 0 && len(p.Steps) == 0 &&
+		len(p.StaleCheckpoints) == 0
+}
+
+// Plan reads the migration history, confirms that it's consistent with our
+// files, and reports the work needed to migrate. It only reads from the
+// database, so it can run before Init, such as for a dry run. The history of
+// a database without meta tables is empty. If the meta tables need an
+// Upgrade, the plan lists only the MetaUpgrades.
+func (m *Migrate) Plan() (*Plan, error) {
+	cur := m.metaVersion
+	m.metaMissing = false
+	if !m.initialized {
+		exists, err := m.db.MetaExists()
+		if err != nil {
+			return nil, errors.Wrap(err, "meta exists")
+		}
+		if exists {
+			v, err := m.db.GetMetaVersion()
+			if err != nil {
+				return nil, errors.Wrap(err, "get meta version")
+			}
+			if err = checkMetaVersion(v); err != nil {
+				return nil, err
+			}
+			cur = v.Version
+		} else {
+			cur, m.metaMissing = version, true
+		}
+	}
+	if cur < version {
+		ups, err := m.metaUpgrades(cur)
+		if err != nil {
+			return nil, err
+		}
+		return &Plan{MetaUpgrades: ups}, nil
+	}
+
+	m.baselineIdx = -1
+	if m.baseline != "" {
+		var err error
+		m.baselineIdx, err = m.baselineIndex()
+		if err != nil {
+			return nil, errors.Wrap(err, "baseline")
+		}
+	}
+	m.squashes = nil
+	if m.metaMissing {
+		m.Migrations, m.repeated = nil, map[string]string{}
+	} else if err := m.getMigrations(); err != nil {
+		return nil, err
+	}
+	if err := m.validHistory(); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Squashes: m.squashes,
+		history:  append([]Migration(nil), m.Migrations...),
+		repeated: m.repeated,
+	}
+	for i := 0; i <= m.baselineIdx; i++ {
+		plan.Baseline = append(plan.Baseline, m.Files[i].Name())
+	}
+	for _, filename := range m.pending() {
+		step, err := m.planStep(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "plan %s", filename)
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	// Repeatable files run last, whenever they're new or have changed
+	for _, fi := range m.Repeatables {
+		filename := fi.Name()
+		step, err := m.planStep(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "plan %s", filename)
+		}
+		if checksum, ok := m.repeated[filename]; ok &&
+			checksum == step.Checksum {
+			continue
+		}
+		step.Repeatable = true
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	// Checkpoints for any file we won't run are left over from an
+	// attempt we can't resume
+	if m.metaMissing {
+		return plan, nil
+	}
+	filenames, err := m.db.GetMetaCheckpointFilenames()
+	if err != nil {
+		return nil, errors.Wrap(err, "get checkpoint filenames")
+	}
+	planned := map[string]bool{}
+	for _, step := range plan.Steps {
+		planned[step.Filename] = true
+	}
+	for _, filename := range filenames {
+		if !planned[filename] {
+			plan.StaleCheckpoints = append(plan.StaleCheckpoints,
+				filename)
+		}
+	}
+	sort.Strings(plan.StaleCheckpoints)
+	return plan, nil
+}
+
+// planStep reads a pending file and determines where to resume it, if an
+// earlier attempt failed part way through.
+func (m *Migrate) planStep(filename string) (Step, error) {
+	byt, err := m.readFile(filename)
+	if err != nil {
+		return Step{}, err
+	}
+	content, err := m.expand(filename, string(byt))
+	if err != nil {
+		return Step{}, err
+	}
+
+	// Ensure that commands are present
+	stmts := m.split(content)
+	if len(stmts) == 0 {
+		return Step{}, fmt.Errorf("no sql statements in file: %s",
+			filename)
+	}
+
+	_, canRebuild := m.db.(Rebuilder)
+	_, canCopy := m.db.(Copier)
+	for _, stmt := range stmts {
+		if stmt.Rebuild != "" && !canRebuild {
+			return Step{}, fmt.Errorf(
+				"line %d: store does not support rebuilding tables",
+				stmt.Line)
+		}
+		if stmt.Copy && !canCopy {
+			return Step{}, fmt.Errorf(
+				"line %d: store does not support COPY FROM STDIN",
+				stmt.Line)
+		}
+	}
+
+	// Get our checkpoints, if any, and ensure commands weren't deleted
+	// from the file after we migrated them
+	var checkpoints []string
+	if !m.metaMissing {
+		checkpoints, err = m.db.GetMetaCheckpoints(filename)
+		if err != nil {
+			return Step{}, errors.Wrap(err, "get checkpoints")
+		}
+	}
+	if len(checkpoints) > len(stmts) {
+		return Step{}, fmt.Errorf("len(checkpoints) %d > len(cmds) %d",
+			len(checkpoints), len(stmts))
+	}
+
+	// Confirm the file up to our checkpoint has not changed
+	for i, stored := range checkpoints {
+		checksum := checksumAlgorithm(stored).sum([]byte(stmts[i].SQL))
+		if checksum != stored {
+			return Step{}, errors.Wrapf(&ChecksumMismatchError{
+				File:   filename,
+				Stored: stored,
+				Actual: checksum,
+			}, "checkpoint %d", i)
+		}
+	}
+
+	// The checksum covers the file as written, so it doesn't depend on
+	// the environment, but we record exactly what ran
+	return Step{
+		Filename:   filename,
+		Checksum:   m.checksum.sum(byt),
+		Statements: stmts,
+		Resume:     len(checkpoints),
+		content:    content,
+	}, nil
+}
+
+// split splits content into statements, or into batches if the Store runs
+// them.
+func (m *Migrate) split(content string) []Statement {
+	if b, ok := m.db.(Batcher); ok {
+		return splitBatches(content, b.IsBatchSeparator)
+	}
+	return splitStatements(content)
+}
+
+// Apply does the work in plan, which must have come from this Migrate's Plan.
+// It must follow Init. It returns an *UpgradeRequiredError if the plan lists
+// MetaUpgrades, and a *StalePlanError without doing anything if the migration
+// history changed since planning, such as when another process migrated the
+// database in the meantime. If the Store implements Locker, Apply holds its
+// lock throughout, so that check can't race another process.
+func (m *Migrate) Apply(plan *Plan) (err error) {
+	if !m.initialized {
+		return errors.New("apply before init")
+	}
+	if len(plan.MetaUpgrades) > 0 {
+		return &UpgradeRequiredError{
+			Version:  plan.MetaUpgrades[0].Version - 1,
+			Required: version,
+		}
+	}
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := unlock(); err2 != nil && err == nil {
+			err = err2
+		}
+	}()
+	if err = m.checkPlan(plan); err != nil {
+		return err
+	}
+
+	// If there's a baseline, then we record the migrations but do not
+	// perform them. This enables you to start using this package on an
+	// existing database
+	if len(plan.Baseline) > 0 {
+		if err := m.recordBaseline(plan.Baseline); err != nil {
+			return errors.Wrap(err, "skip ahead")
+		}
+		m.log.Info("skipped ahead", "file",
+			plan.Baseline[len(plan.Baseline)-1])
+	}
+
+	// If the database ran migrations which have since been squashed,
+	// record the squashed files in their place
+	if len(plan.Squashes) > 0 {
+		if err := m.recordSquashes(plan.Squashes); err != nil {
+			return errors.Wrap(err, "record squashes")
+		}
+	}
+
+	for _, filename := range plan.StaleCheckpoints {
+		if err := m.db.DeleteMetaCheckpoints(filename); err != nil {
+			return errors.Wrap(err, "delete stale checkpoints")
+		}
+		m.log.Warn("deleted stale checkpoints", "file", filename)
+	}
+
+	for _, step := range plan.Steps {
+		if step.Resume == len(step.Statements) {
+			m.log.Warn("recording migration whose statements all ran",
+				"file", step.Filename)
+		}
+		if err := m.applyStep(step); err != nil {
+			return err
+		}
+	}
+	return m.getMigrations()
+}
+
+// checkPlan confirms that the history hasn't changed since plan was made.
+func (m *Migrate) checkPlan(plan *Plan) error {
+	if err := m.getMigrations(); err != nil {
+		return err
+	}
+	if len(m.Migrations) != len(plan.history) {
+		return &StalePlanError{Reason: fmt.Sprintf(
+			"planned with %d migrations, found %d",
+			len(plan.history), len(m.Migrations))}
+	}
+	for i, mg := range m.Migrations {
+		want := plan.history[i]
+		if mg.Filename != want.Filename || mg.Checksum != want.Checksum {
+			return &StalePlanError{Reason: fmt.Sprintf(
+				"planned with %s, found %s", want.Filename,
+				mg.Filename)}
+		}
+	}
+	if len(m.repeated) != len(plan.repeated) {
+		return &StalePlanError{Reason: "repeatable migrations changed"}
+	}
+	for filename, checksum := range m.repeated {
+		if plan.repeated[filename] != checksum {
+			return &StalePlanError{Reason: fmt.Sprintf(
+				"repeatable %s changed", filename)}
+		}
+	}
+	for _, step := range plan.Steps {
+		checkpoints, err := m.db.GetMetaCheckpoints(step.Filename)
+		if err != nil {
+			return errors.Wrap(err, "get checkpoints")
+		}
+		if len(checkpoints) != step.Resume {
+			return &StalePlanError{Reason: fmt.Sprintf(
+				"planned to resume %s at statement %d, found %d checkpoints",
+				step.Filename, step.Resume, len(checkpoints))}
+		}
+	}
+	return nil
+}
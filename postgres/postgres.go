@@ -1,39 +1,83 @@
 package postgres
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/egtann/migrate"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
-
-	_ "github.com/lib/pq"
 )
 
 type DB struct {
 	connURL string
 
+	// searchPath, if set, overrides the search_path in connURL.
+	searchPath string
+
+	// inTx is set between BeginMigration and CommitMigration or
+	// RollbackMigration.
+	inTx bool
+
 	// Embed the sqlx DB struct
 	*sqlx.DB
 }
 
+// New connects with the given settings. Empty settings and a zero port are
+// left to the libpq environment variables, such as PGHOST and PGPASSWORD, or
+// their defaults. It connects only to a server which accepts writes, so when
+// host lists several servers, it migrates the primary.
+//
+// sslMode is any libpq sslmode, such as require or verify-ca. When it's empty,
+// it's verify-full if any ssl file is given and PGSSLMODE isn't set, and
+// otherwise left to libpq, which defaults to prefer. The client key and cert
+// are optional, so a CA alone verifies the server.
 func New(
 	user, pass, host, dbName string,
 	port int,
-	sslKey, sslCert, sslCA string,
+	sslMode, sslKey, sslCert, sslCA string,
 ) *DB {
-	// The trailing space is important
-	url := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s ",
-		host, port, user, pass, dbName)
-	if sslKey == "" {
-		url += "sslmode=disable"
-	} else {
-		url += fmt.Sprintf(
-			"sslmode=verify-full sslkey=%s sslcert=%s sslrootcert=%s",
-			sslKey, sslCert, sslCA)
+	var params []string
+	add := func(key, val string) {
+		if val != "" {
+			params = append(params, key+"="+quoteConnValue(val))
+		}
 	}
-	return &DB{connURL: url}
+	add("host", host)
+	if port != 0 {
+		add("port", fmt.Sprint(port))
+	}
+	add("user", user)
+	add("password", pass)
+	add("dbname", dbName)
+	if sslMode == "" && os.Getenv("PGSSLMODE") == "" &&
+		(sslKey != "" || sslCert != "" || sslCA != "") {
+		sslMode = "verify-full"
+	}
+	add("sslmode", sslMode)
+	add("sslkey", sslKey)
+	add("sslcert", sslCert)
+	add("sslrootcert", sslCA)
+	add("target_session_attrs", "read-write")
+	return &DB{connURL: strings.Join(params, " ")}
+}
+
+// NewFromDSN connects with a libpq connection string, either key=value pairs
+// or a postgres:// URL. Any settings it omits are taken from the libpq
+// environment variables, so an empty dsn uses only those. Add
+// target_session_attrs=read-write to migrate only a primary.
+func NewFromDSN(dsn string) *DB {
+	return &DB{connURL: dsn}
 }
 
 func (db *DB) CreateMetaIfNotExists() error {
@@ -52,6 +96,7 @@ func (db *DB) CreateMetaIfNotExists() error {
 func (db *DB) CreateMetaCheckpointsIfNotExists() error {
 	q := `CREATE TABLE IF NOT EXISTS metacheckpoints (
 		filename TEXT NOT NULL,
+		content TEXT NOT NULL,
 		idx INTEGER NOT NULL,
 		md5 TEXT NOT NULL,
 		createdat TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
@@ -89,6 +134,37 @@ func (db *DB) UpsertMigration(filename, content, checksum string) error {
 	return err
 }
 
+func (db *DB) ReplaceMigrations(
+	old []string,
+	filename, content, checksum string,
+) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := `DELETE FROM meta WHERE filename=$1`
+	for _, name := range old {
+		if _, err = tx.Exec(q, name); err != nil {
+			err = errors.Wrapf(err, "delete %s", name)
+			return
+		}
+	}
+	q = `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
+	if _, err = tx.Exec(q, filename, content, checksum); err != nil {
+		err = errors.Wrap(err, "insert migration")
+		return
+	}
+	return nil
+}
+
 func (db *DB) InsertMetaCheckpoint(
 	filename, content, checksum string,
 	idx int,
@@ -106,109 +182,737 @@ func (db *DB) InsertMigration(filename, content, checksum string) error {
 	return err
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
+func (db *DB) DeleteMetaCheckpoints(filename string) error {
+	q := `DELETE FROM metacheckpoints WHERE filename=$1`
+	_, err := db.Exec(q, filename)
 	return err
 }
 
-func (db *DB) CreateMetaVersionIfNotExists() (int, error) {
+func (db *DB) GetMetaCheckpointFilenames() ([]string, error) {
+	filenames := []string{}
+	q := `SELECT DISTINCT filename FROM metacheckpoints`
+	err := db.Select(&filenames, q)
+	return filenames, err
+}
+
+// CompleteMigration deletes a file's checkpoints and records it in meta in a
+// single transaction, or within the current one after BeginMigration.
+func (db *DB) CompleteMigration(
+	filename, content, checksum string,
+) (err error) {
+	var ex sqlx.Execer = db.DB
+	if !db.inTx {
+		var tx *sqlx.Tx
+		tx, err = db.Beginx()
+		if err != nil {
+			return errors.Wrap(err, "begin tx")
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+		ex = tx
+	}
+
+	q := `DELETE FROM metacheckpoints WHERE filename=$1`
+	if _, err = ex.Exec(q, filename); err != nil {
+		return errors.Wrap(err, "delete checkpoints")
+	}
+	q = `
+		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
+		ON CONFLICT (filename) DO UPDATE SET md5=$4, content=$5`
+	_, err = ex.Exec(q, filename, content, checksum, checksum, content)
+	if err != nil {
+		return errors.Wrap(err, "upsert migration")
+	}
+	return nil
+}
+
+func (db *DB) MetaExists() (bool, error) {
+	var exists bool
+	q := `SELECT to_regclass('meta') IS NOT NULL`
+	err := db.Get(&exists, q)
+	return exists, err
+}
+
+func (db *DB) CreateMetaVersionIfNotExists() (migrate.MetaVersion, error) {
 	q := `CREATE TABLE IF NOT EXISTS metaversion (
-		version INTEGER NOT NULL
+		version INTEGER NOT NULL,
+		migraterelease TEXT NOT NULL
 	)`
 	if _, err := db.Exec(q); err != nil {
-		return 0, errors.Wrap(err, "create metaversion table")
+		return migrate.MetaVersion{}, errors.Wrap(err,
+			"create metaversion table")
 	}
+	return db.GetMetaVersion()
+}
 
-	var version int
-	q = `SELECT version FROM metaversion`
-	err := db.Get(&version, q)
+// GetMetaVersion reports the version of the meta tables without changing
+// them. It's zero if there's no metaversion table.
+func (db *DB) GetMetaVersion() (migrate.MetaVersion, error) {
+	var v migrate.MetaVersion
+	var exists bool
+	q := `SELECT to_regclass('metaversion') IS NOT NULL`
+	if err := db.Get(&exists, q); err != nil {
+		return v, errors.Wrap(err, "metaversion exists")
+	}
+	if !exists {
+		return v, nil
+	}
+
+	// Tables from before v2 have no release column
+	q = `SELECT * FROM metaversion`
+	err := db.Get(&v, q)
 	switch {
 	case err == sql.ErrNoRows:
-		return 0, nil
+		return v, nil
 	case err != nil:
-		return 0, errors.Wrap(err, "get version")
+		return v, errors.Wrap(err, "get version")
 	}
-	return version, nil
+	return v, nil
 }
 
 func (db *DB) Open() error {
-	var err error
-	db.DB, err = sqlx.Open("postgres", db.connURL)
+	cfg, err := pgx.ParseConfig(db.connURL)
 	if err != nil {
-		return errors.Wrap(err, "open db connection")
+		return errors.Wrap(err, "parse connection string")
 	}
+	if db.searchPath != "" {
+		cfg.RuntimeParams["search_path"] = db.searchPath
+	}
+	db.DB = sqlx.NewDb(stdlib.OpenDB(*cfg), "pgx")
+
+	// Use a single connection, so settings like timeouts apply to every
+	// statement
+	db.SetMaxOpenConns(1)
 	return nil
 }
 
-// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
-// migrations before running this function; this will not succeed if have any
-// existing metacheckpoints.
-func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
-	// Begin Tx
-	tx, err := db.Beginx()
+// SetTimeouts sets the statement and lock timeouts of the session. A zero
+// duration resets the timeout to the session's default, such as one set for
+// the role or database.
+func (db *DB) SetTimeouts(statement, lock time.Duration) error {
+	q := `RESET statement_timeout`
+	if statement > 0 {
+		q = fmt.Sprintf(`SET statement_timeout = %d`,
+			statement.Milliseconds())
+	}
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set statement_timeout")
+	}
+	q = `RESET lock_timeout`
+	if lock > 0 {
+		q = fmt.Sprintf(`SET lock_timeout = %d`, lock.Milliseconds())
+	}
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set lock_timeout")
+	}
+	return nil
+}
+
+// BeginMigration starts a transaction on the single open connection.
+func (db *DB) BeginMigration() error {
+	_, err := db.Exec(`BEGIN`)
+	db.inTx = err == nil
+	return err
+}
+
+func (db *DB) CommitMigration() error {
+	_, err := db.Exec(`COMMIT`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) RollbackMigration() error {
+	_, err := db.Exec(`ROLLBACK`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) IsLockTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "55P03" // lock_not_available
+}
+
+// DescribeError reports the SQLSTATE, position, detail and hint of a Postgres
+// error.
+func (db *DB) DescribeError(err error) migrate.ErrorDescription {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return migrate.ErrorDescription{}
+	}
+	return migrate.ErrorDescription{
+		Code:     pgErr.Code,
+		Position: int(pgErr.Position),
+		Detail:   pgErr.Detail,
+		Hint:     pgErr.Hint,
+	}
+}
+
+// CopyFrom runs a COPY ... FROM STDIN statement, streaming rows to the server
+// in the text or CSV format it specifies.
+func (db *DB) CopyFrom(
+	ctx context.Context,
+	stmt string,
+	rows io.Reader,
+) (int64, error) {
+	// This is the single open connection, so it's part of any
+	// transaction from BeginMigration
+	conn, err := db.Conn(ctx)
 	if err != nil {
-		return errors.Wrap(err, "begin tx")
+		return 0, errors.Wrap(err, "conn")
+	}
+	defer conn.Close()
+
+	var n int64
+	err = conn.Raw(func(driverConn interface{}) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn().PgConn()
+		tag, err := pgConn.CopyFrom(ctx, rows, stmt)
+		n = tag.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+// Schema describes the tables in the current schema, which is usually
+// public.
+func (db *DB) Schema() (*migrate.Schema, error) {
+	tables := []string{}
+	q := `
+		SELECT c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND c.relkind IN ('r', 'p')`
+	if err := db.Select(&tables, q); err != nil {
+		return nil, errors.Wrap(err, "select tables")
+	}
+	schema := migrate.NewSchema()
+	for _, name := range tables {
+		if !migrate.IsMetaTable(name) {
+			schema.Table(name)
+		}
+	}
+
+	cols := []struct {
+		Table    string         `db:"tablename"`
+		Name     string         `db:"name"`
+		Type     string         `db:"type"`
+		Nullable bool           `db:"nullable"`
+		Default  sql.NullString `db:"dflt"`
+	}{}
+	q = `
+		SELECT c.relname AS tablename, a.attname AS name,
+			format_type(a.atttypid, a.atttypmod) AS type,
+			NOT a.attnotnull AS nullable,
+			pg_get_expr(d.adbin, d.adrelid) AS dflt
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d
+			ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE n.nspname = current_schema() AND c.relkind IN ('r', 'p')
+			AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY c.relname, a.attnum`
+	if err := db.Select(&cols, q); err != nil {
+		return nil, errors.Wrap(err, "select columns")
+	}
+	for _, c := range cols {
+		t, ok := schema.Tables[c.Table]
+		if !ok {
+			continue
+		}
+		t.Columns = append(t.Columns, migrate.Column{
+			Name:     c.Name,
+			Type:     c.Type,
+			Nullable: c.Nullable,
+			Default:  c.Default.String,
+		})
+	}
+
+	idxs := []struct {
+		Table   string `db:"tablename"`
+		Name    string `db:"name"`
+		Unique  bool   `db:"isunique"`
+		Columns string `db:"columns"`
+	}{}
+	q = `
+		SELECT t.relname AS tablename, i.relname AS name,
+			ix.indisunique AS isunique,
+			(SELECT string_agg(pg_get_indexdef(ix.indexrelid, k, true),
+				',' ORDER BY k)
+			FROM generate_series(1, ix.indnatts) AS k) AS columns
+		FROM pg_index ix
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = current_schema()
+		ORDER BY t.relname, i.relname`
+	if err := db.Select(&idxs, q); err != nil {
+		return nil, errors.Wrap(err, "select indexes")
+	}
+	for _, idx := range idxs {
+		t, ok := schema.Tables[idx.Table]
+		if !ok {
+			continue
+		}
+		t.Indexes = append(t.Indexes, migrate.Index{
+			Name:    idx.Name,
+			Columns: strings.Split(idx.Columns, ","),
+			Unique:  idx.Unique,
+		})
+	}
+
+	cons := []struct {
+		Table      string `db:"tablename"`
+		Name       string `db:"name"`
+		Type       string `db:"type"`
+		Definition string `db:"definition"`
+	}{}
+	q = `
+		SELECT t.relname AS tablename, c.conname AS name,
+			CASE c.contype
+				WHEN 'p' THEN 'PRIMARY KEY'
+				WHEN 'f' THEN 'FOREIGN KEY'
+				WHEN 'u' THEN 'UNIQUE'
+				WHEN 'c' THEN 'CHECK'
+				ELSE 'EXCLUDE'
+			END AS type,
+			pg_get_constraintdef(c.oid) AS definition
+		FROM pg_constraint c
+		JOIN pg_class t ON t.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = current_schema()
+			AND c.contype IN ('p', 'f', 'u', 'c', 'x')
+		ORDER BY t.relname, c.conname`
+	if err := db.Select(&cons, q); err != nil {
+		return nil, errors.Wrap(err, "select constraints")
+	}
+	for _, c := range cons {
+		t, ok := schema.Tables[c.Table]
+		if !ok {
+			continue
+		}
+		t.Constraints = append(t.Constraints, migrate.Constraint{
+			Name:       c.Name,
+			Type:       c.Type,
+			Definition: c.Definition,
+		})
+	}
+	return schema, nil
+}
+
+// DumpSchema returns the statements needed to recreate the sequences,
+// tables, constraints, indexes and views in the current schema. Other
+// objects, like functions and types, are not included.
+func (db *DB) DumpSchema() (_ []string, err error) {
+	var schema, searchPath string
+	if err = db.Get(&schema, `SELECT quote_ident(current_schema())`); err != nil {
+		return nil, errors.Wrap(err, "get current schema")
+	}
+	if err = db.Get(&searchPath, `SHOW search_path`); err != nil {
+		return nil, errors.Wrap(err, "get search_path")
+	}
+
+	// Postgres qualifies names outside the search_path in definitions, so
+	// we search only the current schema while dumping. The statements
+	// then run in any schema.
+	q := `SELECT set_config('search_path', $1, false)`
+	if _, err = db.Exec(q, schema); err != nil {
+		return nil, errors.Wrap(err, "set search_path")
 	}
 	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
+		_, rerr := db.Exec(q, searchPath)
+		if rerr != nil && err == nil {
+			err = errors.Wrap(rerr, "reset search_path")
 		}
-		err = tx.Commit()
 	}()
+	var stmts []string
 
-	// Remove the uniqueness constraint from md5
-	q := `ALTER TABLE meta DROP CONSTRAINT meta_md5_key`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "remove md5 unique")
-		return
+	// Sequences, excluding those backing identity columns, which are
+	// created with their tables
+	seqs := []struct {
+		Name      string `db:"name"`
+		Type      string `db:"type"`
+		Start     int64  `db:"start"`
+		Increment int64  `db:"increment"`
+		Min       int64  `db:"min"`
+		Max       int64  `db:"max"`
+		Cycle     bool   `db:"cycle"`
+	}{}
+	q = `
+		SELECT quote_ident(c.relname) AS name,
+			format_type(s.seqtypid, NULL) AS type,
+			s.seqstart AS start, s.seqincrement AS increment,
+			s.seqmin AS min, s.seqmax AS max, s.seqcycle AS cycle
+		FROM pg_sequence s
+		JOIN pg_class c ON c.oid = s.seqrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND NOT EXISTS (
+			SELECT 1 FROM pg_depend d
+			WHERE d.objid = c.oid AND d.deptype = 'i'
+		)
+		ORDER BY c.oid`
+	if err := db.Select(&seqs, q); err != nil {
+		return nil, errors.Wrap(err, "select sequences")
+	}
+	for _, seq := range seqs {
+		stmt := fmt.Sprintf(
+			"CREATE SEQUENCE %s AS %s INCREMENT BY %d MINVALUE %d MAXVALUE %d START WITH %d",
+			seq.Name, seq.Type, seq.Increment, seq.Min, seq.Max,
+			seq.Start)
+		if seq.Cycle {
+			stmt += " CYCLE"
+		}
+		stmts = append(stmts, stmt)
 	}
 
-	// Add a content column to record the exact migration that ran
-	// alongside the md5, insert the appropriate data, then set not null
-	q = `ALTER TABLE meta ADD COLUMN content TEXT`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "add content column")
-		return
+	// Tables
+	cols := []struct {
+		Table     string         `db:"tablename"`
+		Name      string         `db:"name"`
+		Type      string         `db:"type"`
+		NotNull   bool           `db:"notnull"`
+		Default   sql.NullString `db:"dflt"`
+		Identity  string         `db:"identity"`
+		Generated string         `db:"generated"`
+	}{}
+	q = `
+		SELECT quote_ident(c.relname) AS tablename,
+			quote_ident(a.attname) AS name,
+			format_type(a.atttypid, a.atttypmod) AS type,
+			a.attnotnull AS notnull,
+			pg_get_expr(d.adbin, d.adrelid) AS dflt,
+			a.attidentity::text AS identity,
+			a.attgenerated::text AS generated
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d
+			ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE n.nspname = current_schema() AND c.relkind = 'r'
+			AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY c.oid, a.attnum`
+	if err := db.Select(&cols, q); err != nil {
+		return nil, errors.Wrap(err, "select columns")
 	}
-	for _, m := range migrations {
-		q = `UPDATE meta SET content=$1 WHERE filename=$2`
-		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
-			err = errors.Wrap(err, "update meta content")
-			return
+	for i := 0; i < len(cols); {
+		table := cols[i].Table
+		var defs []string
+		for ; i < len(cols) && cols[i].Table == table; i++ {
+			c := cols[i]
+			def := c.Name + " " + c.Type
+			switch {
+			case c.Identity == "a":
+				def += " GENERATED ALWAYS AS IDENTITY"
+			case c.Identity == "d":
+				def += " GENERATED BY DEFAULT AS IDENTITY"
+			case c.Generated == "s":
+				def += fmt.Sprintf(" GENERATED ALWAYS AS (%s) STORED",
+					c.Default.String)
+			case c.Default.Valid:
+				def += " DEFAULT " + c.Default.String
+			}
+			if c.NotNull {
+				def += " NOT NULL"
+			}
+			defs = append(defs, "\t"+def)
+		}
+		if migrate.IsMetaTable(table) {
+			continue
 		}
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE %s (\n%s\n)",
+			table, strings.Join(defs, ",\n")))
 	}
-	q = `ALTER TABLE meta ALTER COLUMN content SET NOT NULL`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "update meta content not null")
-		return
+
+	// Sequences owned by serial columns
+	owned := []struct {
+		Sequence string `db:"sequence"`
+		Table    string `db:"tablename"`
+		Column   string `db:"col"`
+	}{}
+	q = `
+		SELECT quote_ident(s.relname) AS sequence,
+			quote_ident(t.relname) AS tablename,
+			quote_ident(a.attname) AS col
+		FROM pg_depend d
+		JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+		JOIN pg_class t ON t.oid = d.refobjid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_attribute a
+			ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+		WHERE n.nspname = current_schema() AND d.deptype = 'a'
+		ORDER BY s.oid`
+	if err := db.Select(&owned, q); err != nil {
+		return nil, errors.Wrap(err, "select owned sequences")
+	}
+	for _, o := range owned {
+		if migrate.IsMetaTable(o.Table) {
+			continue
+		}
+		stmts = append(stmts, fmt.Sprintf(
+			"ALTER SEQUENCE %s OWNED BY %s.%s", o.Sequence, o.Table,
+			o.Column))
 	}
 
-	// Add the content column to metacheckpoints
+	// Constraints, adding foreign keys last, since they depend on the
+	// primary keys and unique constraints of other tables
+	cons := []struct {
+		Table      string `db:"tablename"`
+		Name       string `db:"name"`
+		Definition string `db:"definition"`
+	}{}
 	q = `
-	ALTER TABLE metacheckpoints
-	ADD COLUMN IF NOT EXISTS content TEXT NOT NULL`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "add metacheckpoints content")
-		return
+		SELECT quote_ident(t.relname) AS tablename,
+			quote_ident(c.conname) AS name,
+			pg_get_constraintdef(c.oid) AS definition
+		FROM pg_constraint c
+		JOIN pg_class t ON t.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = current_schema()
+			AND c.contype IN ('p', 'f', 'u', 'c', 'x')
+		ORDER BY c.contype = 'f', t.oid, c.conname`
+	if err := db.Select(&cons, q); err != nil {
+		return nil, errors.Wrap(err, "select constraints")
+	}
+	for _, c := range cons {
+		if migrate.IsMetaTable(c.Table) {
+			continue
+		}
+		stmts = append(stmts, fmt.Sprintf(
+			"ALTER TABLE %s ADD CONSTRAINT %s %s", c.Table, c.Name,
+			c.Definition))
 	}
 
+	// Indexes not already created by a constraint
+	idxs := []struct {
+		Table      string `db:"tablename"`
+		Name       string `db:"name"`
+		Definition string `db:"definition"`
+	}{}
 	q = `
-	CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "create metaversion table")
-		return
+		SELECT t.relname AS tablename,
+			quote_ident(i.relname) AS name,
+			pg_get_indexdef(ix.indexrelid) AS definition
+		FROM pg_index ix
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = current_schema() AND NOT EXISTS (
+			SELECT 1 FROM pg_constraint c
+			WHERE c.conindid = ix.indexrelid
+				AND c.contype IN ('p', 'u', 'x')
+		)
+		ORDER BY ix.indexrelid`
+	if err := db.Select(&idxs, q); err != nil {
+		return nil, errors.Wrap(err, "select indexes")
 	}
-	q = `DELETE FROM metaversion`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "delete metaversion")
-		return
+	for _, idx := range idxs {
+		if migrate.IsMetaTable(idx.Table) {
+			continue
+		}
+		stmts = append(stmts,
+			unqualifyIndex(idx.Definition, idx.Name, schema))
+	}
+
+	// Views
+	views := []struct {
+		Name       string `db:"name"`
+		Definition string `db:"definition"`
+	}{}
+	q = `
+		SELECT quote_ident(c.relname) AS name,
+			pg_get_viewdef(c.oid, true) AS definition
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND c.relkind = 'v'
+		ORDER BY c.oid`
+	if err := db.Select(&views, q); err != nil {
+		return nil, errors.Wrap(err, "select views")
+	}
+	for _, v := range views {
+		def := strings.TrimSuffix(strings.TrimSpace(v.Definition), ";")
+		stmts = append(stmts, fmt.Sprintf("CREATE VIEW %s AS\n%s", v.Name,
+			def))
+	}
+	return stmts, nil
+}
+
+// unqualifyIndex removes the schema from the table in an index definition.
+// Unlike other definitions, Postgres qualifies it regardless of the
+// search_path. name and schema must be quoted as in the definition.
+func unqualifyIndex(def, name, schema string) string {
+	head := "INDEX " + name + " ON "
+	i := strings.Index(def, head)
+	if i < 0 {
+		return def
+	}
+	i += len(head)
+	if strings.HasPrefix(def[i:], "ONLY ") {
+		i += len("ONLY ")
+	}
+	return def[:i] + strings.TrimPrefix(def[i:], schema+".")
+}
+
+// Scratch creates a throwaway schema in the same database, connecting to it
+// with the same credentials. Removing it drops the schema and everything in
+// it.
+func (db *DB) Scratch() (migrate.Store, func() error, error) {
+	name, err := scratchName()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = db.Exec(`CREATE SCHEMA ` + name); err != nil {
+		return nil, nil, errors.Wrap(err, "create schema")
 	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
+	dropSchema := func() error {
+		_, err := db.Exec(`DROP SCHEMA ` + name + ` CASCADE`)
+		return errors.Wrap(err, "drop schema")
+	}
+
+	scratch := &DB{connURL: db.connURL, searchPath: name}
+	if err = scratch.Open(); err != nil {
+		_ = dropSchema()
+		return nil, nil, errors.Wrap(err, "open")
+	}
+	cleanup := func() error {
+		if err := scratch.Close(); err != nil {
+			return errors.Wrap(err, "close")
+		}
+		return dropSchema()
+	}
+	return scratch, cleanup, nil
+}
+
+// Tenant opens a Store scoped to the named schema, which must exist.
+func (db *DB) Tenant(name string) (migrate.Store, func() error, error) {
+	tenant := &DB{
+		connURL:    db.connURL,
+		searchPath: pgx.Identifier{name}.Sanitize(),
+	}
+	if err := tenant.Open(); err != nil {
+		return nil, nil, errors.Wrap(err, "open")
+	}
+	return tenant, tenant.Close, nil
+}
+
+// TenantNames runs a query which returns a schema name in each row, such as:
+//
+//	SELECT nspname FROM pg_namespace WHERE nspname LIKE 'tenant_%'
+func (db *DB) TenantNames(query string) ([]string, error) {
+	names := []string{}
+	if err := db.Select(&names, query); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Lock takes a session-level advisory lock on migrations in the current
+// schema, waiting until it's available.
+func (db *DB) Lock() error {
+	q := `SELECT pg_advisory_lock(hashtext('migrate:' || current_schema()))`
+	_, err := db.Exec(q)
+	return err
+}
+
+func (db *DB) Unlock() error {
+	q := `SELECT pg_advisory_unlock(hashtext('migrate:' || current_schema()))`
+	_, err := db.Exec(q)
+	return err
+}
+
+// quoteConnValue quotes a value in a key=value connection string.
+func quoteConnValue(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+	return "'" + s + "'"
+}
+
+func scratchName() (string, error) {
+	byt := make([]byte, 8)
+	if _, err := rand.Read(byt); err != nil {
+		return "", errors.Wrap(err, "read rand")
+	}
+	return "migrate_scratch_" + hex.EncodeToString(byt), nil
+}
+
+// MetaUpgradeSQL returns the statements which upgrade the meta tables to
+// version.
+func (db *DB) MetaUpgradeSQL(
+	version int,
+	migrations []migrate.Migration,
+) ([]migrate.MetaStatement, error) {
+	var stmts []migrate.MetaStatement
+	add := func(q string, args ...interface{}) {
+		stmts = append(stmts, migrate.MetaStatement{SQL: q, Args: args})
+	}
+	switch version {
+	case 1:
+		// Remove the uniqueness constraint from md5
+		add(`ALTER TABLE meta DROP CONSTRAINT meta_md5_key`)
+
+		// Add a content column to record the exact migration that ran
+		// alongside the md5, insert the appropriate data, then set not
+		// null
+		add(`ALTER TABLE meta ADD COLUMN content TEXT`)
+		for _, m := range migrations {
+			add(`UPDATE meta SET content=$1 WHERE filename=$2`,
+				m.Content, m.Filename)
+		}
+		add(`ALTER TABLE meta ALTER COLUMN content SET NOT NULL`)
+
+		// Add the content column to metacheckpoints
+		add(`
+			ALTER TABLE metacheckpoints
+			ADD COLUMN IF NOT EXISTS content TEXT NOT NULL`)
+	case 2:
+		// Add the release column. The version is recorded again once
+		// the upgrade completes.
+		add(`DROP TABLE metaversion`)
+		add(`CREATE TABLE metaversion (
+			version INTEGER NOT NULL,
+			migraterelease TEXT NOT NULL
+		)`)
+	default:
+		return nil, fmt.Errorf("unknown meta version %d", version)
+	}
+	return stmts, nil
+}
+
+// UpgradeMeta runs stmts in a single transaction and records v as the meta
+// version.
+func (db *DB) UpgradeMeta(
+	v migrate.MetaVersion,
+	stmts []migrate.MetaStatement,
+) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt.SQL, stmt.Args...); err != nil {
+			return errors.Wrapf(err, "exec %q", stmt.SQL)
+		}
+	}
+	q := `DELETE FROM metaversion`
 	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "insert metaversion")
-		return
+		return errors.Wrap(err, "delete metaversion")
+	}
+	q = `INSERT INTO metaversion (version, migraterelease) VALUES ($1, $2)`
+	if _, err = tx.Exec(q, v.Version, v.Release); err != nil {
+		return errors.Wrap(err, "insert metaversion")
 	}
 	return nil
 }
@@ -7,10 +7,11 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/egtann/migrate"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
@@ -26,6 +27,43 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func TestNewSSLMode(t *testing.T) {
+	// Without ssl settings, sslmode is left to PGSSLMODE or libpq
+	db := New("postgres", "", "localhost", "migrate_test", 5432, "", "",
+		"", "")
+	if strings.Contains(db.connURL, "sslmode") {
+		t.Fatalf("expected no sslmode, got %s", db.connURL)
+	}
+	db = New("", "", "", "", 0, "", "", "", "")
+	if db.connURL != "target_session_attrs='read-write'" {
+		t.Fatalf("expected settings to be left to libpq, got %s",
+			db.connURL)
+	}
+
+	db = New("postgres", "", "localhost", "migrate_test", 5432, "", "",
+		"", "ca.pem")
+	if !strings.Contains(db.connURL, "sslmode='verify-full'") ||
+		!strings.Contains(db.connURL, "sslrootcert='ca.pem'") ||
+		strings.Contains(db.connURL, "sslkey") {
+		t.Fatalf("expected verify-full with only a CA, got %s", db.connURL)
+	}
+
+	db = New("postgres", "", "localhost", "migrate_test", 5432, "require",
+		"", "", "")
+	if !strings.Contains(db.connURL, "sslmode='require'") {
+		t.Fatalf("expected sslmode=require, got %s", db.connURL)
+	}
+
+	// PGSSLMODE takes precedence over the default for ssl files
+	t.Setenv("PGSSLMODE", "verify-ca")
+	db = New("postgres", "", "localhost", "migrate_test", 5432, "", "",
+		"", "ca.pem")
+	if strings.Contains(db.connURL, "sslmode") {
+		t.Fatalf("expected sslmode to be left to PGSSLMODE, got %s",
+			db.connURL)
+	}
+}
+
 func TestCreateMetaIfNotExists(t *testing.T) {
 	db := newDB(t)
 
@@ -115,7 +153,20 @@ func TestInsertMigration(t *testing.T) {
 func TestDeleteMetaCheckpoints(t *testing.T) {
 	db := setupDBV1(t)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints(checkpointFile)
+	check(t, err)
+
+	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatal("expected 0 checkpoints")
+	}
+}
+
+func TestCompleteMigration(t *testing.T) {
+	db := setupDBV1(t)
+
+	err := db.CompleteMigration(checkpointFile, "SELECT 2;", "md5")
 	check(t, err)
 
 	mcs, err := db.GetMetaCheckpoints(checkpointFile)
@@ -123,6 +174,224 @@ func TestDeleteMetaCheckpoints(t *testing.T) {
 	if len(mcs) != 0 {
 		t.Fatal("expected 0 checkpoints")
 	}
+	filenames, err := db.GetMetaCheckpointFilenames()
+	check(t, err)
+	if len(filenames) != 0 {
+		t.Fatalf("expected no checkpoint files, got %v", filenames)
+	}
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 2 || ms[1].Filename != checkpointFile {
+		t.Fatalf("expected %s to be recorded, got %+v", checkpointFile, ms)
+	}
+}
+
+func TestReplaceMigrations(t *testing.T) {
+	db := setupDBV1(t)
+
+	err := db.InsertMigration("2.sql", "SELECT 2;", "md5")
+	check(t, err)
+
+	err = db.ReplaceMigrations([]string{"1.sql", "2.sql"}, "2_squash.sql",
+		"SELECT 1;", "md5")
+	check(t, err)
+
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "2_squash.sql" {
+		t.Fatalf("expected only 2_squash.sql, got %+v", ms)
+	}
+}
+
+func TestDumpSchema(t *testing.T) {
+	db := setupDBV1(t)
+
+	var schema string
+	err := db.Get(&schema, `SELECT current_schema()`)
+	check(t, err)
+
+	// Literals naming the schema must survive the dump
+	q := fmt.Sprintf(`
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			email TEXT NOT NULL CHECK (email <> '%s.x')
+		)`, schema)
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE INDEX users_email_idx ON users (email)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	stmts, err := db.DumpSchema()
+	check(t, err)
+	if len(stmts) == 0 || !strings.Contains(stmts[0], "CREATE TABLE") {
+		t.Fatalf("expected CREATE TABLE first, got %v", stmts)
+	}
+	all := strings.Join(stmts, "\n")
+	if !strings.Contains(all, schema+".x") {
+		t.Fatalf("expected literal %s.x, got %v", schema, stmts)
+	}
+	if strings.Contains(all, "ON "+schema+".users") {
+		t.Fatalf("expected unqualified index, got %v", stmts)
+	}
+	if !strings.Contains(stmts[len(stmts)-1], "users_email_idx") {
+		t.Fatalf("expected users_email_idx last, got %v", stmts)
+	}
+}
+
+func TestUnqualifyIndex(t *testing.T) {
+	tcs := []struct{ have, want string }{
+		{
+			have: "CREATE INDEX a_idx ON public.a USING btree (x)",
+			want: "CREATE INDEX a_idx ON a USING btree (x)",
+		},
+		{
+			have: "CREATE UNIQUE INDEX a_idx ON ONLY public.a USING btree (x)",
+			want: "CREATE UNIQUE INDEX a_idx ON ONLY a USING btree (x)",
+		},
+		{
+			have: "CREATE INDEX a_idx ON public.a USING btree (x) WHERE (y <> 'public.b'::text)",
+			want: "CREATE INDEX a_idx ON a USING btree (x) WHERE (y <> 'public.b'::text)",
+		},
+		{
+			have: "CREATE INDEX a_idx ON other.a USING btree (x)",
+			want: "CREATE INDEX a_idx ON other.a USING btree (x)",
+		},
+	}
+	for _, tc := range tcs {
+		got := unqualifyIndex(tc.have, "a_idx", "public")
+		if got != tc.want {
+			t.Fatalf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	db := setupDBV1(t)
+
+	q := `
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			email VARCHAR(255) UNIQUE NOT NULL
+		)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE INDEX users_email_idx ON users (id, email)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	schema, err := db.Schema()
+	check(t, err)
+	if len(schema.Tables) != 1 {
+		t.Fatalf("expected 1 table, got %d", len(schema.Tables))
+	}
+	users := schema.Tables["users"]
+	if len(users.Columns) != 2 {
+		t.Fatalf("expected 2 columns, got %d", len(users.Columns))
+	}
+	if len(users.Constraints) != 2 {
+		t.Fatalf("expected 2 constraints, got %+v", users.Constraints)
+	}
+	var found bool
+	for _, idx := range users.Indexes {
+		if idx.Name == "users_email_idx" && len(idx.Columns) == 2 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("missing users_email_idx in %+v", users.Indexes)
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	db := newDB(t)
+	db.SetMaxOpenConns(1)
+
+	var def string
+	err := db.Get(&def, `SHOW lock_timeout`)
+	check(t, err)
+
+	err = db.SetTimeouts(time.Second, 250*time.Millisecond)
+	check(t, err)
+
+	var timeout string
+	err = db.Get(&timeout, `SHOW lock_timeout`)
+	check(t, err)
+	if timeout != "250ms" {
+		t.Fatalf("expected lock_timeout 250ms, got %s", timeout)
+	}
+
+	err = db.SetTimeouts(0, 0)
+	check(t, err)
+	err = db.Get(&timeout, `SHOW lock_timeout`)
+	check(t, err)
+	if timeout != def {
+		t.Fatalf("expected lock_timeout %s, got %s", def, timeout)
+	}
+}
+
+func TestLock(t *testing.T) {
+	db := newDB(t)
+	db.SetMaxOpenConns(1)
+
+	err := db.Lock()
+	check(t, err)
+	err = db.Unlock()
+	check(t, err)
+}
+
+func TestCopyFrom(t *testing.T) {
+	db := newDB(t)
+	db.SetMaxOpenConns(1)
+
+	dir := t.TempDir()
+	content := "CREATE TABLE posts (id INTEGER, title TEXT);\n" +
+		"COPY posts (id, title) FROM STDIN;\n" +
+		"1\ta; b\n" +
+		"2\tc\n" +
+		"\\.\n" +
+		"INSERT INTO posts (id, title) VALUES (3, 'd');\n"
+	err := os.WriteFile(filepath.Join(dir, "1.sql"), []byte(content), 0644)
+	check(t, err)
+
+	m, err := migrate.New(db, migrate.WithDir(dir))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+
+	var titles []string
+	err = db.Select(&titles, `SELECT title FROM posts ORDER BY id`)
+	check(t, err)
+	if strings.Join(titles, ",") != "a; b,c,d" {
+		t.Fatalf("expected a; b,c,d, got %v", titles)
+	}
+}
+
+func TestDescribeError(t *testing.T) {
+	db := newDB(t)
+	db.SetMaxOpenConns(1)
+
+	dir := t.TempDir()
+	content := "CREATE TABLE posts (id INTEGER);\n" +
+		"SELECT id,\n" +
+		"\tmissing\n" +
+		"FROM posts;\n"
+	err := os.WriteFile(filepath.Join(dir, "1.sql"), []byte(content), 0644)
+	check(t, err)
+
+	m, err := migrate.New(db, migrate.WithDir(dir))
+	check(t, err)
+	_, err = m.Migrate()
+	var stmtErr *migrate.StatementError
+	if !errors.As(err, &stmtErr) {
+		t.Fatalf("expected statement error, got %v", err)
+	}
+	if stmtErr.Code != "42703" || stmtErr.Line != 2 ||
+		stmtErr.ErrorLine != 3 {
+		t.Fatalf("expected undefined column on line 3, got %+v", stmtErr)
+	}
 }
 
 func check(t *testing.T, err error) {
@@ -165,7 +434,7 @@ func parseEnv(filename string) error {
 }
 
 func createDBAndOpen(t *testing.T) *sqlx.DB {
-	db, err := sqlx.Open("postgres", dsnForDB(""))
+	db, err := sqlx.Open("pgx", dsnForDB(""))
 	check(t, err)
 
 	q := `DROP DATABASE IF EXISTS migrate_test`
@@ -179,7 +448,7 @@ func createDBAndOpen(t *testing.T) *sqlx.DB {
 	err = db.Close()
 	check(t, err)
 
-	db, err = sqlx.Open("postgres", dsnForDB("migrate_test"))
+	db, err = sqlx.Open("pgx", dsnForDB("migrate_test"))
 	check(t, err)
 
 	t.Cleanup(teardown(db))
@@ -211,7 +480,7 @@ func teardown(db *sqlx.DB) func() {
 		}
 
 		var err error
-		db, err = sqlx.Open("postgres", dsnForDB(""))
+		db, err = sqlx.Open("pgx", dsnForDB(""))
 		if err != nil {
 			return
 		}
@@ -227,12 +496,16 @@ func teardown(db *sqlx.DB) func() {
 
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
-	err := db.UpgradeToV1([]migrate.Migration{{
+	_, err := db.CreateMetaVersionIfNotExists()
+	check(t, err)
+	stmts, err := db.MetaUpgradeSQL(1, []migrate.Migration{{
 		Filename: "1.sql",
 		Checksum: "md5",
 		Content:  "SELECT 1;",
 	}})
 	check(t, err)
+	err = db.UpgradeMeta(migrate.MetaVersion{Version: 1}, stmts)
+	check(t, err)
 
 	q := `
 		INSERT INTO metacheckpoints (idx, filename, content, md5)
@@ -0,0 +1,269 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Introspector is implemented by Stores which can describe their schema. It's
+// used to detect drift between a live database and the schema that its
+// migration files describe.
+type Introspector interface {
+	// Schema describes the tables in the database, excluding migrate's
+	// own meta tables.
+	Schema() (*Schema, error)
+
+	// Scratch creates an empty, throwaway database of the same type
+	// alongside this one, such as a temporary file or a new schema on
+	// the same server. The returned Store has already been opened. Call
+	// the returned function to close and remove it.
+	Scratch() (Store, func() error, error)
+}
+
+// Schema describes the tables in a database.
+type Schema struct {
+	Tables map[string]*Table
+}
+
+// Table describes a single table. Columns are in their defined order.
+// Indexes and constraints are sorted by name.
+type Table struct {
+	Name        string
+	Columns     []Column
+	Indexes     []Index
+	Constraints []Constraint
+}
+
+type Column struct {
+	Name     string
+	Type     string
+	Nullable bool
+	Default  string
+}
+
+type Index struct {
+	Name    string
+	Columns []string
+	Unique  bool
+}
+
+// Constraint describes a table constraint. Type is one of PRIMARY KEY,
+// FOREIGN KEY, UNIQUE, or CHECK, and Definition is the dialect's description
+// of it, such as "(id)" or "FOREIGN KEY (userid) REFERENCES users(id)".
+// Some databases, like sqlite, don't name constraints, in which case Name is
+// empty.
+type Constraint struct {
+	Name       string
+	Type       string
+	Definition string
+}
+
+// metaTables are created and managed by migrate itself, so they're excluded
+// from schema comparisons.
+var metaTables = map[string]struct{}{
+	"meta":            {},
+	"metacheckpoints": {},
+	"metaversion":     {},
+}
+
+// IsMetaTable reports whether the table is one of migrate's meta tables.
+// Stores use this to exclude them from their Schema.
+func IsMetaTable(name string) bool {
+	_, ok := metaTables[name]
+	return ok
+}
+
+// NewSchema returns an empty Schema.
+func NewSchema() *Schema {
+	return &Schema{Tables: map[string]*Table{}}
+}
+
+// Table returns the named table, creating it if it does not already exist.
+func (s *Schema) Table(name string) *Table {
+	t, ok := s.Tables[name]
+	if !ok {
+		t = &Table{Name: name}
+		s.Tables[name] = t
+	}
+	return t
+}
+
+// Drift migrates a throwaway scratch database from the migration files, then
+// compares its schema to that of db. It reports every difference found. An
+// empty result means that db matches its migrations. db must implement
+// Introspector. opts are passed to New when migrating the scratch database.
+func Drift(db Store, opts ...Option) (diffs []string, err error) {
+	live, ok := db.(Introspector)
+	if !ok {
+		return nil, errors.New("store does not support introspection")
+	}
+	scratch, cleanup, err := live.Scratch()
+	if err != nil {
+		return nil, errors.Wrap(err, "create scratch db")
+	}
+	defer func() {
+		if err2 := cleanup(); err2 != nil && err == nil {
+			err = errors.Wrap(err2, "remove scratch db")
+		}
+	}()
+
+	m, err := New(scratch, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "new scratch")
+	}
+	if _, err = m.Migrate(); err != nil {
+		return nil, errors.Wrap(err, "migrate scratch")
+	}
+
+	want, err := scratch.(Introspector).Schema()
+	if err != nil {
+		return nil, errors.Wrap(err, "scratch schema")
+	}
+	got, err := live.Schema()
+	if err != nil {
+		return nil, errors.Wrap(err, "schema")
+	}
+	return Diff(want, got), nil
+}
+
+// Diff reports the differences between the schema we want, as described by
+// the migration files, and the schema we got in a live database.
+func Diff(want, got *Schema) []string {
+	var diffs []string
+	for _, name := range tableNames(want, got) {
+		w, inWant := want.Tables[name]
+		g, inGot := got.Tables[name]
+		switch {
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("table %s is missing", name))
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf(
+				"table %s is not in the migrations", name))
+		default:
+			diffs = append(diffs, diffTable(w, g)...)
+		}
+	}
+	return diffs
+}
+
+func diffTable(want, got *Table) []string {
+	var diffs []string
+	add := func(format string, vs ...interface{}) {
+		diffs = append(diffs, want.Name+": "+fmt.Sprintf(format, vs...))
+	}
+
+	// Columns
+	gotCols := map[string]Column{}
+	for _, c := range got.Columns {
+		gotCols[c.Name] = c
+	}
+	wantCols := map[string]struct{}{}
+	for _, w := range want.Columns {
+		wantCols[w.Name] = struct{}{}
+		g, ok := gotCols[w.Name]
+		if !ok {
+			add("column %s is missing", w.Name)
+			continue
+		}
+		if !strings.EqualFold(g.Type, w.Type) {
+			add("column %s has type %s, want %s", w.Name, g.Type, w.Type)
+		}
+		if g.Nullable != w.Nullable {
+			add("column %s has nullable %t, want %t", w.Name,
+				g.Nullable, w.Nullable)
+		}
+		if g.Default != w.Default {
+			add("column %s has default %q, want %q", w.Name,
+				g.Default, w.Default)
+		}
+	}
+	for _, g := range got.Columns {
+		if _, ok := wantCols[g.Name]; !ok {
+			add("column %s is not in the migrations", g.Name)
+		}
+	}
+
+	// Indexes
+	gotIdxs := map[string]Index{}
+	for _, idx := range got.Indexes {
+		gotIdxs[idx.Name] = idx
+	}
+	wantIdxs := map[string]struct{}{}
+	for _, w := range want.Indexes {
+		wantIdxs[w.Name] = struct{}{}
+		g, ok := gotIdxs[w.Name]
+		if !ok {
+			add("index %s is missing", w.Name)
+			continue
+		}
+		gotDef := strings.Join(g.Columns, ", ")
+		wantDef := strings.Join(w.Columns, ", ")
+		if gotDef != wantDef {
+			add("index %s is on (%s), want (%s)", w.Name, gotDef, wantDef)
+		}
+		if g.Unique != w.Unique {
+			add("index %s has unique %t, want %t", w.Name, g.Unique,
+				w.Unique)
+		}
+	}
+	for _, g := range got.Indexes {
+		if _, ok := wantIdxs[g.Name]; !ok {
+			add("index %s is not in the migrations", g.Name)
+		}
+	}
+
+	// Constraints. Unnamed constraints are identified by their
+	// definition, so a changed unnamed constraint is reported as one
+	// missing and one extra.
+	gotCons := map[string]Constraint{}
+	for _, c := range got.Constraints {
+		gotCons[c.key()] = c
+	}
+	wantCons := map[string]struct{}{}
+	for _, w := range want.Constraints {
+		wantCons[w.key()] = struct{}{}
+		g, ok := gotCons[w.key()]
+		if !ok {
+			add("%s constraint %s is missing", w.Type, w.key())
+			continue
+		}
+		if g.Type != w.Type || g.Definition != w.Definition {
+			add("constraint %s is %s %s, want %s %s", w.Name, g.Type,
+				g.Definition, w.Type, w.Definition)
+		}
+	}
+	for _, g := range got.Constraints {
+		if _, ok := wantCons[g.key()]; !ok {
+			add("%s constraint %s is not in the migrations", g.Type,
+				g.key())
+		}
+	}
+	return diffs
+}
+
+func (c Constraint) key() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Definition
+}
+
+// tableNames returns the sorted union of table names in both schemas.
+func tableNames(a, b *Schema) []string {
+	seen := map[string]struct{}{}
+	var names []string
+	for _, s := range []*Schema{a, b} {
+		for name := range s.Tables {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,25 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package sqlite
+
+import (
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// driverName is github.com/mattn/go-sqlite3, which requires cgo. Build with
+// the purego tag, or with cgo disabled, to use a driver which doesn't. Pragmas
+// may be set in the DSN, such as
+// "app.db?_journal_mode=WAL&_foreign_keys=1&_busy_timeout=5000".
+const driverName = "sqlite3"
+
+// isBusy reports whether err was caused by a locked database.
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy ||
+		sqliteErr.Code == sqlite3.ErrLocked
+}
@@ -0,0 +1,6 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package sqlite
+
+const pragmaDSN = "?_journal_mode=WAL&_foreign_keys=1&_busy_timeout=5000"
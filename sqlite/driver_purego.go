@@ -0,0 +1,28 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package sqlite
+
+import (
+	"github.com/pkg/errors"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// driverName is modernc.org/sqlite, which doesn't require cgo, for static
+// builds and cross-compiling. It's used with the purego tag or when cgo is
+// disabled. Pragmas may be set in the DSN, such as
+// "app.db?_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)".
+const driverName = "sqlite"
+
+// isBusy reports whether err was caused by a locked database.
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	// Extended result codes keep the primary code in the low byte
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
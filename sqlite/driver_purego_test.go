@@ -0,0 +1,6 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package sqlite
+
+const pragmaDSN = "?_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
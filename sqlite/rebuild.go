@@ -0,0 +1,245 @@
+package sqlite
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// regexCreateTable matches the start of a CREATE TABLE statement, capturing
+// the table name.
+var regexCreateTable = regexp.MustCompile("(?is)^\\s*CREATE\\s+TABLE\\s+" +
+	"(\"(?:[^\"]|\"\")+\"|`[^`]+`|\\[[^\\]]+\\]|[A-Za-z_][A-Za-z0-9_$]*)\\s*\\(")
+
+// RebuildTable changes table to match create, a CREATE TABLE statement for
+// the same table, using the procedure from
+// https://www.sqlite.org/lang_altertable.html#otheralter. This allows changes
+// which ALTER TABLE can't make, such as dropping constraints or changing
+// column types. Columns which exist in both the old and new tables are
+// copied. The table's indexes and triggers and every view are recreated.
+//
+// Foreign keys are disabled while rebuilding, then checked. sqlite can't
+// disable them within a transaction, so if they're enforced, rebuild outside
+// of migrate.WithTransactions.
+func (db *DB) RebuildTable(table, create string) (err error) {
+	// 1. Disable foreign keys, so dropping the table doesn't cascade
+	var foreignKeys bool
+	if err = db.Get(&foreignKeys, `PRAGMA foreign_keys`); err != nil {
+		return errors.Wrap(err, "get foreign_keys")
+	}
+	if foreignKeys {
+		if db.inTx {
+			return fmt.Errorf("rebuild %s: foreign keys can't be disabled within a transaction",
+				table)
+		}
+		if _, err = db.Exec(`PRAGMA foreign_keys = OFF`); err != nil {
+			return errors.Wrap(err, "disable foreign keys")
+		}
+
+		// 12. Enable foreign keys again
+		defer func() {
+			_, err2 := db.Exec(`PRAGMA foreign_keys = ON`)
+			if err2 != nil && err == nil {
+				err = errors.Wrap(err2, "enable foreign keys")
+			}
+		}()
+	}
+
+	// 2. Start a transaction, unless we're already in one
+	var ex sqlx.Ext = db.DB
+	if !db.inTx {
+		var tx *sqlx.Tx
+		tx, err = db.Beginx()
+		if err != nil {
+			return errors.Wrap(err, "begin tx")
+		}
+
+		// 11. Commit
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+		ex = tx
+	}
+
+	// Copy the columns the tables share, which we learn by creating the
+	// new table and dropping it again
+	tmpCreate, err := rebuildCreate(table, create)
+	if err != nil {
+		return err
+	}
+	if _, err = ex.Exec(tmpCreate); err != nil {
+		return errors.Wrap(err, "create table")
+	}
+	tmp := "migrate_rebuild_" + table
+	newCols, err := columnNames(ex, tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = ex.Exec(`DROP TABLE ` + quoteIdent(tmp)); err != nil {
+		return errors.Wrap(err, "drop table")
+	}
+	oldCols, err := columnNames(ex, table)
+	if err != nil {
+		return err
+	}
+	has := map[string]bool{}
+	for _, col := range oldCols {
+		has[strings.ToLower(col)] = true
+	}
+	var cols []string
+	for _, col := range newCols {
+		if has[strings.ToLower(col)] {
+			cols = append(cols, col)
+		}
+	}
+
+	// 3 to 9. Rebuild the table
+	stmts, err := rebuildSQL(ex, table, create, cols)
+	if err != nil {
+		return err
+	}
+	for _, q := range stmts {
+		if _, err = ex.Exec(q); err != nil {
+			return errors.Wrapf(err, "exec %q", q)
+		}
+	}
+
+	// 10. Confirm the new table didn't break any foreign keys
+	if foreignKeys {
+		if err = foreignKeyCheck(ex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildSQL returns the statements which rebuild table to match create,
+// copying cols from the old table: steps 3 to 9 of RebuildTable, which must
+// run within a transaction. It reads the table's indexes and triggers, and
+// every view, from ex.
+func rebuildSQL(
+	ex sqlx.Queryer,
+	table, create string,
+	cols []string,
+) ([]string, error) {
+	tmpCreate, err := rebuildCreate(table, create)
+	if err != nil {
+		return nil, err
+	}
+	tmp := "migrate_rebuild_" + table
+
+	// 3. Remember the table's indexes and triggers, and every view, in
+	// the order they were created. Indexes created by constraints have no
+	// SQL, and are recreated with the table.
+	var objects []struct {
+		Type string `db:"type"`
+		Name string `db:"name"`
+		SQL  string `db:"sql"`
+	}
+	q := `
+		SELECT type, name, sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND (type = 'view' OR
+			(type IN ('index', 'trigger') AND tbl_name = $1 COLLATE NOCASE))
+		ORDER BY rowid`
+	if err = sqlx.Select(ex, &objects, q, table); err != nil {
+		return nil, errors.Wrap(err, "get schema")
+	}
+	var legacy bool
+	if err = sqlx.Get(ex, &legacy, `PRAGMA legacy_alter_table`); err != nil {
+		return nil, errors.Wrap(err, "get legacy_alter_table")
+	}
+
+	// Views may refer to the table, which would stop us from renaming the
+	// new one, so they're dropped and recreated
+	var stmts []string
+	for _, o := range objects {
+		if o.Type == "view" {
+			stmts = append(stmts, `DROP VIEW `+quoteIdent(o.Name))
+		}
+	}
+
+	// 4. Create the new table
+	stmts = append(stmts, tmpCreate)
+
+	// 5. Copy the columns the tables share
+	if len(cols) > 0 {
+		quoted := make([]string, 0, len(cols))
+		for _, col := range cols {
+			quoted = append(quoted, quoteIdent(col))
+		}
+		colList := strings.Join(quoted, ", ")
+		stmts = append(stmts, fmt.Sprintf(
+			`INSERT INTO %s (%s) SELECT %s FROM %s`, quoteIdent(tmp),
+			colList, colList, quoteIdent(table)))
+	}
+
+	// 6. Drop the old table
+	stmts = append(stmts, `DROP TABLE `+quoteIdent(table))
+
+	// 7. Rename the new table. Legacy renames leave references to the
+	// table's name in other tables' foreign keys and triggers untouched,
+	// which now point to the new table.
+	if !legacy {
+		stmts = append(stmts, `PRAGMA legacy_alter_table = ON`)
+	}
+	stmts = append(stmts, fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`,
+		quoteIdent(tmp), quoteIdent(table)))
+	if !legacy {
+		stmts = append(stmts, `PRAGMA legacy_alter_table = OFF`)
+	}
+
+	// 8 and 9. Recreate the indexes, triggers and views
+	for _, o := range objects {
+		stmts = append(stmts, o.SQL)
+	}
+	return stmts, nil
+}
+
+// rebuildCreate confirms that create is a CREATE TABLE statement for table,
+// and returns it creating the temporary table which replaces it instead.
+func rebuildCreate(table, create string) (string, error) {
+	loc := regexCreateTable.FindStringSubmatchIndex(create)
+	if loc == nil {
+		return "", errors.New("rebuild requires a CREATE TABLE statement")
+	}
+	if name := unquoteIdent(create[loc[2]:loc[3]]); !strings.EqualFold(
+		name, table) {
+		return "", fmt.Errorf("rebuild %s with CREATE TABLE %s", table,
+			name)
+	}
+	tmp := "migrate_rebuild_" + table
+	return create[:loc[2]] + quoteIdent(tmp) + create[loc[3]:], nil
+}
+
+// columnNames returns the names of a table's columns, in order.
+func columnNames(ex sqlx.Queryer, table string) ([]string, error) {
+	var cols []string
+	q := `SELECT name FROM pragma_table_info($1) ORDER BY cid`
+	if err := sqlx.Select(ex, &cols, q, table); err != nil {
+		return nil, errors.Wrapf(err, "get columns of %s", table)
+	}
+	return cols, nil
+}
+
+// unquoteIdent removes the quotes sqlite accepts around an identifier.
+func unquoteIdent(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+	switch s[0] {
+	case '"':
+		return strings.Replace(s[1:len(s)-1], `""`, `"`, -1)
+	case '`':
+		return s[1 : len(s)-1]
+	case '[':
+		return s[1 : len(s)-1]
+	}
+	return s
+}
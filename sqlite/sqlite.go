@@ -2,23 +2,102 @@ package sqlite
 
 import (
 	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/egtann/migrate"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// regexPragmaValue matches the values accepted by Options, which are
+// interpolated into PRAGMA statements.
+var regexPragmaValue = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
 type DB struct {
 	filepath string
+	opts     []Option
+
+	// pragmas are set by Open, in order.
+	pragmas []pragma
+
+	// checks runs foreign_key_check and integrity_check before recording
+	// each file.
+	checks bool
+
+	// busyTimeout is the busy_timeout in milliseconds once Open has set
+	// any pragmas, which SetTimeouts restores without a lock timeout.
+	busyTimeout int64
+
+	// inTx is set between BeginMigration and CommitMigration or
+	// RollbackMigration.
+	inTx bool
 
 	// Embed the sqlx DB struct
 	*sqlx.DB
 }
 
-func New(dbFile string) *DB {
-	return &DB{filepath: dbFile}
+// Option configures a DB.
+type Option func(*DB)
+
+type pragma struct {
+	name, value string
+}
+
+// WithForeignKeys enforces foreign key constraints, which sqlite ignores by
+// default.
+func WithForeignKeys() Option {
+	return func(db *DB) {
+		db.pragmas = append(db.pragmas, pragma{"foreign_keys", "ON"})
+	}
+}
+
+// WithJournalMode sets the journal mode, such as WAL, which lets readers
+// continue while migrating.
+func WithJournalMode(mode string) Option {
+	return func(db *DB) {
+		db.pragmas = append(db.pragmas, pragma{"journal_mode", mode})
+	}
+}
+
+// WithBusyTimeout sets how long statements wait on a locked database before
+// failing with SQLITE_BUSY. migrate.WithLockTimeout, or a lock-timeout
+// directive, overrides it while set.
+func WithBusyTimeout(d time.Duration) Option {
+	return func(db *DB) {
+		db.pragmas = append(db.pragmas, pragma{"busy_timeout",
+			strconv.FormatInt(d.Milliseconds(), 10)})
+	}
+}
+
+// WithSynchronous sets how often sqlite syncs to disk: OFF, NORMAL, FULL or
+// EXTRA.
+func WithSynchronous(level string) Option {
+	return func(db *DB) {
+		db.pragmas = append(db.pragmas, pragma{"synchronous", level})
+	}
+}
+
+// WithChecks runs PRAGMA foreign_key_check and integrity_check after each
+// migration file, and fails the file if either finds a problem. The file is
+// not recorded as migrated, and with migrate.WithTransactions its changes are
+// rolled back.
+func WithChecks() Option {
+	return func(db *DB) { db.checks = true }
+}
+
+func New(dbFile string, opts ...Option) *DB {
+	db := &DB{filepath: dbFile, opts: opts}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
 }
 
 func (db *DB) CreateMetaIfNotExists() error {
@@ -72,6 +151,37 @@ func (db *DB) UpsertMigration(filename, content, checksum string) error {
 	return err
 }
 
+func (db *DB) ReplaceMigrations(
+	old []string,
+	filename, content, checksum string,
+) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	q := `DELETE FROM meta WHERE filename=$1`
+	for _, name := range old {
+		if _, err = tx.Exec(q, name); err != nil {
+			err = errors.Wrapf(err, "delete %s", name)
+			return
+		}
+	}
+	q = `INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)`
+	if _, err = tx.Exec(q, filename, content, checksum); err != nil {
+		err = errors.Wrap(err, "insert migration")
+		return
+	}
+	return nil
+}
+
 func (db *DB) InsertMetaCheckpoint(
 	filename, content, checksum string,
 	idx int,
@@ -89,171 +199,522 @@ func (db *DB) InsertMigration(filename, content, checksum string) error {
 	return err
 }
 
-func (db *DB) DeleteMetaCheckpoints() error {
-	q := `DELETE FROM metacheckpoints`
-	_, err := db.Exec(q)
+func (db *DB) DeleteMetaCheckpoints(filename string) error {
+	q := `DELETE FROM metacheckpoints WHERE filename=$1`
+	_, err := db.Exec(q, filename)
 	return err
 }
 
-func (db *DB) CreateMetaVersionIfNotExists() (int, error) {
+func (db *DB) GetMetaCheckpointFilenames() ([]string, error) {
+	filenames := []string{}
+	q := `SELECT DISTINCT filename FROM metacheckpoints`
+	err := db.Select(&filenames, q)
+	return filenames, err
+}
+
+// CompleteMigration deletes a file's checkpoints and records it in meta in a
+// single transaction, or within the current one after BeginMigration.
+func (db *DB) CompleteMigration(
+	filename, content, checksum string,
+) (err error) {
+	var ex sqlx.Ext = db.DB
+	if !db.inTx {
+		var tx *sqlx.Tx
+		tx, err = db.Beginx()
+		if err != nil {
+			return errors.Wrap(err, "begin tx")
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+		ex = tx
+	}
+
+	if db.checks {
+		if err = runChecks(ex); err != nil {
+			return err
+		}
+	}
+	q := `DELETE FROM metacheckpoints WHERE filename=$1`
+	if _, err = ex.Exec(q, filename); err != nil {
+		return errors.Wrap(err, "delete checkpoints")
+	}
+	q = `
+		INSERT INTO meta (filename, content, md5) VALUES ($1, $2, $3)
+		ON CONFLICT(filename) DO UPDATE SET md5=$4, content=$5`
+	_, err = ex.Exec(q, filename, content, checksum, checksum, content)
+	if err != nil {
+		return errors.Wrap(err, "upsert migration")
+	}
+	return nil
+}
+
+func (db *DB) MetaExists() (bool, error) {
+	var n int
+	q := `SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='meta'`
+	if err := db.Get(&n, q); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (db *DB) CreateMetaVersionIfNotExists() (migrate.MetaVersion, error) {
 	q := `CREATE TABLE IF NOT EXISTS metaversion (
-		version INTEGER NOT NULL
+		version INTEGER NOT NULL,
+		migraterelease TEXT NOT NULL
 	)`
 	if _, err := db.Exec(q); err != nil {
-		return 0, errors.Wrap(err, "create metaversion table")
+		return migrate.MetaVersion{}, errors.Wrap(err,
+			"create metaversion table")
+	}
+	return db.GetMetaVersion()
+}
+
+// GetMetaVersion reports the version of the meta tables without changing
+// them. It's zero if there's no metaversion table.
+func (db *DB) GetMetaVersion() (migrate.MetaVersion, error) {
+	var v migrate.MetaVersion
+	var n int
+	q := `SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='metaversion'`
+	if err := db.Get(&n, q); err != nil {
+		return v, errors.Wrap(err, "metaversion exists")
+	}
+	if n == 0 {
+		return v, nil
 	}
 
-	var version int
-	q = `SELECT version FROM metaversion`
-	err := db.Get(&version, q)
+	// Tables from before v2 have no release column
+	q = `SELECT * FROM metaversion`
+	err := db.Get(&v, q)
 	switch {
 	case err == sql.ErrNoRows:
-		return 0, nil
+		return v, nil
 	case err != nil:
-		return 0, errors.Wrap(err, "get version")
+		return v, errors.Wrap(err, "get version")
 	}
-	return version, nil
+	return v, nil
 }
 
 func (db *DB) Open() error {
 	var err error
-	db.DB, err = sqlx.Open("sqlite3", db.filepath)
+	db.DB, err = sqlx.Open(driverName, db.filepath)
 	if err != nil {
 		return errors.Wrap(err, "open db connection")
 	}
+
+	// Use a single connection, so settings like timeouts apply to every
+	// statement
+	db.SetMaxOpenConns(1)
+
+	for _, p := range db.pragmas {
+		if !regexPragmaValue.MatchString(p.value) {
+			_ = db.Close()
+			return fmt.Errorf("invalid %s: %q", p.name, p.value)
+		}
+		q := fmt.Sprintf(`PRAGMA %s = %s`, p.name, p.value)
+		if _, err = db.Exec(q); err != nil {
+			_ = db.Close()
+			return errors.Wrapf(err, "set %s", p.name)
+		}
+	}
+	if err = db.Get(&db.busyTimeout, `PRAGMA busy_timeout`); err != nil {
+		_ = db.Close()
+		return errors.Wrap(err, "get busy_timeout")
+	}
 	return nil
 }
 
-// UpgradeToV1 migrates existing meta tables to the v1 format. Complete any
-// migrations before running this function; this will not succeed if have any
-// existing metacheckpoints.
-func (db *DB) UpgradeToV1(migrations []migrate.Migration) (err error) {
-	// Begin Tx
-	tx, err := db.Beginx()
-	if err != nil {
-		return errors.Wrap(err, "begin tx")
+// runChecks runs foreign_key_check and integrity_check, returning a
+// *CheckError describing any problems.
+func runChecks(ex sqlx.Queryer) error {
+	if err := foreignKeyCheck(ex); err != nil {
+		return err
 	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-			return
+	var problems []string
+	if err := sqlx.Select(ex, &problems, `PRAGMA integrity_check`); err != nil {
+		return errors.Wrap(err, "integrity check")
+	}
+	if len(problems) != 1 || problems[0] != "ok" {
+		return &CheckError{Check: "integrity_check", Problems: problems}
+	}
+	return nil
+}
+
+// foreignKeyCheck returns a *CheckError describing any rows which violate
+// foreign key constraints.
+func foreignKeyCheck(ex sqlx.Queryer) error {
+	var fks []struct {
+		Table  string        `db:"table"`
+		RowID  sql.NullInt64 `db:"rowid"`
+		Parent string        `db:"parent"`
+		FKID   int           `db:"fkid"`
+	}
+	if err := sqlx.Select(ex, &fks, `PRAGMA foreign_key_check`); err != nil {
+		return errors.Wrap(err, "foreign key check")
+	}
+	if len(fks) > 0 {
+		e := &CheckError{Check: "foreign_key_check"}
+		for _, fk := range fks {
+			e.Problems = append(e.Problems, fmt.Sprintf(
+				"%s row %d violates foreign key %d to %s",
+				fk.Table, fk.RowID.Int64, fk.FKID, fk.Parent))
 		}
-		err = tx.Commit()
-	}()
+		return e
+	}
+	return nil
+}
 
-	// Remove the uniqueness constraint from md5. sqlite doesn't support
-	// MODIFY COLUMN so we recreate the table.
-	q := `CREATE TABLE metatmp (
-		filename TEXT UNIQUE NOT NULL,
-		md5 TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-	)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "create metatmp")
-		return
+// CheckError is returned when a migration file fails WithChecks, or a
+// rebuilt table violates foreign key constraints.
+type CheckError struct {
+	Check    string
+	Problems []string
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Check,
+		strings.Join(e.Problems, "; "))
+}
+
+// SetTimeouts sets how long statements wait on a locked database. Without a
+// lock timeout, it restores the busy_timeout set when the database was
+// opened, such as by WithBusyTimeout. sqlite has no statement timeout of its
+// own, so that's enforced only by migrate canceling the statement.
+func (db *DB) SetTimeouts(statement, lock time.Duration) error {
+	ms := db.busyTimeout
+	if lock > 0 {
+		ms = lock.Milliseconds()
 	}
-	q = `INSERT INTO metatmp SELECT filename, md5, createdat FROM meta`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "insert metatmp")
+	q := fmt.Sprintf(`PRAGMA busy_timeout = %d`, ms)
+	if _, err := db.Exec(q); err != nil {
+		return errors.Wrap(err, "set busy_timeout")
 	}
-	q = `DROP TABLE meta`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "drop meta")
+	return nil
+}
+
+// BeginMigration starts a transaction on the single open connection.
+func (db *DB) BeginMigration() error {
+	_, err := db.Exec(`BEGIN`)
+	db.inTx = err == nil
+	return err
+}
+
+func (db *DB) CommitMigration() error {
+	_, err := db.Exec(`COMMIT`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) RollbackMigration() error {
+	_, err := db.Exec(`ROLLBACK`)
+	db.inTx = false
+	return err
+}
+
+func (db *DB) IsLockTimeout(err error) bool {
+	return isBusy(err)
+}
+
+// Schema describes the tables in the database. sqlite does not report CHECK
+// constraints, so those are not included.
+func (db *DB) Schema() (*migrate.Schema, error) {
+	tables := []string{}
+	q := `
+		SELECT name FROM sqlite_master
+		WHERE type='table' AND name NOT LIKE 'sqlite_%'`
+	if err := db.Select(&tables, q); err != nil {
+		return nil, errors.Wrap(err, "select tables")
 	}
-	q = `ALTER TABLE metatmp RENAME TO meta`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "rename metatmp 1")
-		return
+	schema := migrate.NewSchema()
+	for _, name := range tables {
+		if migrate.IsMetaTable(name) {
+			continue
+		}
+		t := schema.Table(name)
+		if err := db.describeTable(t); err != nil {
+			return nil, errors.Wrapf(err, "describe %s", name)
+		}
 	}
+	return schema, nil
+}
 
-	// Add a content column to record the exact migration that ran
-	// alongside the md5, insert the appropriate data, then set not null
-	q = `ALTER TABLE meta ADD COLUMN content TEXT`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "add content column")
-		return
+func (db *DB) describeTable(t *migrate.Table) error {
+	cols := []struct {
+		CID     int            `db:"cid"`
+		Name    string         `db:"name"`
+		Type    string         `db:"type"`
+		NotNull bool           `db:"notnull"`
+		Default sql.NullString `db:"dflt_value"`
+		PK      int            `db:"pk"`
+	}{}
+	q := fmt.Sprintf(`PRAGMA table_info(%s)`, quoteIdent(t.Name))
+	if err := db.Select(&cols, q); err != nil {
+		return errors.Wrap(err, "table info")
 	}
-	for _, m := range migrations {
-		q = `UPDATE meta SET content=$1 WHERE filename=$2`
-		if _, err = tx.Exec(q, m.Content, m.Filename); err != nil {
-			err = errors.Wrap(err, "update meta content")
-			return
+	var pk []string
+	for _, c := range cols {
+		t.Columns = append(t.Columns, migrate.Column{
+			Name:     c.Name,
+			Type:     c.Type,
+			Nullable: !c.NotNull,
+			Default:  c.Default.String,
+		})
+		if c.PK > 0 {
+			pk = append(pk, c.Name)
 		}
 	}
+	if len(pk) > 0 {
+		t.Constraints = append(t.Constraints, migrate.Constraint{
+			Type:       "PRIMARY KEY",
+			Definition: fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(pk, ", ")),
+		})
+	}
 
-	// Once again, sqlite3 doesn't support modify column, so we have to
-	// recreate our tables
-	q = `CREATE TABLE metatmp (
-		filename TEXT UNIQUE NOT NULL,
-		content TEXT NOT NULL,
-		md5 TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
-	)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "create metatmp")
-		return
+	idxs := []struct {
+		Seq     int    `db:"seq"`
+		Name    string `db:"name"`
+		Unique  bool   `db:"unique"`
+		Origin  string `db:"origin"`
+		Partial bool   `db:"partial"`
+	}{}
+	q = fmt.Sprintf(`PRAGMA index_list(%s)`, quoteIdent(t.Name))
+	if err := db.Select(&idxs, q); err != nil {
+		return errors.Wrap(err, "index list")
 	}
-	q = `
-		INSERT INTO metatmp
-		SELECT filename, content, md5, createdat FROM meta`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "")
+	for _, idx := range idxs {
+		idxCols := []struct {
+			SeqNo int            `db:"seqno"`
+			CID   int            `db:"cid"`
+			Name  sql.NullString `db:"name"`
+		}{}
+		q = fmt.Sprintf(`PRAGMA index_info(%s)`, quoteIdent(idx.Name))
+		if err := db.Select(&idxCols, q); err != nil {
+			return errors.Wrap(err, "index info")
+		}
+		index := migrate.Index{Name: idx.Name, Unique: idx.Unique}
+		for _, c := range idxCols {
+			// Expressions have no name
+			name := c.Name.String
+			if !c.Name.Valid {
+				name = "<expr>"
+			}
+			index.Columns = append(index.Columns, name)
+		}
+		t.Indexes = append(t.Indexes, index)
 	}
-	q = `DROP TABLE meta`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "drop meta")
-		return
+	sort.Slice(t.Indexes, func(i, j int) bool {
+		return t.Indexes[i].Name < t.Indexes[j].Name
+	})
+
+	fks := []struct {
+		ID       int            `db:"id"`
+		Seq      int            `db:"seq"`
+		Table    string         `db:"table"`
+		From     string         `db:"from"`
+		To       sql.NullString `db:"to"`
+		OnUpdate string         `db:"on_update"`
+		OnDelete string         `db:"on_delete"`
+		Match    string         `db:"match"`
+	}{}
+	q = fmt.Sprintf(`PRAGMA foreign_key_list(%s)`, quoteIdent(t.Name))
+	if err := db.Select(&fks, q); err != nil {
+		return errors.Wrap(err, "foreign key list")
 	}
-	q = `ALTER TABLE metatmp RENAME TO meta`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "rename metatmp 2")
-		return
+	for i := 0; i < len(fks); {
+		// Composite foreign keys span several rows sharing an id
+		var from, to []string
+		j := i
+		for ; j < len(fks) && fks[j].ID == fks[i].ID; j++ {
+			from = append(from, fks[j].From)
+			to = append(to, fks[j].To.String)
+		}
+		t.Constraints = append(t.Constraints, migrate.Constraint{
+			Type: "FOREIGN KEY",
+			Definition: fmt.Sprintf(
+				"FOREIGN KEY (%s) REFERENCES %s(%s) ON UPDATE %s ON DELETE %s",
+				strings.Join(from, ", "), fks[i].Table,
+				strings.Join(to, ", "), fks[i].OnUpdate,
+				fks[i].OnDelete),
+		})
+		i = j
 	}
+	sort.Slice(t.Constraints, func(i, j int) bool {
+		return t.Constraints[i].Definition < t.Constraints[j].Definition
+	})
+	return nil
+}
 
-	// Add the content column to metacheckpoints. Same song and dance as above
-	q = `CREATE TABLE metacheckpointstmp (
-		filename TEXT NOT NULL,
-		content TEXT NOT NULL,
-		idx INTEGER NOT NULL,
-		md5 TEXT NOT NULL,
-		createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		PRIMARY KEY (filename, idx)
-	)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "create metacheckpointstmp")
-		return
+// DumpSchema returns the statements which created every table, index, view
+// and trigger in the database.
+func (db *DB) DumpSchema() ([]string, error) {
+	objs := []struct {
+		Type  string `db:"type"`
+		Table string `db:"tbl_name"`
+		SQL   string `db:"sql"`
+	}{}
+	q := `
+		SELECT type, tbl_name, sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		ORDER BY CASE type
+			WHEN 'table' THEN 0
+			WHEN 'index' THEN 1
+			WHEN 'view' THEN 2
+			ELSE 3
+		END, rowid`
+	if err := db.Select(&objs, q); err != nil {
+		return nil, errors.Wrap(err, "select schema")
 	}
-	q = `
-		INSERT INTO metacheckpointstmp
-		SELECT filename, md5, createdat FROM meta`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "insert metacheckpointstmp")
+	var stmts []string
+	for _, o := range objs {
+		if migrate.IsMetaTable(o.Table) {
+			continue
+		}
+		stmts = append(stmts, o.SQL)
 	}
-	q = `DROP TABLE metacheckpoints`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "drop metacheckpoints")
-		return
+	return stmts, nil
+}
+
+// Scratch creates a temporary sqlite database file.
+func (db *DB) Scratch() (migrate.Store, func() error, error) {
+	fi, err := ioutil.TempFile("", "migrate-scratch-*.db")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "temp file")
 	}
-	q = `ALTER TABLE metacheckpointstmp RENAME TO metacheckpoints`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "rename metacheckpointstmp")
-		return
+	if err = fi.Close(); err != nil {
+		return nil, nil, errors.Wrap(err, "close temp file")
 	}
+	scratch := New(fi.Name(), db.opts...)
+	if err = scratch.Open(); err != nil {
+		_ = os.Remove(fi.Name())
+		return nil, nil, errors.Wrap(err, "open")
+	}
+	cleanup := func() error {
+		if err := scratch.Close(); err != nil {
+			return errors.Wrap(err, "close")
+		}
+		return os.Remove(fi.Name())
+	}
+	return scratch, cleanup, nil
+}
 
-	q = `CREATE TABLE IF NOT EXISTS metaversion (version INTEGER NOT NULL)`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "create metaversion table")
-		return
+// Tenant opens the named database file. sqlite has no concept of tenants, so
+// each is a separate file.
+func (db *DB) Tenant(name string) (migrate.Store, func() error, error) {
+	tenant := New(name, db.opts...)
+	if err := tenant.Open(); err != nil {
+		return nil, nil, errors.Wrap(err, "open")
 	}
-	q = `DELETE FROM metaversion`
-	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "delete metaversion")
-		return
+	return tenant, tenant.Close, nil
+}
+
+// TenantNames runs a query which returns the path to a database file in each
+// row.
+func (db *DB) TenantNames(query string) ([]string, error) {
+	names := []string{}
+	if err := db.Select(&names, query); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// MetaUpgradeSQL returns the statements which upgrade the meta tables to
+// version. sqlite can't modify columns, so tables are recreated instead,
+// using the same procedure as RebuildTable.
+func (db *DB) MetaUpgradeSQL(
+	version int,
+	migrations []migrate.Migration,
+) ([]migrate.MetaStatement, error) {
+	var stmts []migrate.MetaStatement
+	add := func(q string, args ...interface{}) {
+		stmts = append(stmts, migrate.MetaStatement{SQL: q, Args: args})
+	}
+	switch version {
+	case 1:
+		// Add a content column to record the exact migration that ran
+		// alongside the md5, insert the appropriate data, then
+		// recreate the table to set content not null and remove the
+		// uniqueness constraint from md5
+		add(`ALTER TABLE meta ADD COLUMN content TEXT`)
+		for _, m := range migrations {
+			add(`UPDATE meta SET content=$1 WHERE filename=$2`,
+				m.Content, m.Filename)
+		}
+		rebuild, err := rebuildSQL(db, "meta", `CREATE TABLE meta (
+			filename TEXT UNIQUE NOT NULL,
+			md5 TEXT NOT NULL,
+			content TEXT NOT NULL,
+			createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`, []string{"filename", "md5", "content", "createdat"})
+		if err != nil {
+			return nil, errors.Wrap(err, "rebuild meta")
+		}
+		for _, q := range rebuild {
+			add(q)
+		}
+
+		// Add the content column to metacheckpoints, which must be
+		// empty
+		add(`DROP TABLE metacheckpoints`)
+		add(`CREATE TABLE metacheckpoints (
+			filename TEXT NOT NULL,
+			content TEXT NOT NULL,
+			idx INTEGER NOT NULL,
+			md5 TEXT NOT NULL,
+			createdat TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (filename, idx)
+		)`)
+	case 2:
+		// Add the release column. The version is recorded again once
+		// the upgrade completes.
+		add(`DROP TABLE metaversion`)
+		add(`CREATE TABLE metaversion (
+			version INTEGER NOT NULL,
+			migraterelease TEXT NOT NULL
+		)`)
+	default:
+		return nil, fmt.Errorf("unknown meta version %d", version)
+	}
+	return stmts, nil
+}
+
+// UpgradeMeta runs stmts in a single transaction and records v as the meta
+// version.
+func (db *DB) UpgradeMeta(
+	v migrate.MetaVersion,
+	stmts []migrate.MetaStatement,
+) (err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin tx")
 	}
-	q = `INSERT INTO metaversion (version) VALUES (1)`
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt.SQL, stmt.Args...); err != nil {
+			return errors.Wrapf(err, "exec %q", stmt.SQL)
+		}
+	}
+	q := `DELETE FROM metaversion`
 	if _, err = tx.Exec(q); err != nil {
-		err = errors.Wrap(err, "update metaversion")
-		return
+		return errors.Wrap(err, "delete metaversion")
+	}
+	q = `INSERT INTO metaversion (version, migraterelease) VALUES ($1, $2)`
+	if _, err = tx.Exec(q, v.Version, v.Release); err != nil {
+		return errors.Wrap(err, "insert metaversion")
 	}
 	return nil
 }
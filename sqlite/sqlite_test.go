@@ -1,11 +1,18 @@
 package sqlite
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/egtann/migrate"
+	"github.com/egtann/migrate/migratetest"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 )
 
 const checkpointFile = "2.sql"
@@ -104,7 +111,7 @@ func TestDeleteMetaCheckpoints(t *testing.T) {
 	t.Parallel()
 	db := setupDBV1(t)
 
-	err := db.DeleteMetaCheckpoints()
+	err := db.DeleteMetaCheckpoints(checkpointFile)
 	check(t, err)
 
 	mcs, err := db.GetMetaCheckpoints(checkpointFile)
@@ -114,6 +121,660 @@ func TestDeleteMetaCheckpoints(t *testing.T) {
 	}
 }
 
+func TestCompleteMigration(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+
+	err := db.CompleteMigration(checkpointFile, "SELECT 2;", "md5")
+	check(t, err)
+
+	mcs, err := db.GetMetaCheckpoints(checkpointFile)
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatal("expected 0 checkpoints")
+	}
+	filenames, err := db.GetMetaCheckpointFilenames()
+	check(t, err)
+	if len(filenames) != 0 {
+		t.Fatalf("expected no checkpoint files, got %v", filenames)
+	}
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 2 || ms[1].Filename != checkpointFile {
+		t.Fatalf("expected %s to be recorded, got %+v", checkpointFile, ms)
+	}
+}
+
+func TestReplaceMigrations(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+
+	err := db.InsertMigration("2.sql", "SELECT 2;", "md5")
+	check(t, err)
+
+	err = db.ReplaceMigrations([]string{"1.sql", "2.sql"}, "2_squash.sql",
+		"SELECT 1;", "md5")
+	check(t, err)
+
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "2_squash.sql" {
+		t.Fatalf("expected only 2_squash.sql, got %+v", ms)
+	}
+}
+
+func TestDumpSchema(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+
+	q := `CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT NOT NULL)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	q = `CREATE INDEX users_email_idx ON users (email)`
+	_, err = db.DB.Exec(q)
+	check(t, err)
+
+	stmts, err := db.DumpSchema()
+	check(t, err)
+	if len(stmts) == 0 || !strings.Contains(stmts[0], "CREATE TABLE") {
+		t.Fatalf("expected CREATE TABLE first, got %v", stmts)
+	}
+	if !strings.Contains(stmts[len(stmts)-1], "users_email_idx") {
+		t.Fatalf("expected users_email_idx last, got %v", stmts)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	t.Parallel()
+	db := setupDBV1(t)
+
+	q := `
+		CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			email TEXT UNIQUE NOT NULL,
+			name TEXT DEFAULT 'anon'
+		);
+		CREATE TABLE posts (
+			id INTEGER PRIMARY KEY,
+			userid INTEGER NOT NULL REFERENCES users(id),
+			body TEXT
+		);
+		CREATE INDEX posts_userid_idx ON posts (userid)`
+	_, err := db.DB.Exec(q)
+	check(t, err)
+
+	schema, err := db.Schema()
+	check(t, err)
+	if len(schema.Tables) != 2 {
+		t.Fatalf("expected 2 tables, got %d", len(schema.Tables))
+	}
+	users := schema.Tables["users"]
+	if len(users.Columns) != 3 {
+		t.Fatalf("expected 3 columns, got %d", len(users.Columns))
+	}
+	if users.Columns[2].Default != "'anon'" || !users.Columns[2].Nullable {
+		t.Fatalf("unexpected column %+v", users.Columns[2])
+	}
+	if len(users.Indexes) != 1 || !users.Indexes[0].Unique {
+		t.Fatalf("expected 1 unique index, got %+v", users.Indexes)
+	}
+	posts := schema.Tables["posts"]
+	if len(posts.Indexes) != 1 || posts.Indexes[0].Name != "posts_userid_idx" {
+		t.Fatalf("unexpected indexes %+v", posts.Indexes)
+	}
+	if len(posts.Constraints) != 2 {
+		t.Fatalf("expected 2 constraints, got %+v", posts.Constraints)
+	}
+}
+
+func TestApplyMigrations(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"1.sql": {Data: []byte(`CREATE TABLE users (id INTEGER PRIMARY KEY);`)},
+		"2.sql": {Data: []byte(`ALTER TABLE users ADD COLUMN email TEXT;`)},
+	}
+
+	// The migrations run against a scratch file, not the live database
+	live := New(":memory:")
+	db := migratetest.Apply(t, fsys, live)
+	_, err := db.Exec(`INSERT INTO users (email) VALUES ('a@example.com')`)
+	check(t, err)
+	if live.DB != nil {
+		t.Fatal("expected the live database to be untouched")
+	}
+
+	// Down migrations must restore the schema
+	fsys["3.sql"] = &fstest.MapFile{
+		Data: []byte(`CREATE INDEX users_email_idx ON users (email);`),
+	}
+	fsys["3.down.sql"] = &fstest.MapFile{
+		Data: []byte(`DROP INDEX users_email_idx;`),
+	}
+	migratetest.Apply(t, fsys, live, migratetest.WithReversibility())
+}
+
+func TestDSNPragmas(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "1.sql", `CREATE TABLE posts (id INTEGER);`)
+
+	db := New(filepath.Join(dir, "live.db") + pragmaDSN)
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+
+	var journalMode string
+	err = db.Get(&journalMode, `PRAGMA journal_mode`)
+	check(t, err)
+	if journalMode != "wal" {
+		t.Fatalf("expected wal journal mode, got %s", journalMode)
+	}
+	var foreignKeys, busyTimeout int
+	err = db.Get(&foreignKeys, `PRAGMA foreign_keys`)
+	check(t, err)
+	err = db.Get(&busyTimeout, `PRAGMA busy_timeout`)
+	check(t, err)
+	if foreignKeys != 1 || busyTimeout != 5000 {
+		t.Fatalf("expected foreign keys and busy timeout, got %d and %d",
+			foreignKeys, busyTimeout)
+	}
+
+	m, err := migrate.New(db, migrate.WithDir(dir))
+	check(t, err)
+	_, err = m.Migrate()
+	check(t, err)
+	if _, err = os.Stat(filepath.Join(dir, "live.db")); err != nil {
+		t.Fatalf("expected pragmas to be removed from the filename: %v",
+			err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+
+	db := New(filepath.Join(dir, "live.db"), WithForeignKeys(),
+		WithJournalMode("WAL"), WithBusyTimeout(2*time.Second),
+		WithSynchronous("NORMAL"))
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+
+	var journalMode string
+	err = db.Get(&journalMode, `PRAGMA journal_mode`)
+	check(t, err)
+	var foreignKeys, busyTimeout, synchronous int
+	err = db.Get(&foreignKeys, `PRAGMA foreign_keys`)
+	check(t, err)
+	err = db.Get(&busyTimeout, `PRAGMA busy_timeout`)
+	check(t, err)
+	err = db.Get(&synchronous, `PRAGMA synchronous`)
+	check(t, err)
+	if journalMode != "wal" || foreignKeys != 1 || busyTimeout != 2000 ||
+		synchronous != 1 {
+		t.Fatalf("unexpected pragmas: %s %d %d %d", journalMode,
+			foreignKeys, busyTimeout, synchronous)
+	}
+
+	bad := New(filepath.Join(dir, "bad.db"), WithJournalMode("WAL; DROP"))
+	if err = bad.Open(); err == nil {
+		t.Fatal("expected invalid journal mode to fail")
+	}
+}
+
+func TestChecks(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE users (id INTEGER PRIMARY KEY);
+		CREATE TABLE posts (
+			id INTEGER PRIMARY KEY,
+			userid INTEGER REFERENCES users (id)
+		);`)
+	writeFile(t, dir, "2.sql", `INSERT INTO posts (userid) VALUES (42);`)
+
+	// Foreign keys aren't enforced, so only the check catches this
+	db := New(filepath.Join(dir, "live.db"), WithChecks())
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+
+	m, err := migrate.New(db, migrate.WithDir(dir),
+		migrate.WithTransactions(migrate.TxPerFile))
+	check(t, err)
+	_, err = m.Migrate()
+	var checkErr *CheckError
+	if !errors.As(err, &checkErr) || checkErr.Check != "foreign_key_check" {
+		t.Fatalf("expected foreign key check error, got %v", err)
+	}
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Filename != "1.sql" {
+		t.Fatalf("expected only 1.sql, got %+v", ms)
+	}
+	var posts int
+	err = db.Get(&posts, `SELECT COUNT(*) FROM posts`)
+	check(t, err)
+	if posts != 0 {
+		t.Fatalf("expected 2.sql to be rolled back, got %d posts", posts)
+	}
+}
+
+func TestRebuildTable(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+
+	db := New(filepath.Join(dir, "live.db"), WithForeignKeys())
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+
+	for _, q := range []string{
+		`CREATE TABLE posts (
+			id INTEGER PRIMARY KEY,
+			title TEXT UNIQUE,
+			body TEXT,
+			score TEXT
+		)`,
+		`CREATE TABLE comments (
+			id INTEGER PRIMARY KEY,
+			postid INTEGER NOT NULL REFERENCES posts (id)
+				ON DELETE CASCADE
+		)`,
+		`CREATE INDEX posts_score ON posts (score)`,
+		`CREATE TABLE audit (postid INTEGER)`,
+		`CREATE TRIGGER posts_audit AFTER INSERT ON posts BEGIN
+			INSERT INTO audit (postid) VALUES (NEW.id);
+		END`,
+		`CREATE VIEW titles AS SELECT title FROM posts`,
+		`INSERT INTO posts (title, body, score) VALUES ('a', 'b', '3')`,
+		`INSERT INTO comments (postid) VALUES (1)`,
+	} {
+		_, err = db.Exec(q)
+		check(t, err)
+	}
+
+	// Drop body, change score's type and make title required
+	err = db.RebuildTable("posts", `CREATE TABLE posts (
+		id INTEGER PRIMARY KEY,
+		title TEXT UNIQUE NOT NULL,
+		score INTEGER
+	)`)
+	check(t, err)
+
+	var score int
+	err = db.Get(&score, `SELECT score FROM posts WHERE title = 'a'`)
+	check(t, err)
+	if score != 3 {
+		t.Fatalf("expected score 3, got %d", score)
+	}
+	var comments int
+	err = db.Get(&comments, `SELECT COUNT(*) FROM comments`)
+	check(t, err)
+	if comments != 1 {
+		t.Fatal("expected rebuilding not to cascade to comments")
+	}
+	var names []string
+	err = db.Select(&names, `
+		SELECT name FROM sqlite_master
+		WHERE name IN ('posts_score', 'posts_audit', 'titles')
+		ORDER BY name`)
+	check(t, err)
+	if strings.Join(names, ",") != "posts_audit,posts_score,titles" {
+		t.Fatalf("expected index, trigger and view, got %v", names)
+	}
+	_, err = db.Exec(`INSERT INTO posts (title) VALUES ('c')`)
+	check(t, err)
+	var audits int
+	err = db.Get(&audits, `SELECT COUNT(*) FROM audit`)
+	check(t, err)
+	if audits != 2 {
+		t.Fatalf("expected trigger to run, got %d audits", audits)
+	}
+	var foreignKeys bool
+	err = db.Get(&foreignKeys, `PRAGMA foreign_keys`)
+	check(t, err)
+	if !foreignKeys {
+		t.Fatal("expected foreign keys to be enabled again")
+	}
+
+	// A rebuild which breaks an index is rolled back
+	err = db.RebuildTable("posts", `CREATE TABLE posts (
+		id INTEGER PRIMARY KEY,
+		title TEXT UNIQUE NOT NULL
+	)`)
+	if err == nil {
+		t.Fatal("expected dropping an indexed column to fail")
+	}
+	err = db.Get(&score, `SELECT score FROM posts WHERE title = 'a'`)
+	check(t, err)
+
+	if err = db.RebuildTable("posts", `CREATE TABLE users (id INTEGER)`); err == nil {
+		t.Fatal("expected a different table name to fail")
+	}
+}
+
+func TestMetaUpgradeRebuild(t *testing.T) {
+	t.Parallel()
+
+	// Upgrading to v1 rebuilds meta the same way as RebuildTable, so views
+	// over it survive
+	db := setupDBV0(t)
+	defer db.Close()
+	_, err := db.DB.Exec(`CREATE VIEW metafiles AS SELECT filename FROM meta`)
+	check(t, err)
+	_, err = db.CreateMetaVersionIfNotExists()
+	check(t, err)
+	stmts, err := db.MetaUpgradeSQL(1, []migrate.Migration{{
+		Filename: "1.sql",
+		Checksum: "md5",
+		Content:  "SELECT 1;",
+	}})
+	check(t, err)
+	var rebuilt bool
+	for _, stmt := range stmts {
+		if strings.Contains(stmt.SQL, `"migrate_rebuild_meta"`) {
+			rebuilt = true
+		}
+	}
+	if !rebuilt {
+		t.Fatalf("expected meta to be rebuilt, got %+v", stmts)
+	}
+	check(t, db.UpgradeMeta(migrate.MetaVersion{Version: 1}, stmts))
+
+	var content string
+	check(t, db.Get(&content, `SELECT content FROM meta WHERE filename = '1.sql'`))
+	if content != "SELECT 1;" {
+		t.Fatalf("expected the content to be copied, got %q", content)
+	}
+	var n int
+	check(t, db.Get(&n, `SELECT COUNT(*) FROM metafiles`))
+	if n != 1 {
+		t.Fatalf("expected the view to be recreated, got %d rows", n)
+	}
+
+	// md5 is no longer unique
+	err = db.UpsertMigration("2.sql", "SELECT 1;", "md5")
+	check(t, err)
+}
+
+func TestRebuildDirective(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "1.sql", `
+		CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT);
+		INSERT INTO posts (title) VALUES ('a');`)
+	writeFile(t, dir, "2.sql", `
+		-- Titles are now required
+		-- migrate:rebuild posts
+		CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT NOT NULL);
+		INSERT INTO posts (title) VALUES ('b');`)
+
+	db := New(filepath.Join(dir, "live.db"))
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+
+	m, err := migrate.New(db, migrate.WithDir(dir))
+	check(t, err)
+	check(t, m.Init())
+	plan, err := m.Plan()
+	check(t, err)
+	stmts := plan.Steps[1].Statements
+	if len(stmts) != 2 || stmts[0].Rebuild != "posts" || stmts[0].Line != 4 {
+		t.Fatalf("expected rebuild of posts on line 4, got %+v", stmts)
+	}
+	check(t, m.Apply(plan))
+
+	var titles []string
+	err = db.Select(&titles, `SELECT title FROM posts ORDER BY id`)
+	check(t, err)
+	if strings.Join(titles, ",") != "a,b" {
+		t.Fatalf("expected a,b, got %v", titles)
+	}
+	_, err = db.Exec(`INSERT INTO posts (title) VALUES (NULL)`)
+	if err == nil {
+		t.Fatal("expected title to be required")
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	t.Parallel()
+	db := newDB()
+	db.SetMaxOpenConns(1)
+
+	err := db.SetTimeouts(time.Second, 250*time.Millisecond)
+	check(t, err)
+
+	var ms int
+	err = db.Get(&ms, `PRAGMA busy_timeout`)
+	check(t, err)
+	if ms != 250 {
+		t.Fatalf("expected busy_timeout 250, got %d", ms)
+	}
+}
+
+func TestSetTimeoutsKeepsBusyTimeout(t *testing.T) {
+	t.Parallel()
+	db := New(":memory:", WithBusyTimeout(3*time.Second))
+	check(t, db.Open())
+	defer db.Close()
+
+	busyTimeout := func() int {
+		t.Helper()
+		var ms int
+		check(t, db.Get(&ms, `PRAGMA busy_timeout`))
+		return ms
+	}
+
+	// A statement timeout alone leaves the busy timeout alone
+	check(t, db.SetTimeouts(time.Second, 0))
+	if ms := busyTimeout(); ms != 3000 {
+		t.Fatalf("expected busy_timeout 3000, got %d", ms)
+	}
+
+	// A lock timeout overrides it until the timeouts are reset
+	check(t, db.SetTimeouts(0, 250*time.Millisecond))
+	if ms := busyTimeout(); ms != 250 {
+		t.Fatalf("expected busy_timeout 250, got %d", ms)
+	}
+	check(t, db.SetTimeouts(0, 0))
+	if ms := busyTimeout(); ms != 3000 {
+		t.Fatalf("expected busy_timeout 3000 to be restored, got %d", ms)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+	writeFile(t, dir, "1.sql", `CREATE TABLE users (id INTEGER PRIMARY KEY);`)
+
+	db := New(filepath.Join(dir, "live.db"))
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+	m, err := migrate.New(db, migrate.WithDir(dir),
+		migrate.WithLockTimeout(10*time.Millisecond),
+		migrate.WithLockRetries(2, time.Millisecond))
+	check(t, err)
+	check(t, m.Init())
+	check(t, m.Upgrade())
+	_, err = m.Plan()
+	check(t, err)
+
+	// Hold a write lock from another connection
+	other, err := sqlx.Open(driverName, filepath.Join(dir, "live.db"))
+	check(t, err)
+	defer other.Close()
+	tx, err := other.Begin()
+	check(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`CREATE TABLE locked (id INTEGER)`)
+	check(t, err)
+
+	_, err = m.Migrate()
+	var lockErr *migrate.LockTimeoutError
+	if !errors.As(err, &lockErr) {
+		t.Fatalf("expected lock timeout error, got %v", err)
+	}
+	if lockErr.Attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", lockErr.Attempts)
+	}
+	if !db.IsLockTimeout(err) {
+		t.Fatal("expected IsLockTimeout")
+	}
+}
+
+func TestMetaUpgrade(t *testing.T) {
+	t.Parallel()
+	db := setupDBV0(t)
+	db.SetMaxOpenConns(1)
+	fsys := fstest.MapFS{"1.sql": {Data: []byte("SELECT 1;")}}
+
+	m, err := migrate.New(db, migrate.WithFS(fsys))
+	check(t, err)
+
+	// A plan reports the upgrades, before Init without creating the
+	// metaversion table
+	plan, err := m.Plan()
+	check(t, err)
+	if len(plan.MetaUpgrades) != 2 || len(plan.Steps) != 0 {
+		t.Fatalf("expected only 2 meta upgrades, got %+v", plan)
+	}
+	if v, err := db.GetMetaVersion(); err != nil || v.Version != 0 {
+		t.Fatalf("expected no meta version, got %+v, %v", v, err)
+	}
+	check(t, m.Init())
+	plan, err = m.Plan()
+	check(t, err)
+	var upgradeErr *migrate.UpgradeRequiredError
+	if err = m.Apply(plan); !errors.As(err, &upgradeErr) {
+		t.Fatalf("expected upgrade required error, got %v", err)
+	}
+	ups, err := m.MetaUpgrades()
+	check(t, err)
+	if len(ups) != 2 || ups[0].Version != 1 || ups[1].Version != 2 {
+		t.Fatalf("expected upgrades to v1 and v2, got %+v", ups)
+	}
+
+	// Upgrades wait for half-finished migrations
+	err = db.InsertMetaCheckpoint("2.sql", "SELECT 2", "md5", 0)
+	if err == nil {
+		t.Fatal("expected v0 checkpoints to have no content")
+	}
+	_, err = db.Exec(`INSERT INTO metacheckpoints (filename, idx, md5)
+		VALUES ('2.sql', 0, 'md5')`)
+	check(t, err)
+	if err = m.Upgrade(); err == nil {
+		t.Fatal("expected upgrade with checkpoints to fail")
+	}
+	_, err = db.Exec(`DELETE FROM metacheckpoints`)
+	check(t, err)
+
+	check(t, m.Upgrade())
+	ups, err = m.MetaUpgrades()
+	check(t, err)
+	if len(ups) != 0 {
+		t.Fatalf("expected no meta upgrades, got %+v", ups)
+	}
+	v, err := db.CreateMetaVersionIfNotExists()
+	check(t, err)
+	if v.Version != 2 || v.Release != migrate.Release {
+		t.Fatalf("expected v2 from %s, got %+v", migrate.Release, v)
+	}
+	ms, err := db.GetMigrations()
+	check(t, err)
+	if len(ms) != 1 || ms[0].Content != "SELECT 1;" {
+		t.Fatalf("expected content to be backfilled, got %+v", ms)
+	}
+
+}
+
+func TestTenant(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+
+	db := New(filepath.Join(dir, "live.db"))
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+
+	// Each tenant is a separate file
+	tenant, closeTenant, err := db.Tenant(filepath.Join(dir, "a.db"))
+	check(t, err)
+	_, err = tenant.Exec(`CREATE TABLE users (id INTEGER)`)
+	check(t, err)
+	check(t, closeTenant())
+	if _, err = os.Stat(filepath.Join(dir, "a.db")); err != nil {
+		t.Fatalf("expected a.db to be created: %v", err)
+	}
+	schema, err := db.Schema()
+	check(t, err)
+	if len(schema.Tables) != 0 {
+		t.Fatalf("expected no tables, got %v", schema.Tables)
+	}
+
+	_, _, err = db.Tenant(filepath.Join(dir, "missing", "b.db"))
+	if err == nil {
+		t.Fatal("expected a tenant in a missing directory to fail")
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	check(t, err)
+	defer os.RemoveAll(dir)
+
+	db := New(filepath.Join(dir, "live.db"))
+	err = db.Open()
+	check(t, err)
+	defer db.Close()
+	check(t, db.CreateMetaIfNotExists())
+	check(t, db.CreateMetaCheckpointsIfNotExists())
+
+	// Rolling back undoes both the statement and its checkpoint
+	check(t, db.BeginMigration())
+	_, err = db.Exec(`CREATE TABLE users (id INTEGER)`)
+	check(t, err)
+	check(t, db.InsertMetaCheckpoint("1.sql", "CREATE TABLE users", "md5", 0))
+	check(t, db.RollbackMigration())
+
+	schema, err := db.Schema()
+	check(t, err)
+	if len(schema.Tables) != 0 {
+		t.Fatalf("expected no tables, got %v", schema.Tables)
+	}
+	mcs, err := db.GetMetaCheckpoints("1.sql")
+	check(t, err)
+	if len(mcs) != 0 {
+		t.Fatalf("expected no checkpoints, got %d", len(mcs))
+	}
+}
+
 func check(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -121,10 +782,16 @@ func check(t *testing.T, err error) {
 	}
 }
 
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	check(t, err)
+}
+
 func newDB() *DB {
 	// Every database connection sees a different database, which is
 	// perfect, as that lets us run tests in parallel.
-	db, err := sqlx.Open("sqlite3", ":memory:")
+	db, err := sqlx.Open(driverName, ":memory:")
 	if err != nil {
 		panic(err)
 	}
@@ -133,12 +800,16 @@ func newDB() *DB {
 
 func setupDBV1(t *testing.T) *DB {
 	db := setupDBV0(t)
-	err := db.UpgradeToV1([]migrate.Migration{{
+	_, err := db.CreateMetaVersionIfNotExists()
+	check(t, err)
+	stmts, err := db.MetaUpgradeSQL(1, []migrate.Migration{{
 		Filename: "1.sql",
 		Checksum: "md5",
 		Content:  "SELECT 1;",
 	}})
 	check(t, err)
+	err = db.UpgradeMeta(migrate.MetaVersion{Version: 1}, stmts)
+	check(t, err)
 
 	q := `
 		INSERT INTO metacheckpoints (idx, filename, content, md5)
@@ -0,0 +1,235 @@
+package migrate
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing/fstest"
+
+	"github.com/pkg/errors"
+)
+
+// Dumper is implemented by Stores which can generate the statements needed
+// to recreate their schema, excluding migrate's own meta tables.
+type Dumper interface {
+	DumpSchema() ([]string, error)
+}
+
+// Squash migrates a scratch database through the migration file named
+// through, which may be a filename or its leading number, then dumps the
+// resulting schema as the content for a single migration that supersedes
+// every file up to and including it. db must implement Introspector, and its
+// scratch databases must implement Dumper. opts are passed to New when
+// migrating the scratch database.
+//
+// The squashed file is checked by migrating a second scratch database with
+// it alone, which must end up with the same schema. Objects whose
+// definitions hold several statements, such as triggers and functions, can't
+// be split from the rest of the file, so Squash refuses to include them.
+//
+// Save the result with the same leading number as the last superseded file,
+// then delete the originals. Databases which already ran the originals will
+// record the squashed file in their place the next time they're migrated.
+//
+// Only the schema is squashed. Any data inserted by the original migrations
+// is not included.
+func Squash(
+	db Store,
+	through string,
+	opts ...Option,
+) (content string, err error) {
+	live, ok := db.(Introspector)
+	if !ok {
+		return "", errors.New("store does not support introspection")
+	}
+	scratch, cleanup, err := live.Scratch()
+	if err != nil {
+		return "", errors.Wrap(err, "create scratch db")
+	}
+	defer func() {
+		if err2 := cleanup(); err2 != nil && err == nil {
+			err = errors.Wrap(err2, "remove scratch db")
+		}
+	}()
+	dumper, ok := scratch.(Dumper)
+	if !ok {
+		return "", errors.New("store does not support dumping its schema")
+	}
+
+	m, err := New(scratch, opts...)
+	if err != nil {
+		return "", errors.Wrap(err, "new scratch")
+	}
+	index := -1
+	for i, fi := range m.Files {
+		num := regexNum.FindString(path.Base(fi.Name()))
+		if fi.Name() == through || num == through ||
+			path.Join(namespace(fi.Name()), num) == through {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return "", fmt.Errorf("%s does not exist", through)
+	}
+
+	// Run only the files being squashed. Repeatable files run again
+	// whenever they change, so they're never squashed.
+	name := path.Base(m.Files[index].Name())
+	m.Files, m.Repeatables, m.baseline = m.Files[:index+1], nil, ""
+	if _, err = m.Migrate(); err != nil {
+		return "", errors.Wrap(err, "migrate scratch")
+	}
+	superseded := m.Migrations
+	stmts, err := dumper.DumpSchema()
+	if err != nil {
+		return "", errors.Wrap(err, "dump schema")
+	}
+
+	var b strings.Builder
+	for _, stmt := range stmts {
+		fmt.Fprintf(&b, "%s;\n\n", stmt)
+	}
+
+	// These comments must follow the last statement. A statement which
+	// begins with a comment is skipped when migrating.
+	b.WriteString("-- This file was generated by migrate squash. It supersedes the\n")
+	b.WriteString("-- migrations below, which must be removed.\n")
+	for _, mg := range superseded {
+		fmt.Fprintf(&b, "-- migrate:squash %s %s\n", mg.Filename,
+			mg.Checksum)
+	}
+	content = b.String()
+
+	// Each dumped statement must be read back unchanged
+	split := m.split(content)
+	for i, stmt := range stmts {
+		stmt = strings.TrimSpace(stmt)
+		if i >= len(split) || split[i].SQL != stmt {
+			return "", fmt.Errorf(
+				"can't squash %q: it holds several statements, such as a trigger or function body",
+				firstLine(stmt))
+		}
+	}
+	if len(split) != len(stmts) {
+		return "", fmt.Errorf("squashed file has %d statements, want %d",
+			len(split), len(stmts))
+	}
+
+	// And migrating a fresh database with the squashed file alone must
+	// give the same schema
+	want, err := scratch.(Introspector).Schema()
+	if err != nil {
+		return "", errors.Wrap(err, "scratch schema")
+	}
+	verify, cleanupVerify, err := live.Scratch()
+	if err != nil {
+		return "", errors.Wrap(err, "create scratch db")
+	}
+	defer func() {
+		if err2 := cleanupVerify(); err2 != nil && err == nil {
+			err = errors.Wrap(err2, "remove scratch db")
+		}
+	}()
+	fsys := fstest.MapFS{name: &fstest.MapFile{Data: []byte(content)}}
+	m, err = New(verify, append(opts, WithFS(fsys))...)
+	if err != nil {
+		return "", errors.Wrap(err, "new scratch")
+	}
+	m.baseline = ""
+	if _, err = m.Migrate(); err != nil {
+		return "", errors.Wrap(err, "migrate squashed file")
+	}
+	got, err := verify.(Introspector).Schema()
+	if err != nil {
+		return "", errors.Wrap(err, "squashed schema")
+	}
+	if diffs := Diff(want, got); len(diffs) > 0 {
+		return "", fmt.Errorf("squashed file gives a different schema: %s",
+			strings.Join(diffs, "; "))
+	}
+	return content, nil
+}
+
+// firstLine returns the first line of s, to identify a statement in errors.
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// squashed reports the migrations superseded by a file, if it was generated
+// by Squash.
+func (m *Migrate) squashed(filename string) ([]Migration, error) {
+	byt, err := m.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var ms []Migration
+	for _, args := range directives(string(byt), "squash") {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("bad squash directive in %s: %v",
+				filename, args)
+		}
+		ms = append(ms, Migration{Filename: args[0], Checksum: args[1]})
+	}
+	return ms, nil
+}
+
+// supersedes reports whether history begins with every migration superseded
+// by a squashed file. It returns an error if those migrations ran, but their
+// checksums don't match the ones recorded when the file was squashed.
+func supersedes(history, originals []Migration) (bool, error) {
+	if len(originals) == 0 || len(history) < len(originals) {
+		return false, nil
+	}
+	for i, mg := range originals {
+		if history[i].Filename != mg.Filename {
+			return false, nil
+		}
+	}
+	for i, mg := range originals {
+		// We can't verify checksums recorded with a different algorithm,
+		// since the original file is gone
+		if checksumAlgorithm(history[i].Checksum) !=
+			checksumAlgorithm(mg.Checksum) {
+			continue
+		}
+		if history[i].Checksum != mg.Checksum {
+			return false, &ChecksumMismatchError{
+				File:   mg.Filename,
+				Stored: history[i].Checksum,
+				Actual: mg.Checksum,
+			}
+		}
+	}
+	return true, nil
+}
+
+// recordSquashes replaces the superseded migrations in the meta table with
+// the squashed files that replaced them.
+func (m *Migrate) recordSquashes(filenames []string) error {
+	for _, filename := range filenames {
+		originals, err := m.squashed(filename)
+		if err != nil {
+			return errors.Wrap(err, "squashed")
+		}
+		mg, err := m.migrationFromFile(filename)
+		if err != nil {
+			return errors.Wrap(err, "migration from file")
+		}
+		names := make([]string, len(originals))
+		for i, o := range originals {
+			names[i] = o.Filename
+		}
+		err = m.db.ReplaceMigrations(names, mg.Filename, mg.Content,
+			mg.Checksum)
+		if err != nil {
+			return errors.Wrap(err, "replace migrations")
+		}
+		m.log.Info("recorded squashed migration", "file", filename,
+			"superseded", len(originals))
+	}
+	return nil
+}
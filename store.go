@@ -1,15 +1,41 @@
 package migrate
 
 import (
+	"context"
 	"database/sql"
+	"io"
+	"time"
 )
 
 type Store interface {
 	Open() error
 	Exec(string, ...interface{}) (sql.Result, error)
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+
+	// SetTimeouts for every following statement. A zero duration restores
+	// the database's default timeout, which is usually none. Stores must
+	// run every statement on one pinned connection whose session isn't
+	// reset between statements, so that settings like these apply to
+	// each.
+	SetTimeouts(statement, lock time.Duration) error
+
+	// IsLockTimeout reports whether err was caused by a statement timing
+	// out while waiting to acquire a lock.
+	IsLockTimeout(error) bool
+
+	// MetaExists reports whether the meta table exists, so new meta
+	// tables can be created at the current version.
+	MetaExists() (bool, error)
 
 	// CreateMetaversionIfNotExists and report the current version.
-	CreateMetaVersionIfNotExists() (int, error)
+	CreateMetaVersionIfNotExists() (MetaVersion, error)
+
+	// GetMetaVersion reports the current version without changing the
+	// database. It's zero if there's no metaversion table.
+	GetMetaVersion() (MetaVersion, error)
+
+	// CreateMetaIfNotExists and CreateMetaCheckpointsIfNotExists create
+	// tables in the format of the current version.
 	CreateMetaIfNotExists() error
 	CreateMetaCheckpointsIfNotExists() error
 
@@ -17,9 +43,76 @@ type Store interface {
 	InsertMigration(filename, content, checksum string) error
 	UpsertMigration(filename, content, checksum string) error
 
+	// ReplaceMigrations atomically deletes the named migrations and
+	// inserts a new one in their place.
+	ReplaceMigrations(old []string, filename, content, checksum string) error
+
 	GetMetaCheckpoints(string) ([]string, error)
 	InsertMetaCheckpoint(filename, content, checksum string, idx int) error
-	DeleteMetaCheckpoints() error
+	DeleteMetaCheckpoints(filename string) error
+
+	// GetMetaCheckpointFilenames reports every file with checkpoints.
+	GetMetaCheckpointFilenames() ([]string, error)
+
+	// CompleteMigration atomically deletes a file's checkpoints and
+	// records it as migrated, replacing any earlier record of the same
+	// file. Within a Transactor's migration, it joins that transaction.
+	CompleteMigration(filename, content, checksum string) error
+
+	// MetaUpgradeSQL returns the statements which upgrade the meta tables
+	// to version from the version before it. migrations hold the content
+	// of every migration file, for upgrades which backfill it.
+	MetaUpgradeSQL(version int, migrations []Migration) ([]MetaStatement, error)
+
+	// UpgradeMeta runs stmts in a single transaction and records v as
+	// the meta version.
+	UpgradeMeta(v MetaVersion, stmts []MetaStatement) error
+}
+
+// Transactor is implemented by Stores which can run a migration file in a
+// single transaction, as required by WithTransactions(TxPerFile). The
+// transaction spans the Store's pinned connection, so every Store method
+// called between BeginMigration and CommitMigration is part of it.
+type Transactor interface {
+	BeginMigration() error
+	CommitMigration() error
+	RollbackMigration() error
+}
+
+// Rebuilder is implemented by Stores which can rebuild a table to make
+// changes that ALTER TABLE can't, as required by statements following a
+// "-- migrate:rebuild <table>" directive. RebuildTable recreates table to
+// match create, a CREATE TABLE statement for the same table, and copies the
+// columns the two share.
+type Rebuilder interface {
+	RebuildTable(table, create string) error
+}
+
+// Copier is implemented by Stores which can bulk load the rows following a
+// COPY ... FROM STDIN statement, as in the output of pg_dump. CopyFrom reports
+// the number of rows copied.
+type Copier interface {
+	CopyFrom(ctx context.Context, stmt string, rows io.Reader) (int64, error)
+}
+
+// Batcher is implemented by Stores whose migrations are divided into batches
+// by separator lines, like SQL Server's GO, rather than into statements by
+// semicolons. Each batch runs as a single statement with its own checkpoint.
+type Batcher interface {
+	IsBatchSeparator(line string) bool
+}
+
+// ErrorDescriber is implemented by Stores which can report more about why a
+// statement failed, and where in the statement.
+type ErrorDescriber interface {
+	DescribeError(err error) ErrorDescription
+}
 
-	UpgradeToV1([]Migration) error
+// ErrorDescription describes a failed statement. Position is the character
+// in the statement where the error occurred, starting at 1, or 0 if unknown.
+type ErrorDescription struct {
+	Code     string
+	Position int
+	Detail   string
+	Hint     string
 }
@@ -0,0 +1,179 @@
+package migrate
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tenanter is implemented by Stores which hold many tenants, each with its
+// own tables and meta tables, such as schemas in a Postgres database or
+// databases on a MySQL server.
+type Tenanter interface {
+	// Tenant opens a Store scoped to the named tenant. Call the returned
+	// function to close it.
+	Tenant(name string) (Store, func() error, error)
+
+	// TenantNames runs a query which returns the name of a tenant in each
+	// row.
+	TenantNames(query string) ([]string, error)
+}
+
+// Locker is implemented by Stores which can take an exclusive lock on their
+// migrations, so that two processes can't migrate the same database or tenant
+// at once. Migrate and Apply hold the lock while they run. It's held by the
+// Store's pinned connection until Unlock.
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// TenantStatus is the outcome of migrating a single tenant.
+type TenantStatus string
+
+const (
+	TenantMigrated TenantStatus = "migrated"
+	TenantUpToDate TenantStatus = "up to date"
+	TenantFailed   TenantStatus = "failed"
+
+	// TenantSkipped means the tenant was not migrated, because another
+	// failed first and we stopped.
+	TenantSkipped TenantStatus = "skipped"
+)
+
+// TenantResult reports the outcome of migrating a single tenant. Err is set
+// when Status is TenantFailed.
+type TenantResult struct {
+	Tenant string
+	Status TenantStatus
+	Err    error
+}
+
+// TenantConfig controls how MigrateTenants runs.
+type TenantConfig struct {
+	// Concurrency is the most tenants to migrate at once. Values below 1
+	// migrate one at a time.
+	Concurrency int
+
+	// ContinueOnError migrates the remaining tenants after one fails.
+	// Otherwise, tenants which haven't started are skipped.
+	ContinueOnError bool
+}
+
+// MigrateTenants migrates each tenant in db, which must implement Tenanter,
+// and reports the outcome for each in the same order as tenants. Each tenant
+// is locked while it migrates if its Store implements Locker. opts are passed
+// to New for every tenant, and log messages include a "tenant" key.
+func MigrateTenants(
+	db Store,
+	tenants []string,
+	cfg TenantConfig,
+	opts ...Option,
+) ([]TenantResult, error) {
+	t, ok := db.(Tenanter)
+	if !ok {
+		return nil, errors.New("store does not support tenants")
+	}
+	concurrency := cfg.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]TenantResult, len(tenants))
+	var (
+		mu      sync.Mutex
+		stopped bool
+		wg      sync.WaitGroup
+	)
+	sem := make(chan struct{}, concurrency)
+	for i, name := range tenants {
+		results[i] = TenantResult{Tenant: name, Status: TenantSkipped}
+
+		sem <- struct{}{}
+		mu.Lock()
+		stop := stopped
+		mu.Unlock()
+		if stop {
+			<-sem
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			status, err := migrateTenant(t, name, opts)
+			mu.Lock()
+			defer mu.Unlock()
+			results[i].Status = status
+			results[i].Err = err
+			if err != nil && !cfg.ContinueOnError {
+				stopped = true
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func migrateTenant(
+	t Tenanter,
+	name string,
+	opts []Option,
+) (status TenantStatus, err error) {
+	db, closeDB, err := t.Tenant(name)
+	if err != nil {
+		return TenantFailed, errors.Wrap(err, "open tenant")
+	}
+	defer func() {
+		if err2 := closeDB(); err2 != nil && err == nil {
+			status, err = TenantFailed, errors.Wrap(err2, "close tenant")
+		}
+	}()
+
+	// Options are applied in order, so this wraps whichever logger the
+	// caller chose
+	opts = append(opts[:len(opts):len(opts)], func(m *Migrate) {
+		m.log = tenantLogger{log: m.log, tenant: name}
+	})
+	m, err := New(db, opts...)
+	if err != nil {
+		return TenantFailed, err
+	}
+	migrated, err := m.Migrate()
+	switch {
+	case err != nil:
+		return TenantFailed, err
+	case migrated:
+		return TenantMigrated, nil
+	default:
+		return TenantUpToDate, nil
+	}
+}
+
+// tenantLogger adds the tenant to every message.
+type tenantLogger struct {
+	log    LevelLogger
+	tenant string
+}
+
+func (l tenantLogger) Debug(msg string, kvs ...interface{}) {
+	l.log.Debug(msg, l.kvs(kvs)...)
+}
+
+func (l tenantLogger) Info(msg string, kvs ...interface{}) {
+	l.log.Info(msg, l.kvs(kvs)...)
+}
+
+func (l tenantLogger) Warn(msg string, kvs ...interface{}) {
+	l.log.Warn(msg, l.kvs(kvs)...)
+}
+
+func (l tenantLogger) Error(msg string, kvs ...interface{}) {
+	l.log.Error(msg, l.kvs(kvs)...)
+}
+
+func (l tenantLogger) kvs(kvs []interface{}) []interface{} {
+	return append([]interface{}{"tenant", l.tenant}, kvs...)
+}